@@ -0,0 +1,67 @@
+package chunker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+// CheckReport - what Check found in a snapshot
+type CheckReport struct {
+	// Chunks is the number of chunks that were checked
+	Chunks int
+	// Damaged lists the chunks that are missing, cannot be read or
+	// decrypted, or do not match the digest the manifest holds for them
+	Damaged []string
+}
+
+// Check - verifies the metadata of snapshot tag the way Restore does,
+// then reads every chunk it references and checks it against its digest,
+// without restoring anything. chunks of snapshots taken before chunks had
+// digests are only checked to decrypt
+func (s *Multipart) Check(ctx context.Context, tag string) (*CheckReport, error) {
+	md, snapshotKey, err := s.loadMetadata(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	err = s.verifyMetadata(tag, md, false)
+	if err != nil {
+		return nil, err
+	}
+	report := &CheckReport{}
+	for _, fw := range md.Entities {
+		if !fw.IsFile() || fw.Size == 0 {
+			continue
+		}
+		for _, sec := range md.ChunkMap[fw.Hash] {
+			report.Chunks++
+			key := s.sectionKey(tag, fw, sec)
+			// backends decrypting what they store fail to read damaged
+			// chunks
+			entry, err := s.disk.Get(ctx, key)
+			if err != nil || entry == nil || entry.Value == nil {
+				report.Damaged = append(report.Damaged, key)
+				continue
+			}
+			value := entry.Value
+			if snapshotKey != nil && len(sec.ID) == 0 {
+				value, err = file.Decrypt(snapshotKey, value)
+			} else if len(sec.Key) != 0 {
+				value, err = file.Decrypt(sec.Key, value)
+			}
+			if err != nil {
+				report.Damaged = append(report.Damaged, key)
+				continue
+			}
+			if len(sec.Digest) != 0 {
+				digest := sha256.Sum256(value)
+				if hex.EncodeToString(digest[:]) != sec.Digest {
+					report.Damaged = append(report.Damaged, key)
+				}
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,320 @@
+package commands
+
+import (
+	"log"
+	"runtime"
+
+	splitter "github.com/damoonazarpazhooh/File-Ingestion"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/cache"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/erasure"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/keys"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/kvstore"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/mirror"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/pack"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/stripe"
+	utils "github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/palantir/stacktrace"
+	"github.com/urfave/cli"
+)
+
+// backendFlags are shared by every command that opens a repository
+var backendFlags = append(append(append(append(append(append(append(append(append([]cli.Flag{
+	cli.StringFlag{
+		Name:  "backend",
+		Value: "file",
+		Usage: "storage backend holding the repository. one of [file, bolt, mirror, erasure, stripe]",
+	},
+	cli.IntFlag{
+		Name:  "threads",
+		Value: 0,
+		Usage: "number of chunks, and objects of every disk, read or written at once. defaults to one per cpu",
+	},
+	cli.IntFlag{
+		Name:  "limit-upload",
+		Value: 0,
+		Usage: "most KiB a second written to every disk, shared by all threads. 0 means unlimited",
+	},
+	cli.IntFlag{
+		Name:  "limit-download",
+		Value: 0,
+		Usage: "most KiB a second read from every disk, shared by all threads. 0 means unlimited",
+	},
+	cli.BoolFlag{
+		Name:  "versioning",
+		Usage: "keep the prior version of objects that are overwritten or deleted, on every disk. see [versions]",
+	},
+}, databaseFlags...), mirrorFlags...), erasureFlags...), stripeFlags...), packFlags...), cacheFlags...), keyFlags...), cipherFlags...), recipientFlags...)
+
+// databaseFlags configure the bolt backend
+var databaseFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "database",
+		Value: "",
+		Usage: "path of the database file used by the bolt backend. defaults to [<path>/.chunks/repository.db]",
+	},
+}
+
+// mirrorFlags configure the mirror backend
+var mirrorFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "replica",
+		Usage: "root path of a replica used by the mirror backend. repeat for every replica",
+	},
+	cli.IntFlag{
+		Name:  "write-quorum",
+		Value: 0,
+		Usage: "number of replicas that must acknowledge a write. defaults to all replicas",
+	},
+	cli.BoolFlag{
+		Name:  "repair",
+		Usage: "rewrite objects on replicas found missing them, or holding corrupt or older copies, and delete objects from replicas a delete missed",
+	},
+}
+
+// erasureFlags configure the erasure backend
+var erasureFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "shard",
+		Usage: "root path of a disk holding shards for the erasure backend. repeat for every disk",
+	},
+	cli.IntFlag{
+		Name:  "parity",
+		Value: 1,
+		Usage: "number of parity shards. that many disks can be lost without losing data",
+	},
+}
+
+// stripeFlags configure the stripe backend
+var stripeFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "disk",
+		Usage: "root path of a disk used by the stripe backend. repeat for every disk",
+	},
+	cli.StringSliceFlag{
+		Name:  "drain",
+		Usage: "root path of a disk leaving the stripe backend. objects are read from it but not written to it until [rebalance] moved them off. repeat for every disk",
+	},
+}
+
+// packFlags configure bundling chunks into pack files
+var packFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "packs",
+		Usage: "bundle chunks into pack files instead of storing one object per chunk",
+	},
+	cli.Int64Flag{
+		Name:  "pack-size",
+		Value: 64,
+		Usage: "target size of pack files in mb",
+	},
+}
+
+// cacheFlags configure the local read cache
+var cacheFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "cache-dir",
+		Value: "",
+		Usage: "directory objects read from the backend are cached in, encrypted with the repository key. no cache is used if not set. cannot be used without the repository key, e.g. with --recipient",
+	},
+	cli.Int64Flag{
+		Name:  "cache-size",
+		Value: 256,
+		Usage: "capacity of the cache in mb. snapshot and chunk metadata do not count against it",
+	},
+}
+
+// cipherFlags select the cipher suite new objects are encrypted with
+var cipherFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "cipher",
+		Value: "aes-256-gcm",
+		Usage: "cipher suite new objects are encrypted with. one of [aes-256-gcm, xchacha20-poly1305]. existing objects are read with the suite they were written with",
+	},
+	cli.IntFlag{
+		Name:  "crypto-workers",
+		Value: 0,
+		Usage: "number of goroutines sealing and opening the bursts of an object. defaults to one per cpu",
+	},
+	cli.StringFlag{
+		Name:  "padding",
+		Value: "none",
+		Usage: "pads new encrypted objects so their size does not reveal the size of their contents. one of [none, pow2, random]. cannot be used with --convergent",
+	},
+	cli.Float64Flag{
+		Name:  "padding-overhead",
+		Value: 0.1,
+		Usage: "largest padding added by [--padding random], as a fraction of the object size",
+	},
+}
+
+// newBackend returns the backend selected by --backend for the repository
+// at path, encrypting objects with kr
+func newBackend(ctx *cli.Context, path string, kr *keys.Keyring) (file.Backend, error) {
+	backend, err := newBaseBackend(ctx, path, kr)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Bool("packs") {
+		backend = newPackStorage(ctx, backend)
+	}
+	if len(ctx.String("cache-dir")) != 0 {
+		// the cache holds decrypted objects, which only the repository key
+		// can keep confidential
+		if kr == nil {
+			err := stacktrace.NewError("[ERROR] --cache-dir needs the repository key to encrypt cached objects with")
+			return nil, err
+		}
+		backend = newCacheStorage(ctx, backend, kr)
+	}
+	return backend, nil
+}
+
+// newBaseBackend returns the backend selected by --backend without the
+// pack and cache layers. with a nil keyring, it is used to read key files.
+func newBaseBackend(ctx *cli.Context, path string, kr *keys.Keyring) (file.Backend, error) {
+	switch ctx.String("backend") {
+	case "", "file":
+		return newFileStorage(ctx, path, kr), nil
+	case "bolt":
+		return newKVStore(ctx, path, kr), nil
+	case "mirror":
+		return newMirrorStorage(ctx, kr), nil
+	case "erasure":
+		return newErasureStorage(ctx, kr), nil
+	case "stripe":
+		return newStripeStorage(ctx, kr), nil
+	}
+	err := stacktrace.NewError("unknown backend (%s)", ctx.String("backend"))
+	return nil, err
+}
+
+func newFileStorage(ctx *cli.Context, path string, kr *keys.Keyring, extra ...file.Option) *file.Storage {
+	opts := []file.Option{
+		file.WithNumberOfThreads(threads(ctx)),
+		file.WithUploadRateLimit(ctx.Int("limit-upload") * 1024),
+		file.WithDownloadRateLimit(ctx.Int("limit-download") * 1024),
+		file.WithPath(path),
+		file.WithPlaintextPrefixes(keys.Prefix, splitter.ConvergentPrefix),
+		file.LogOps(),
+	}
+	if kr != nil {
+		opts = append(opts, file.WithEncryptionKey(kr.Primary), file.WithFallbackKeys(kr.Fallback...))
+	}
+	opts = append(opts, file.WithCipher(cipherSuite(ctx)), file.WithCryptoWorkers(cryptoWorkers(ctx)), file.WithPadding(padding(ctx)))
+	opts = append(opts, recipientOptions(ctx)...)
+	if ctx.Bool("versioning") {
+		// keys that are replaced or destroyed must not live on as versions
+		opts = append(opts, file.WithVersioning(), file.WithUnversionedPrefixes(keys.Prefix, splitter.SnapshotKeyPrefix))
+	}
+	opts = append(opts, extra...)
+	return file.New(opts...)
+}
+
+func newKVStore(ctx *cli.Context, path string, kr *keys.Keyring) *kvstore.Storage {
+	database := ctx.String("database")
+	if len(database) == 0 {
+		database = utils.PathJoin(path, ".chunks", "repository.db")
+	}
+	opts := []kvstore.Option{
+		kvstore.LogOps(),
+		kvstore.WithPath(database),
+		kvstore.WithPlaintextPrefixes(keys.Prefix, splitter.ConvergentPrefix),
+	}
+	if kr != nil {
+		opts = append(opts, kvstore.WithEncryptionKey(kr.Primary), kvstore.WithFallbackKeys(kr.Fallback...), kvstore.WithCipher(cipherSuite(ctx)), kvstore.WithPadding(padding(ctx)))
+	}
+	return kvstore.New(opts...)
+}
+
+func newMirrorStorage(ctx *cli.Context, kr *keys.Keyring) *mirror.Storage {
+	opts := []mirror.Option{
+		mirror.LogOps(),
+		mirror.WithWriteQuorum(ctx.Int("write-quorum")),
+	}
+	for _, replica := range ctx.StringSlice("replica") {
+		opts = append(opts, mirror.WithReplicas(newFileStorage(ctx, replica, kr)))
+	}
+	if ctx.Bool("repair") {
+		opts = append(opts, mirror.WithRepair())
+	}
+	return mirror.New(opts...)
+}
+
+func newErasureStorage(ctx *cli.Context, kr *keys.Keyring) *erasure.Storage {
+	opts := []erasure.Option{
+		erasure.LogOps(),
+		erasure.WithParityShards(ctx.Int("parity")),
+	}
+	for _, shard := range ctx.StringSlice("shard") {
+		opts = append(opts, erasure.WithShards(newFileStorage(ctx, shard, kr)))
+	}
+	return erasure.New(opts...)
+}
+
+func newStripeStorage(ctx *cli.Context, kr *keys.Keyring) *stripe.Storage {
+	opts := []stripe.Option{
+		stripe.LogOps(),
+	}
+	for _, disk := range ctx.StringSlice("disk") {
+		opts = append(opts, stripe.WithDisks(newFileStorage(ctx, disk, kr)))
+	}
+	for _, disk := range ctx.StringSlice("drain") {
+		opts = append(opts, stripe.WithDrainingDisks(newFileStorage(ctx, disk, kr)))
+	}
+	return stripe.New(opts...)
+}
+
+func newPackStorage(ctx *cli.Context, backend file.Backend) *pack.Storage {
+	return pack.New(
+		pack.LogOps(),
+		pack.WithBackend(backend),
+		pack.WithTargetSizeInMegabytes(ctx.Int64("pack-size")),
+	)
+}
+
+func newCacheStorage(ctx *cli.Context, backend file.Backend, kr *keys.Keyring) *cache.Storage {
+	return cache.New(
+		cache.LogOps(),
+		cache.WithBackend(backend),
+		cache.WithPath(ctx.String("cache-dir")),
+		cache.WithSizeInMegabytes(ctx.Int64("cache-size")),
+		cache.WithEncryptionKey(kr.Primary),
+		cache.WithCipher(cipherSuite(ctx)),
+	)
+}
+
+// cipherSuite returns the cipher suite selected by --cipher
+func cipherSuite(ctx *cli.Context) byte {
+	id, err := file.ParseCipher(ctx.String("cipher"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return id
+}
+
+// padding returns the padding policy selected by --padding
+func padding(ctx *cli.Context) file.Padding {
+	policy, err := file.ParsePadding(ctx.String("padding"), ctx.Float64("padding-overhead"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return policy
+}
+
+// threads returns the number of parallel operations selected by --threads
+func threads(ctx *cli.Context) int {
+	if n := ctx.Int("threads"); n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
+// cryptoWorkers returns the number of goroutines selected by
+// --crypto-workers
+func cryptoWorkers(ctx *cli.Context) int {
+	if n := ctx.Int("crypto-workers"); n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
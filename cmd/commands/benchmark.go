@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/stream"
+	utils "github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+	"github.com/urfave/cli"
+)
+
+// benchmark ...
+var benchmark = cli.Command{
+	Name:    "Benchmark",
+	Aliases: []string{"benchmark"},
+	Usage:   "measures encryption and decryption throughput",
+	Description: `this command seals and opens --size mb of random data one burst at a time
+	and on --crypto-workers goroutines. both ways must give the same stream.
+	`,
+	Flags: append([]cli.Flag{
+		cli.IntFlag{
+			Name:  "size",
+			Value: 256,
+			Usage: "amount of data sealed and opened in mb",
+		},
+	}, cipherFlags...),
+	Action: func(ctx *cli.Context) error {
+		var err error
+		key := make([]byte, stream.KeySize)
+		nonce := make([]byte, stream.StandardNonceSize)
+		plaintext := make([]byte, ctx.Int("size")<<20)
+		for _, b := range [][]byte{key, nonce, plaintext} {
+			_, err = io.ReadFull(rand.Reader, b)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		cipherID := cipherSuite(ctx)
+		workers := cryptoWorkers(ctx)
+		var streams [2][]byte
+		for i, n := range []int{1, workers} {
+			start := time.Now()
+			reader, err := stream.NewEncryptReader(
+				bytes.NewReader(plaintext),
+				key,
+				stream.WithCipher(cipherID),
+				stream.WithRand(bytes.NewReader(nonce)),
+				stream.WithConcurrency(n),
+			)
+			if err != nil {
+				log.Fatal(err)
+			}
+			streams[i], err = ioutil.ReadAll(reader)
+			if err != nil {
+				log.Fatal(err)
+			}
+			printThroughput("encrypt", n, len(plaintext), time.Since(start))
+			start = time.Now()
+			reader, err = stream.NewDecryptReader(bytes.NewReader(streams[i]), key, stream.WithConcurrency(n))
+			if err != nil {
+				log.Fatal(err)
+			}
+			decrypted, err := ioutil.ReadAll(reader)
+			if err != nil {
+				log.Fatal(err)
+			}
+			printThroughput("decrypt", n, len(plaintext), time.Since(start))
+			if !bytes.Equal(decrypted, plaintext) {
+				log.Fatal(stacktrace.NewError("decrypting with (%d) workers did not return the plaintext", n))
+			}
+		}
+		if !bytes.Equal(streams[0], streams[1]) {
+			log.Fatal(stacktrace.NewError("sealing with (%d) workers gave a different stream than sealing serially", workers))
+		}
+		return nil
+	},
+}
+
+// printThroughput prints how fast size bytes were processed
+func printThroughput(op string, workers, size int, elapsed time.Duration) {
+	rate := int64(float64(size) / elapsed.Seconds())
+	colorstring.Printf("[cyan]%s with (%d) workers : %s/s\n", op, workers, utils.PrettyPrintSize(rate))
+}
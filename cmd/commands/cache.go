@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"log"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/cache"
+	utils "github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/urfave/cli"
+)
+
+// cacheCommand ...
+var cacheCommand = cli.Command{
+	Name:    "Cache",
+	Aliases: []string{"cache"},
+	Usage:   "manages the local read cache",
+	Subcommands: []cli.Command{
+		cacheClean,
+	},
+}
+
+// cacheClean ...
+var cacheClean = cli.Command{
+	Name:    "Clean",
+	Aliases: []string{"clean"},
+	Usage:   "empties the local read cache",
+	Description: `this command removes every object cached in the directory given with
+	--cache-dir. snapshot and chunk metadata are kept unless --all is set.
+	`,
+	Flags: append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "also remove cached metadata",
+		},
+	}, cacheFlags...),
+	Action: func(ctx *cli.Context) error {
+		store := cache.New(
+			cache.LogOps(),
+			cache.WithPath(ctx.String("cache-dir")),
+		)
+		freed, err := store.Clean(ctx.Bool("all"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		colorstring.Printf("[green]freed %s\n", utils.PrettyPrintSize(freed))
+		return nil
+	},
+}
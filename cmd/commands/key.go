@@ -0,0 +1,277 @@
+package commands
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	splitter "github.com/damoonazarpazhooh/File-Ingestion"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/keys"
+	"github.com/mitchellh/colorstring"
+	"github.com/urfave/cli"
+)
+
+// newKeyFlags configure how the passphrase of a new key slot is read
+var newKeyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "new-password-file",
+		Value: "",
+		Usage: "file holding the new passphrase. defaults to the " + newPasswordEnv + " environment variable, then to a prompt",
+	},
+	cli.StringFlag{
+		Name:  "new-key-provider",
+		Value: "",
+		Usage: "wrap the new key slot with the master key of a key provider instead of a passphrase. takes the same values as --key-provider",
+	},
+}
+
+// keyCommand ...
+var keyCommand = cli.Command{
+	Name:    "Key",
+	Aliases: []string{"key"},
+	Usage:   "manages the key slots of a repository",
+	Subcommands: []cli.Command{
+		keyAdd,
+		keyList,
+		keyRemove,
+		keyPasswd,
+		keyRotate,
+		keyTrust,
+		keyDistrust,
+	},
+}
+
+// keyAdd ...
+var keyAdd = cli.Command{
+	Name:    "Add",
+	Aliases: []string{"add"},
+	Usage:   "adds a key slot protected by a new passphrase or key provider",
+	Description: `this command unlocks the repository with an existing passphrase and
+	stores its data key in a new key slot, protected by the passphrase read from
+	--new-password-file, or wrapped by --new-key-provider. objects are not
+	re-encrypted.
+	`,
+	Flags: append(append(append([]cli.Flag{}, kdfFlags...), newKeyFlags...), backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		withKeySlot(ctx, func(raw file.Backend, kr *keys.Keyring, id string, _ []byte) {
+			if len(ctx.String("new-key-provider")) != 0 {
+				p, err := keyProvider(ctx.String("new-key-provider"))
+				if err != nil {
+					log.Fatal(err)
+				}
+				id, err = keys.AddWithProvider(context.Background(), raw, kr, p)
+				if err != nil {
+					log.Fatal(err)
+				}
+				colorstring.Printf("[green]added key slot (%s), wrapped by the (%s) key provider\n", id, p.Name())
+				return
+			}
+			passphrase, err := readNewPassphrase(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+			params, err := kdfParams(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+			id, err = keys.Add(context.Background(), raw, kr, passphrase, params)
+			if err != nil {
+				log.Fatal(err)
+			}
+			colorstring.Printf("[green]added key slot (%s)\n", id)
+		})
+		return nil
+	},
+}
+
+// keyList ...
+var keyList = cli.Command{
+	Name:    "List",
+	Aliases: []string{"list"},
+	Usage:   "lists the key slots of a repository",
+	Flags:   backendFlags,
+	Action: func(ctx *cli.Context) error {
+		raw, err := newBaseBackend(ctx, repositoryPath(ctx), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = raw.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeBackend(raw)
+		slots, err := keys.Slots(context.Background(), raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, kf := range slots {
+			kdf := kf.Provider
+			if kf.Params != nil {
+				kdf = kf.Params.KDF
+			}
+			colorstring.Printf("[cyan]%s  %-8s  %s\n", kf.ID, kdf, time.Unix(kf.Created, 0).Format(time.RFC3339))
+		}
+		rotation, err := keys.RotationInProgress(context.Background(), raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rotation != nil {
+			colorstring.Printf("[yellow]rotation in progress since %s : (%d) objects rotated\n", time.Unix(rotation.Started, 0).Format(time.RFC3339), rotation.Rotated)
+		}
+		signing, err := keys.SigningKeys(context.Background(), raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range signing {
+			colorstring.Printf("[cyan]trusted signing key : %s\n", hex.EncodeToString(key))
+		}
+		return nil
+	},
+}
+
+// keyRemove ...
+var keyRemove = cli.Command{
+	Name:    "Remove",
+	Aliases: []string{"remove"},
+	Usage:   "removes a key slot",
+	Description: `this command removes the key slot given with --id, after unlocking the
+	repository with any passphrase. the last key slot cannot be removed.
+	`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "id",
+			Value: "",
+			Usage: "id of the key slot to remove, as shown by [key list]",
+		},
+	}, backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		withKeySlot(ctx, func(raw file.Backend, kr *keys.Keyring, id string, _ []byte) {
+			err := keys.Remove(context.Background(), raw, ctx.String("id"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			colorstring.Printf("[green]removed key slot (%s)\n", ctx.String("id"))
+		})
+		return nil
+	},
+}
+
+// keyPasswd ...
+var keyPasswd = cli.Command{
+	Name:    "Passwd",
+	Aliases: []string{"passwd"},
+	Usage:   "changes the passphrase of a key slot",
+	Description: `this command protects the key slot the current passphrase unlocks with
+	the passphrase read from --new-password-file instead.
+	`,
+	Flags: append(append(append([]cli.Flag{}, kdfFlags...), newKeyFlags...), backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		withKeySlot(ctx, func(raw file.Backend, kr *keys.Keyring, id string, _ []byte) {
+			passphrase, err := readNewPassphrase(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+			params, err := kdfParams(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = keys.Change(context.Background(), raw, kr, id, passphrase, params)
+			if err != nil {
+				log.Fatal(err)
+			}
+			colorstring.Printf("[green]changed passphrase of key slot (%s)\n", id)
+		})
+		return nil
+	},
+}
+
+// keyRotate ...
+var keyRotate = cli.Command{
+	Name:    "Rotate",
+	Aliases: []string{"rotate"},
+	Usage:   "re-encrypts every object of a repository under a new data key",
+	Description: `this command generates a new data key and re-encrypts every snapshot
+	and chunk with it. progress is saved as it goes; an interrupted rotation is
+	resumed by running the command again, and the repository stays readable
+	meanwhile. once done, the key slot of the current passphrase, or key provider,
+	is the only one left, since the other ones still hold the old data key.
+	chunks stored with --convergent are sealed with keys derived from their
+	contents, not the data key, and are not re-keyed. prior versions kept by
+	--versioning would stay sealed with the old data key, so repositories
+	holding any are refused until [splitter versions purge --all] removes them,
+	and the objects rotated are not kept as versions.
+	`,
+	Flags: backendFlags,
+	Action: func(ctx *cli.Context) error {
+		path := repositoryPath(ctx)
+		var (
+			kr         *keys.Keyring
+			id         string
+			passphrase []byte
+		)
+		withKeySlot(ctx, func(raw file.Backend, current *keys.Keyring, slot string, secret []byte) {
+			var err error
+			kr, err = keys.StartRotation(context.Background(), raw, current)
+			if err != nil {
+				log.Fatal(err)
+			}
+			id = slot
+			passphrase = secret
+		})
+		backend, err := newBaseBackend(ctx, path, kr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = backend.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeBackend(backend)
+		// an interrupt stops the rotation at the next object, saving its
+		// progress
+		rotateCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+		go func() {
+			select {
+			case <-interrupt:
+				colorstring.Println("[yellow]stopping rotation ...")
+				cancel()
+			case <-rotateCtx.Done():
+			}
+		}()
+		n, err := keys.Rotate(rotateCtx, backend, kr, id, passphrase, ".metadata", ".chunks", splitter.SnapshotKeyPrefix)
+		colorstring.Printf("[cyan]rotated (%d) objects\n", n)
+		if err != nil {
+			log.Fatal(err)
+		}
+		colorstring.Printf("[green]rotation complete. key slot (%s) is the only one left\n", id)
+		return nil
+	},
+}
+
+// withKeySlot unlocks the repository given as the first argument and calls
+// fn with its unencrypted backend, keyring, and the key slot and passphrase
+// that unlocked it
+func withKeySlot(ctx *cli.Context, fn func(raw file.Backend, kr *keys.Keyring, id string, passphrase []byte)) {
+	raw, err := newBaseBackend(ctx, repositoryPath(ctx), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = raw.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeBackend(raw)
+	kr, id, passphrase, err := openSlot(ctx, raw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fn(raw, kr, id, passphrase)
+}
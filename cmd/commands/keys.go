@@ -0,0 +1,362 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/keys"
+	utils "github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	osext "github.com/kardianos/osext"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// passwordEnv is the environment variable the passphrase is read from when
+// --password-file is not given
+const passwordEnv = "SPLITTER_PASSWORD"
+
+// newPasswordEnv is the environment variable the passphrase of a new key
+// slot is read from when --new-password-file is not given
+const newPasswordEnv = "SPLITTER_NEW_PASSWORD"
+
+// kmsTokenEnv is the environment variable the bearer token of an http key
+// provider is read from
+const kmsTokenEnv = "SPLITTER_KMS_TOKEN"
+
+// legacyKey is the string repositories without a key file were encrypted
+// with
+const legacyKey = "encryption-key"
+
+// keyFlags configure how the repository passphrase is read
+var keyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "password-file",
+		Value: "",
+		Usage: "file holding the repository passphrase. defaults to the " + passwordEnv + " environment variable, then to a prompt",
+	},
+	cli.StringFlag{
+		Name:  "key-provider",
+		Value: "",
+		Usage: "unlock with a master key from a key provider instead of a passphrase. one of [file:<path>, env:<name>, command:<command line>, http(s)://<kms url>]. the kms token is read from the " + kmsTokenEnv + " environment variable",
+	},
+}
+
+// kdfFlags configure the key derivation of new key files
+var kdfFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "kdf",
+		Value: keys.Scrypt,
+		Usage: "key derivation function turning the passphrase into a master key. one of [scrypt, argon2id]",
+	},
+	cli.IntFlag{
+		Name:  "scrypt-n",
+		Value: 1 << 15,
+		Usage: "scrypt cpu/memory cost. must be a power of two",
+	},
+	cli.IntFlag{
+		Name:  "argon2-time",
+		Value: 3,
+		Usage: "Argon2id number of passes",
+	},
+	cli.IntFlag{
+		Name:  "argon2-memory",
+		Value: 64 * 1024,
+		Usage: "Argon2id memory in kb",
+	},
+	cli.IntFlag{
+		Name:  "argon2-threads",
+		Value: 4,
+		Usage: "Argon2id parallelism",
+	},
+}
+
+// initialize ...
+var initialize = cli.Command{
+	Name:    "Init",
+	Aliases: []string{"init"},
+	Usage:   "creates the key file of a repository",
+	Description: `this command generates the data key objects of the repository are
+	encrypted with, and stores it in a key file protected by a passphrase.
+	the master key unlocking it is derived from the passphrase with --kdf, using a
+	random salt. with --key-provider, the key file is wrapped by the master key of
+	the provider instead. a repository that already holds snapshots keeps its
+	current key.
+	`,
+	Flags: append(append([]cli.Flag{}, kdfFlags...), backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		path := repositoryPath(ctx)
+		raw, err := newBaseBackend(ctx, path, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = raw.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeBackend(raw)
+		exists, err := keys.Exists(context.Background(), raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if exists {
+			log.Fatal(stacktrace.NewError("repository at (%s) already has a key file", path))
+		}
+		params, err := kdfParams(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var dataKey []byte
+		legacy, err := hasLegacyObjects(raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if legacy {
+			dataKey, err = file.DeriveKey(legacyKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(ctx.String("key-provider")) != 0 {
+			p, err := keyProvider(ctx.String("key-provider"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			_, err = keys.CreateWithProvider(context.Background(), raw, p, dataKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			colorstring.Printf("[green]created key file of repository at (%s), wrapped by the (%s) key provider\n", path, p.Name())
+			return nil
+		}
+		passphrase, err := readPassphrase(ctx, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = keys.Create(context.Background(), raw, passphrase, params, dataKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		colorstring.Printf("[green]created key file of repository at (%s)\n", path)
+		return nil
+	},
+}
+
+// repositoryPath returns the absolute repository path given as the first
+// argument
+func repositoryPath(ctx *cli.Context) string {
+	path := ctx.Args().First()
+	if len(path) == 0 {
+		path = "tmp"
+		selfPath, _ := osext.ExecutableFolder()
+		path = utils.PathJoin(selfPath, path)
+	}
+	path, _ = filepath.Abs(path)
+	return path
+}
+
+// repositoryKey unlocks the keyring of the repository at path
+func repositoryKey(ctx *cli.Context, path string) (*keys.Keyring, error) {
+	raw, err := newBaseBackend(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return unlock(ctx, raw)
+}
+
+// unlock returns the keyring of the repository on raw, an unencrypted
+// backend. repositories without a key file only fall back to the legacy
+// key when they hold snapshots written with it; others must be initialized.
+func unlock(ctx *cli.Context, raw file.Backend) (*keys.Keyring, error) {
+	err := raw.Init()
+	if err != nil {
+		return nil, err
+	}
+	defer closeBackend(raw)
+	exists, err := keys.Exists(context.Background(), raw)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		legacy, err := hasLegacyObjects(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !legacy {
+			err = stacktrace.NewError("[ERROR] repository has no key file. run [splitter init] to create one")
+			return nil, err
+		}
+		colorstring.Println("[red][WARN] repository has no key file; using the legacy built-in key. run [splitter init] to protect it with a passphrase")
+		key, err := file.DeriveKey(legacyKey)
+		if err != nil {
+			return nil, err
+		}
+		naming, err := keys.NamingKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &keys.Keyring{Primary: key, Naming: naming}, nil
+	}
+	kr, _, _, err := openSlot(ctx, raw)
+	return kr, err
+}
+
+// hasLegacyObjects reports whether the repository on raw holds snapshots,
+// which without a key file were written with the legacy key
+func hasLegacyObjects(raw file.Backend) (bool, error) {
+	snapshots, err := raw.List(context.Background(), ".metadata")
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not list the snapshots of the repository")
+		return false, err
+	}
+	return len(snapshots) != 0, nil
+}
+
+// openSlot unlocks the keyring of the repository on raw, an initialized
+// backend, returning the key slot and passphrase that unlocked it. the
+// passphrase is nil when --key-provider unlocked it
+func openSlot(ctx *cli.Context, raw file.Backend) (*keys.Keyring, string, []byte, error) {
+	if len(ctx.String("key-provider")) != 0 {
+		p, err := keyProvider(ctx.String("key-provider"))
+		if err != nil {
+			return nil, "", nil, err
+		}
+		kr, id, err := keys.UnlockWithProvider(context.Background(), raw, p)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return kr, id, nil, nil
+	}
+	passphrase, err := readPassphrase(ctx, false)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	kr, id, err := keys.Unlock(context.Background(), raw, passphrase)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return kr, id, passphrase, nil
+}
+
+// keyProvider returns the key provider described by spec, one of
+// file:<path>, env:<name>, command:<command line> or the url of a kms
+func keyProvider(spec string) (keys.KeyProvider, error) {
+	var p keys.KeyProvider
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "file":
+		p = keys.NewFileProvider(arg)
+	case "env":
+		p = keys.NewEnvProvider(arg)
+	case "command":
+		p = keys.NewCommandProvider(arg)
+	case "http", "https":
+		p = keys.NewHTTPProvider(spec, os.Getenv(kmsTokenEnv))
+	default:
+		return nil, stacktrace.NewError("[ERROR] unknown key provider (%s). must be one of [file:<path>, env:<name>, command:<command line>, http(s)://<kms url>]", spec)
+	}
+	if len(arg) == 0 {
+		return nil, stacktrace.NewError("[ERROR] key provider (%s) is missing its argument", spec)
+	}
+	// a keyring is unlocked once per backend opened; the master key is only
+	// asked for once
+	return keys.NewCachedProvider(p), nil
+}
+
+// closeBackend releases backends holding a lock, such as bolt databases,
+// so they can be opened again
+func closeBackend(backend file.Backend) {
+	if closer, ok := backend.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// readPassphrase reads the passphrase from --password-file, the
+// environment or a prompt. with confirm, a prompted passphrase is asked
+// for twice
+func readPassphrase(ctx *cli.Context, confirm bool) ([]byte, error) {
+	return passphraseFrom(ctx.String("password-file"), passwordEnv, "repository passphrase", confirm)
+}
+
+// readNewPassphrase reads a passphrase for a new key slot from
+// --new-password-file, the environment or a prompt
+func readNewPassphrase(ctx *cli.Context) ([]byte, error) {
+	return passphraseFrom(ctx.String("new-password-file"), newPasswordEnv, "new passphrase", true)
+}
+
+func passphraseFrom(path, env, label string, confirm bool) ([]byte, error) {
+	var passphrase []byte
+	if len(path) != 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			err = stacktrace.Propagate(err, "could not read password file (%s)", path)
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(data, "\r\n")
+	} else if value := os.Getenv(env); len(value) != 0 {
+		passphrase = []byte(value)
+	} else {
+		var err error
+		passphrase, err = prompt(fmt.Sprintf("enter %s: ", label), env)
+		if err != nil {
+			return nil, err
+		}
+		if confirm {
+			again, err := prompt(fmt.Sprintf("confirm %s: ", label), env)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(passphrase, again) {
+				return nil, stacktrace.NewError("passphrases do not match")
+			}
+		}
+	}
+	if len(passphrase) == 0 {
+		return nil, stacktrace.NewError("passphrase cannot be empty")
+	}
+	return passphrase, nil
+}
+
+func prompt(message, env string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, stacktrace.NewError("no passphrase given; use a password file or %s", env)
+	}
+	fmt.Fprint(os.Stderr, message)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		err = stacktrace.Propagate(err, "could not read passphrase")
+		return nil, err
+	}
+	return passphrase, nil
+}
+
+// kdfParams returns the key derivation parameters selected by kdfFlags
+func kdfParams(ctx *cli.Context) (*keys.Params, error) {
+	params, err := keys.DefaultParams(ctx.String("kdf"))
+	if err != nil {
+		return nil, err
+	}
+	switch params.KDF {
+	case keys.Scrypt:
+		params.N = ctx.Int("scrypt-n")
+	case keys.Argon2id:
+		params.Time = uint32(ctx.Int("argon2-time"))
+		params.Memory = uint32(ctx.Int("argon2-memory"))
+		params.Threads = uint8(ctx.Int("argon2-threads"))
+	}
+	return params, nil
+}
@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/keys"
+	"github.com/mitchellh/colorstring"
+	"github.com/urfave/cli"
+)
+
+// kms ...
+var kms = cli.Command{
+	Name:    "KMS",
+	Aliases: []string{"kms"},
+	Usage:   "serves a development stand-in for a KMS",
+	Description: `this command serves the wrap and unwrap endpoints an http key
+	provider talks to, wrapping keys with the master key held in --key-file. a
+	master key is generated if the file does not exist. requests must carry
+	--token, read from the ` + kmsTokenEnv + ` environment variable by clients, as a bearer
+	token. it is meant for development and tests; use a real KMS otherwise.
+	`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Value: "127.0.0.1:8200",
+			Usage: "address to listen on",
+		},
+		cli.StringFlag{
+			Name:  "key-file",
+			Value: "kms.key",
+			Usage: "file holding the hex encoded master key",
+		},
+		cli.StringFlag{
+			Name:  "token",
+			Value: "",
+			Usage: "bearer token requests must carry. defaults to none",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		path := ctx.String("key-file")
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			masterKey := make([]byte, file.KeySize)
+			_, err = io.ReadFull(rand.Reader, masterKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = ioutil.WriteFile(path, []byte(hex.EncodeToString(masterKey)+"\n"), 0600)
+			if err != nil {
+				log.Fatal(err)
+			}
+			colorstring.Printf("[green]wrote master key to (%s)\n", path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		masterKey, err := file.ParseKey(string(data))
+		if err != nil {
+			log.Fatal(err)
+		}
+		colorstring.Printf("[cyan]serving KMS on (http://%s)\n", ctx.String("listen"))
+		log.Fatal(http.ListenAndServe(ctx.String("listen"), keys.NewKMSHandler(masterKey, ctx.String("token"))))
+		return nil
+	},
+}
@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+
+	splitter "github.com/damoonazarpazhooh/File-Ingestion"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+	"github.com/urfave/cli"
+)
+
+// recipientFlags configure sealing objects to public keys
+var recipientFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "recipient",
+		Usage: "public key, or file holding one, new objects are sealed to instead of the repository key. repeat for every recipient. writing then needs no passphrase",
+	},
+	cli.StringFlag{
+		Name:  "identity",
+		Value: "",
+		Usage: "file holding the private key objects sealed to recipients are read with",
+	},
+}
+
+// keygen ...
+var keygen = cli.Command{
+	Name:    "Keygen",
+	Aliases: []string{"keygen"},
+	Usage:   "generates a key pair for sealing objects to recipients, or signing manifests",
+	Description: `this command writes a new private key to the file given with --output
+	and prints its public key. hosts snapshotting with --recipient only need the
+	public key; restoring needs the private key, given with --identity.
+	with --signing, an Ed25519 key pair is generated instead. snapshots are
+	signed with the private key, given with --signing-key. the repository is
+	told to trust the public key with [key trust], after which restore and check
+	refuse manifests it did not sign.
+	`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output",
+			Value: "identity.key",
+			Usage: "file the private key is written to",
+		},
+		cli.BoolFlag{
+			Name:  "signing",
+			Usage: "generate a key pair for signing snapshot manifests",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		output := ctx.String("output")
+		_, err := os.Stat(output)
+		if err == nil {
+			log.Fatal(stacktrace.NewError("(%s) already exists", output))
+		}
+		if ctx.Bool("signing") {
+			public, private, err := splitter.GenerateSigningKey()
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = ioutil.WriteFile(output, []byte(hex.EncodeToString(private.Seed())+"\n"), 0600)
+			if err != nil {
+				log.Fatal(err)
+			}
+			colorstring.Printf("[green]wrote signing key to (%s)\n", output)
+			colorstring.Printf("[cyan]verify key : %s\n", hex.EncodeToString(public))
+			return nil
+		}
+		public, private, err := file.GenerateIdentity()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = ioutil.WriteFile(output, []byte(hex.EncodeToString(private)+"\n"), 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		colorstring.Printf("[green]wrote private key to (%s)\n", output)
+		colorstring.Printf("[cyan]public key : %s\n", hex.EncodeToString(public))
+		return nil
+	},
+}
+
+// recipientOptions returns the file storage options selected by
+// recipientFlags
+func recipientOptions(ctx *cli.Context) []file.Option {
+	opts := []file.Option{}
+	for _, arg := range ctx.StringSlice("recipient") {
+		value := arg
+		if data, err := ioutil.ReadFile(arg); err == nil {
+			value = string(data)
+		}
+		recipient, err := file.ParseKey(value)
+		if err != nil {
+			log.Fatal(stacktrace.Propagate(err, "invalid recipient (%s)", arg))
+		}
+		opts = append(opts, file.WithRecipients(recipient))
+	}
+	if path := ctx.String("identity"); len(path) != 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(stacktrace.Propagate(err, "could not read identity file (%s)", path))
+		}
+		identity, err := file.ParseKey(string(data))
+		if err != nil {
+			log.Fatal(stacktrace.Propagate(err, "invalid identity file (%s)", path))
+		}
+		opts = append(opts, file.WithIdentities(identity))
+	}
+	return opts
+}
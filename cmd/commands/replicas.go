@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"context"
+	"log"
+
+	"github.com/mitchellh/colorstring"
+	"github.com/urfave/cli"
+)
+
+// replicas ...
+var replicas = cli.Command{
+	Name:    "Replicas",
+	Aliases: []string{"replicas"},
+	Usage:   "inspects the replicas of a mirrored repository",
+	Subcommands: []cli.Command{
+		replicasStatus,
+	},
+}
+
+// replicasStatus ...
+var replicasStatus = cli.Command{
+	Name:    "Status",
+	Aliases: []string{"status"},
+	Usage:   "shows divergence between the replicas of a mirrored repository",
+	Description: `this command lists every object stored on the replicas given with
+	--replica and reports the objects each replica is missing, or holds at
+	an older generation than another replica, including deleted objects.
+	--deep flag also checks the generation of every object, reads every copy
+	and reports objects whose copies differ or do not match their digest.
+	`,
+	Flags: append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "deep",
+			Usage: "compare the contents of every copy, not just their presence",
+		},
+	}, append(append([]cli.Flag{}, mirrorFlags...), keyFlags...)...),
+	Action: func(ctx *cli.Context) error {
+		kr, err := unlock(ctx, newMirrorStorage(ctx, nil))
+		if err != nil {
+			log.Fatal(err)
+		}
+		store := newMirrorStorage(ctx, kr)
+		err = store.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		report, err := store.Status(context.Background(), "", ctx.Bool("deep"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		replicaPaths := ctx.StringSlice("replica")
+		colorstring.Printf("[cyan]objects : %d\n", report.Keys)
+		for i, path := range replicaPaths {
+			if err, ok := report.Unreachable[i]; ok {
+				colorstring.Printf("[red]replica #%d (%s) : unreachable : %v\n", i, path, err)
+				continue
+			}
+			missing := report.Missing[i]
+			stale := report.Stale[i]
+			if len(missing) == 0 && len(stale) == 0 {
+				colorstring.Printf("[green]replica #%d (%s) : in sync\n", i, path)
+				continue
+			}
+			if len(missing) != 0 {
+				colorstring.Printf("[yellow]replica #%d (%s) : missing %d objects\n", i, path, len(missing))
+				for _, key := range missing {
+					colorstring.Printf("[yellow]  - %s\n", key)
+				}
+			}
+			if len(stale) != 0 {
+				colorstring.Printf("[yellow]replica #%d (%s) : %d stale objects\n", i, path, len(stale))
+				for _, key := range stale {
+					colorstring.Printf("[yellow]  - %s\n", key)
+				}
+			}
+		}
+		for _, key := range report.Divergent {
+			colorstring.Printf("[red]divergent : %s\n", key)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,278 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+
+	splitter "github.com/damoonazarpazhooh/File-Ingestion"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/keys"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signingFlags configure how snapshot manifests are signed
+var signingFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "signing-key",
+		Value: "",
+		Usage: "file holding the signing key the manifest of the snapshot is signed with, as written by [keygen --signing]",
+	},
+}
+
+// verifyFlags configure how snapshot manifests are verified
+var verifyFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "verify-key",
+		Usage: "public signing key, or file holding one, manifests may be signed by besides the ones the repository trusts, see [key trust]. repeat for every key. once any key is trusted, unsigned manifests are refused",
+	},
+}
+
+// verifySignature ...
+var verifySignature = cli.Command{
+	Name:    "VerifySignature",
+	Aliases: []string{"verify-signature"},
+	Usage:   "verifies the signature and Merkle root of a snapshot manifest",
+	Description: `this command checks that the manifest of the snapshot given with --tag
+	matches its Merkle root, and that the root is signed by one of the keys the
+	repository trusts, or given with --verify-key. unsigned manifests are refused.
+	[check] verifies the chunks of the snapshot as well.
+	`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "tag",
+			Value: "",
+			Usage: "tag used to identify snapshot to verify",
+		},
+	}, append(append(append([]cli.Flag{}, verifyFlags...), namingFlags...), backendFlags...)...),
+	Action: func(ctx *cli.Context) error {
+		tag := ctx.String("tag")
+		if len(tag) == 0 {
+			log.Fatal(stacktrace.NewError("--tag is required"))
+		}
+		md, err := verifyingSplitter(ctx).VerifySignature(context.Background(), tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		colorstring.Printf("[cyan]merkle root : %s\n", hex.EncodeToString(md.MerkleRoot))
+		colorstring.Printf("[cyan]signed by : %s\n", hex.EncodeToString(md.SignedBy))
+		colorstring.Printf("[green]manifest of snapshot (%s) verified\n", tag)
+		return nil
+	},
+}
+
+// check ...
+var check = cli.Command{
+	Name:    "Check",
+	Aliases: []string{"check"},
+	Usage:   "verifies a snapshot manifest and every chunk it references",
+	Description: `this command verifies the manifest of the snapshot given with --tag the
+	way restore does: once the repository trusts a signing key, or one is given
+	with --verify-key, the manifest must be signed by one of them. every chunk of
+	the snapshot is then read and checked against the digest the manifest holds
+	for it. nothing is restored.
+	`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "tag",
+			Value: "",
+			Usage: "tag used to identify snapshot to check",
+		},
+	}, append(append(append([]cli.Flag{}, verifyFlags...), namingFlags...), backendFlags...)...),
+	Action: func(ctx *cli.Context) error {
+		tag := ctx.String("tag")
+		if len(tag) == 0 {
+			log.Fatal(stacktrace.NewError("--tag is required"))
+		}
+		report, err := verifyingSplitter(ctx).Check(context.Background(), tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range report.Damaged {
+			colorstring.Printf("[red]damaged chunk : %s\n", key)
+		}
+		if len(report.Damaged) != 0 {
+			log.Fatal(stacktrace.NewError("[ERROR] (%d) of (%d) chunks of snapshot (%s) are damaged", len(report.Damaged), report.Chunks, tag))
+		}
+		colorstring.Printf("[green]snapshot (%s) checked : (%d) chunks intact\n", tag, report.Chunks)
+		return nil
+	},
+}
+
+// keyTrust ...
+var keyTrust = cli.Command{
+	Name:    "Trust",
+	Aliases: []string{"trust"},
+	Usage:   "trusts a public key to sign snapshot manifests",
+	Description: `this command adds the keys given with --verify-key to the signing keys
+	the repository trusts. once one is trusted, restore and check refuse
+	manifests that are unsigned or signed by any other key, and snapshot refuses
+	to run without a trusted --signing-key. the list is stored in every key slot
+	and authenticated with the repository key, so someone holding only write
+	access to the storage can neither change it nor remove it without making the
+	repository unreadable. every change bumps its version and the newest copy
+	wins, though rolling back every key slot at once brings back the list they
+	held; hosts that must not rely on the repository alone pass the keys with
+	--verify-key as well.
+	`,
+	Flags: append(append([]cli.Flag{}, verifyFlags...), backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		withKeySlot(ctx, func(raw file.Backend, kr *keys.Keyring, _ string, _ []byte) {
+			trusted := verifyKeys(ctx)
+			if len(trusted) == 0 {
+				log.Fatal(stacktrace.NewError("--verify-key is required"))
+			}
+			for _, key := range trusted {
+				err := keys.TrustSigningKey(context.Background(), raw, kr, key)
+				if err != nil {
+					log.Fatal(err)
+				}
+				colorstring.Printf("[green]trusted signing key (%s)\n", hex.EncodeToString(key))
+			}
+		})
+		return nil
+	},
+}
+
+// keyDistrust ...
+var keyDistrust = cli.Command{
+	Name:    "Distrust",
+	Aliases: []string{"distrust"},
+	Usage:   "stops trusting a public key to sign snapshot manifests",
+	Description: `this command removes the keys given with --verify-key from the signing
+	keys the repository trusts. the last trusted key cannot be removed.
+	`,
+	Flags: append(append([]cli.Flag{}, verifyFlags...), backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		withKeySlot(ctx, func(raw file.Backend, kr *keys.Keyring, _ string, _ []byte) {
+			distrusted := verifyKeys(ctx)
+			if len(distrusted) == 0 {
+				log.Fatal(stacktrace.NewError("--verify-key is required"))
+			}
+			for _, key := range distrusted {
+				err := keys.DistrustSigningKey(context.Background(), raw, kr, key)
+				if err != nil {
+					log.Fatal(err)
+				}
+				colorstring.Printf("[green]no longer trusting signing key (%s)\n", hex.EncodeToString(key))
+			}
+		})
+		return nil
+	},
+}
+
+// verifyingSplitter returns a splitter reading the snapshots of the
+// repository, verifying their manifests with trustedKeys
+func verifyingSplitter(ctx *cli.Context) *splitter.Multipart {
+	path := repositoryPath(ctx)
+	kr, err := repositoryKey(ctx, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend, err := newBackend(ctx, path, kr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []splitter.Option{
+		splitter.WithRootPath(path),
+		splitter.WithEncryptionKey(kr.Primary),
+		splitter.WithBackend(backend),
+		splitter.WithVerifyKeys(trustedKeys(ctx, kr)...),
+	}
+	if ctx.Bool("obfuscate-keys") {
+		opts = append(opts, splitter.WithObfuscatedKeys(kr.Naming))
+	}
+	return splitter.New(opts...)
+}
+
+// signingKey returns the key selected by --signing-key, or nil
+func signingKey(ctx *cli.Context) ed25519.PrivateKey {
+	path := ctx.String("signing-key")
+	if len(path) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(stacktrace.Propagate(err, "could not read signing key file (%s)", path))
+	}
+	seed, err := file.ParseKey(string(data))
+	if err != nil {
+		log.Fatal(stacktrace.Propagate(err, "invalid signing key file (%s)", path))
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// checkSigningKey refuses to take a snapshot of the repository at path
+// that restore would refuse: once the repository trusts a signing key,
+// the snapshot must be signed with one of them. hosts sealing to
+// recipients hold no keyring, so they check against the trusted keys
+// without authenticating them
+func checkSigningKey(ctx *cli.Context, path string, kr *keys.Keyring, key ed25519.PrivateKey) {
+	var trusted []ed25519.PublicKey
+	if kr != nil {
+		trusted = kr.SigningKeys()
+	} else {
+		raw := openRaw(ctx, path)
+		defer closeBackend(raw)
+		var err error
+		trusted, err = keys.SigningKeys(context.Background(), raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(trusted) == 0 {
+		return
+	}
+	if key == nil {
+		log.Fatal(stacktrace.NewError("the repository only accepts signed snapshots; --signing-key is required"))
+	}
+	public := key.Public().(ed25519.PublicKey)
+	for _, k := range trusted {
+		if bytes.Equal(k, public) {
+			return
+		}
+	}
+	log.Fatal(stacktrace.NewError("signing key (%s) is not trusted by the repository; trust it with [key trust] first", hex.EncodeToString(public)))
+}
+
+// trustedKeys returns the signing keys the repository trusts, as kr was
+// unlocked with, along with the ones selected by --verify-key
+func trustedKeys(ctx *cli.Context, kr *keys.Keyring) []ed25519.PublicKey {
+	return append(kr.SigningKeys(), verifyKeys(ctx)...)
+}
+
+// verifyKeys returns the keys selected by --verify-key
+func verifyKeys(ctx *cli.Context) []ed25519.PublicKey {
+	result := []ed25519.PublicKey{}
+	for _, arg := range ctx.StringSlice("verify-key") {
+		value := arg
+		if data, err := ioutil.ReadFile(arg); err == nil {
+			value = string(data)
+		}
+		key, err := file.ParseKey(value)
+		if err != nil {
+			log.Fatal(stacktrace.Propagate(err, "invalid verify key (%s)", arg))
+		}
+		result = append(result, ed25519.PublicKey(key))
+	}
+	return result
+}
+
+// openRaw returns the initialized backend of the repository at path,
+// reading objects as they are stored
+func openRaw(ctx *cli.Context, path string) file.Backend {
+	raw, err := newBaseBackend(ctx, path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = raw.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return raw
+}
@@ -3,12 +3,12 @@ package commands
 import (
 	"context"
 	"log"
-	"path/filepath"
 
 	splitter "github.com/damoonazarpazhooh/File-Ingestion"
 	"github.com/damoonazarpazhooh/File-Ingestion/internal/uuid"
-	utils "github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
-	osext "github.com/kardianos/osext"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/keys"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
 	"github.com/urfave/cli"
 )
 
@@ -18,8 +18,31 @@ var Splitter = cli.Command{
 	Aliases: []string{"splitter"},
 	Usage:   "split a file into chunks",
 	Subcommands: []cli.Command{
+		initialize,
 		snapshot,
 		restore,
+		verifySignature,
+		check,
+		shred,
+		compact,
+		repack,
+		replicas,
+		scrub,
+		rebalance,
+		cacheCommand,
+		keyCommand,
+		keygen,
+		benchmark,
+		kms,
+		versions,
+	},
+}
+
+// namingFlags configure how snapshot objects are named
+var namingFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "obfuscate-keys",
+		Usage: "name objects after a keyed HMAC so the repository layout reveals no tags, paths or hashes. snapshots taken with it must be restored with it",
 	},
 }
 
@@ -33,34 +56,67 @@ var snapshot = cli.Command{
 	--tag flag is used to set a tag for the snapshot. if no tag is provided , a
 	uuid is used as snapshot tag
 	`,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "tag",
 			Value: "",
 			Usage: "tag used to identify this snapshot",
 		},
-	},
+		cli.BoolFlag{
+			Name:  "convergent",
+			Usage: "seal chunks with keys derived from their contents so equal chunks are stored once. restores need no flag. key rotations do not re-key these chunks, and they cannot be padded",
+		},
+		cli.BoolFlag{
+			Name:  "snapshot-key",
+			Usage: "encrypt the snapshot under a key of its own so shred can make it unreadable. restores need no flag",
+		},
+	}, append(append(append([]cli.Flag{}, signingFlags...), namingFlags...), backendFlags...)...),
 	Action: func(ctx *cli.Context) error {
 
-		path := ctx.Args().First()
-		if len(path) == 0 {
-			path = "tmp"
-			selfPath, _ := osext.ExecutableFolder()
-			path = utils.PathJoin(selfPath, path)
-		}
-		path, _ = filepath.Abs(path)
-		filesplitter := splitter.New(
+		path := repositoryPath(ctx)
+		kr, err := snapshotKey(ctx, path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend, err := newBackend(ctx, path, kr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := []splitter.Option{
 			splitter.LogOps(),
 			splitter.WithRootPath(path),
 			// splitter.WithChunkSizeInKilobytes(4),
 			splitter.WithChunkSizeInMegabytes(4),
-			splitter.WithEncryption("encryption-key"),
-		)
+			splitter.WithNumberOfThreads(threads(ctx)),
+			splitter.WithBackend(backend),
+		}
+		if kr != nil {
+			opts = append(opts, splitter.WithEncryptionKey(kr.Primary))
+		}
+		if ctx.Bool("obfuscate-keys") {
+			opts = append(opts, splitter.WithObfuscatedKeys(kr.Naming))
+		}
+		if ctx.Bool("convergent") {
+			secret, err := kr.ConvergenceKey()
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts = append(opts, splitter.WithConvergentEncryption(secret))
+		}
+		if ctx.Bool("snapshot-key") {
+			opts = append(opts, splitter.WithSnapshotKeys())
+		}
+		key := signingKey(ctx)
+		checkSigningKey(ctx, path, kr, key)
+		if key != nil {
+			opts = append(opts, splitter.WithSigningKey(key))
+		}
+		filesplitter := splitter.New(opts...)
 		tag := ctx.String("tag")
 		if len(tag) == 0 {
 			tag, _ = uuid.GenerateUUID()
 		}
-		err := filesplitter.Snapshot(context.Background(), tag)
+		err = filesplitter.Snapshot(context.Background(), tag)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -68,6 +124,27 @@ var snapshot = cli.Command{
 	},
 }
 
+// snapshotKey returns the keyring snapshots of the repository at path are
+// taken with. objects sealed to recipients need no key, so nil is returned
+// without asking for a passphrase
+func snapshotKey(ctx *cli.Context, path string) (*keys.Keyring, error) {
+	// convergent chunks are stored unpadded, so they would reveal the size
+	// padding is meant to hide
+	if ctx.Bool("convergent") && padding(ctx) != nil {
+		return nil, stacktrace.NewError("--padding cannot be used with --convergent, which stores chunks at their exact size")
+	}
+	if len(ctx.StringSlice("recipient")) == 0 {
+		return repositoryKey(ctx, path)
+	}
+	if ctx.Bool("obfuscate-keys") || ctx.Bool("convergent") {
+		return nil, stacktrace.NewError("--obfuscate-keys and --convergent need the repository key and cannot be used with --recipient")
+	}
+	if ctx.String("backend") == "bolt" {
+		return nil, stacktrace.NewError("--recipient is not supported by the bolt backend")
+	}
+	return nil, nil
+}
+
 // singleSampleFile ...
 var restore = cli.Command{
 	Name:    "Restore",
@@ -76,7 +153,7 @@ var restore = cli.Command{
 	Description: `this command helps with generating restoring snapshots from a directory based on metadatas of a snapshot.
 	--tag flag is used to set a tag for the snapshot. if no tag is provided , it would return without any results.
 	`,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "tag",
 			Value: "",
@@ -87,33 +164,231 @@ var restore = cli.Command{
 			Value: "restore-root-dir",
 			Usage: "restore-root is used to pass in the name of the directory in which snapshots are restored",
 		},
-	},
+	}, append(append(append([]cli.Flag{}, verifyFlags...), namingFlags...), backendFlags...)...),
 	Action: func(ctx *cli.Context) error {
 
-		path := ctx.Args().First()
-		if len(path) == 0 {
-			path = "tmp"
-			selfPath, _ := osext.ExecutableFolder()
-			path = utils.PathJoin(selfPath, path)
-		}
-		path, _ = filepath.Abs(path)
-		filesplitter := splitter.New(
+		path := repositoryPath(ctx)
+		kr, err := repositoryKey(ctx, path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend, err := newBackend(ctx, path, kr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := []splitter.Option{
 			splitter.LogOps(),
 			splitter.WithRootPath(path),
 			// splitter.WithChunkSizeInKilobytes(4),
 			splitter.WithChunkSizeInMegabytes(4),
-			splitter.WithEncryption("encryption-key"),
-		)
+			splitter.WithNumberOfThreads(threads(ctx)),
+			splitter.WithEncryptionKey(kr.Primary),
+			splitter.WithBackend(backend),
+			splitter.WithVerifyKeys(trustedKeys(ctx, kr)...),
+		}
+		if ctx.Bool("obfuscate-keys") {
+			opts = append(opts, splitter.WithObfuscatedKeys(kr.Naming))
+		}
+		filesplitter := splitter.New(opts...)
 		tag := ctx.String("tag")
 		if len(tag) == 0 {
 			return nil
 		}
 		restoreRoot := ctx.String("restore-root")
 
-		err := filesplitter.Restore(context.Background(), restoreRoot, tag)
+		err = filesplitter.Restore(context.Background(), restoreRoot, tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return nil
+	},
+}
+
+// shred ...
+var shred = cli.Command{
+	Name:    "Shred",
+	Aliases: []string{"shred"},
+	Usage:   "makes a snapshot unreadable by destroying its key",
+	Description: `this command destroys the key of the snapshot given with --tag, which
+	makes it unreadable at once, then deletes its metadata and chunks.
+	only snapshots taken with --snapshot-key can be shredded. chunks taken with
+	--convergent may be shared with other snapshots and are kept; they stay
+	readable through those snapshots only.
+	`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "tag",
+			Value: "",
+			Usage: "tag used to identify snapshot to shred",
+		},
+	}, append(append([]cli.Flag{}, namingFlags...), backendFlags...)...),
+	Action: func(ctx *cli.Context) error {
+		tag := ctx.String("tag")
+		if len(tag) == 0 {
+			log.Fatal(stacktrace.NewError("--tag is required"))
+		}
+		path := repositoryPath(ctx)
+		kr, err := repositoryKey(ctx, path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend, err := newBackend(ctx, path, kr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := []splitter.Option{
+			splitter.LogOps(),
+			splitter.WithRootPath(path),
+			splitter.WithEncryptionKey(kr.Primary),
+			splitter.WithBackend(backend),
+		}
+		if ctx.Bool("obfuscate-keys") {
+			opts = append(opts, splitter.WithObfuscatedKeys(kr.Naming))
+		}
+		err = splitter.New(opts...).Shred(context.Background(), tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return nil
+	},
+}
+
+// compact ...
+var compact = cli.Command{
+	Name:    "Compact",
+	Aliases: []string{"compact"},
+	Usage:   "compacts the database file of a bolt backed repository",
+	Description: `this command rewrites the database file of a repository stored with
+	--backend bolt, releasing the space left behind by deleted and overwritten objects.
+	--database flag is used to set the database file. if no database is provided ,
+	[<path>/.chunks/repository.db] is used.
+	`,
+	Flags: databaseFlags,
+	Action: func(ctx *cli.Context) error {
+		path := repositoryPath(ctx)
+		// compaction copies values as they are stored, encrypted or not
+		store := newKVStore(ctx, path, nil)
+		err := store.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer store.Close()
+		err = store.Compact(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return nil
+	},
+}
+
+// repack ...
+var repack = cli.Command{
+	Name:    "Repack",
+	Aliases: []string{"repack"},
+	Usage:   "rewrites pack files that are mostly made of deleted chunks",
+	Description: `this command rewrites every pack file of a repository stored with
+	--packs whose share of live bytes dropped below --threshold, and deletes
+	the old packs once their live chunks are stored in new ones.
+	`,
+	Flags: append([]cli.Flag{
+		cli.Float64Flag{
+			Name:  "threshold",
+			Value: 0.5,
+			Usage: "packs with a lower share of live bytes are rewritten",
+		},
+	}, backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		path := repositoryPath(ctx)
+		kr, err := repositoryKey(ctx, path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend, err := newBaseBackend(ctx, path, kr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store := newPackStorage(ctx, backend)
+		err = store.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := store.Repack(context.Background(), ctx.Float64("threshold"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		colorstring.Printf("[green]rewrote (%d) packs\n", n)
+		return nil
+	},
+}
+
+// scrub ...
+var scrub = cli.Command{
+	Name:    "Scrub",
+	Aliases: []string{"scrub"},
+	Usage:   "rebuilds missing or corrupt shards of an erasure coded repository",
+	Description: `this command verifies the checksum of every shard stored on the disks
+	given with --shard and rebuilds the shards that are missing or corrupt from the
+	healthy ones.
+	`,
+	Flags: append(append([]cli.Flag{}, erasureFlags...), keyFlags...),
+	Action: func(ctx *cli.Context) error {
+		kr, err := unlock(ctx, newErasureStorage(ctx, nil))
+		if err != nil {
+			log.Fatal(err)
+		}
+		store := newErasureStorage(ctx, kr)
+		err = store.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		report, err := store.Scrub(context.Background(), "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		colorstring.Printf("[cyan]checked (%d) objects , rebuilt (%d)\n", report.Checked, len(report.Repaired))
+		for _, key := range report.Unrecoverable {
+			colorstring.Printf("[red]unrecoverable : %s\n", key)
+		}
+		return nil
+	},
+}
+
+// rebalance ...
+var rebalance = cli.Command{
+	Name:    "Rebalance",
+	Aliases: []string{"rebalance"},
+	Usage:   "moves objects of a striped repository to the disks that own them",
+	Description: `this command moves every object stored on the disks given with --disk
+	that is not on the disk owning it. run it after adding or removing a disk;
+	only the objects whose owner changed are moved.
+	to remove a disk, pass it with --drain instead of --disk ; every object it
+	holds is moved to the other disks, after which it can be taken out.
+	objects are locked one at a time while they move, so the repository can be
+	used while a rebalance runs.
+	--reweigh flag recomputes the weight of every disk from its current free space
+	before moving objects.
+	`,
+	Flags: append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "reweigh",
+			Usage: "recompute disk weights from their current free space",
+		},
+	}, append(append([]cli.Flag{}, stripeFlags...), keyFlags...)...),
+	Action: func(ctx *cli.Context) error {
+		kr, err := unlock(ctx, newStripeStorage(ctx, nil))
+		if err != nil {
+			log.Fatal(err)
+		}
+		store := newStripeStorage(ctx, kr)
+		err = store.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := store.Rebalance(context.Background(), ctx.Bool("reweigh"))
 		if err != nil {
 			log.Fatal(err)
 		}
+		colorstring.Printf("[green]moved (%d) objects\n", n)
 		return nil
 	},
 }
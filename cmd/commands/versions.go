@@ -0,0 +1,223 @@
+package commands
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	utils "github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+	"github.com/urfave/cli"
+)
+
+// versionKeyFlags select the object whose versions are used
+var versionKeyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "key",
+		Value: "",
+		Usage: "key of the object",
+	},
+	cli.StringFlag{
+		Name:  "tag",
+		Value: "",
+		Usage: "tag of the snapshot whose metadata object is used, instead of --key",
+	},
+}
+
+// versions ...
+var versions = cli.Command{
+	Name:    "Versions",
+	Aliases: []string{"versions"},
+	Usage:   "manages the prior versions kept by repositories written with --versioning",
+	Subcommands: []cli.Command{
+		versionsList,
+		versionsRestore,
+		versionsPurge,
+	},
+}
+
+// versionsList ...
+var versionsList = cli.Command{
+	Name:    "List",
+	Aliases: []string{"list"},
+	Usage:   "lists the prior versions of an object",
+	Description: `this command lists the versions of the object given with --key, or of
+	the metadata of the snapshot given with --tag, oldest first.
+	`,
+	Flags: append(append([]cli.Flag{}, versionKeyFlags...), backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		withVersionedStorage(ctx, func(store *file.Storage) {
+			key := versionedKey(ctx)
+			out, err := store.ListVersions(context.Background(), key)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(out) == 0 {
+				colorstring.Printf("[yellow]no prior versions of (%s)\n", key)
+				return
+			}
+			for _, v := range out {
+				colorstring.Printf("[cyan]%s  %s  %10s  %s\n", v.ID, v.Archived.Format(time.RFC3339), utils.PrettyPrintSize(v.Size), v.ETag)
+			}
+		})
+		return nil
+	},
+}
+
+// versionsRestore ...
+var versionsRestore = cli.Command{
+	Name:    "Restore",
+	Aliases: []string{"restore"},
+	Usage:   "makes a prior version of an object current again",
+	Description: `this command writes the version given with --id of the object given
+	with --key over the current object. the current object is kept as a version
+	of its own.
+	with --tag, the version given with --id is one of the metadata of the
+	snapshot, and the chunks of the snapshot are restored to what they were
+	when that metadata was written too. snapshot keys are never kept as
+	versions, so a snapshot taken with --snapshot-key cannot be brought back
+	once its tag was re-used.
+	`,
+	Flags: append(append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "id",
+			Value: "",
+			Usage: "id of the version to restore, as shown by [versions list]",
+		},
+	}, versionKeyFlags...), backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		withVersionedStorage(ctx, func(store *file.Storage) {
+			key := versionedKey(ctx)
+			if tag := ctx.String("tag"); len(tag) != 0 {
+				restoreSnapshotVersion(store, tag, ctx.String("id"))
+				return
+			}
+			entry, err := store.GetVersion(context.Background(), key, ctx.String("id"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if entry == nil {
+				log.Fatal(stacktrace.NewError("[ERROR] (%s) has no version (%s)", key, ctx.String("id")))
+			}
+			err = store.Put(context.Background(), entry)
+			if err != nil {
+				log.Fatal(err)
+			}
+			colorstring.Printf("[green]restored version (%s) of (%s)\n", ctx.String("id"), key)
+		})
+		return nil
+	},
+}
+
+// versionsPurge ...
+var versionsPurge = cli.Command{
+	Name:    "Purge",
+	Aliases: []string{"purge"},
+	Usage:   "removes old prior versions",
+	Description: `this command removes the versions of objects under --prefix that were
+	archived longer ago than --max-age, and all but the newest --max-count
+	versions of every object, or every one of them with --all. current objects
+	are never removed.
+	`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "prefix",
+			Value: "",
+			Usage: "only purge versions of objects under this key prefix",
+		},
+		cli.DurationFlag{
+			Name:  "max-age",
+			Value: 0,
+			Usage: "remove versions archived longer ago than this, e.g. [720h]. 0 keeps versions of any age",
+		},
+		cli.IntFlag{
+			Name:  "max-count",
+			Value: 0,
+			Usage: "keep at most this many versions of every object. 0 keeps any number",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "remove every version, whatever its age. [key rotate] needs it",
+		},
+	}, backendFlags...),
+	Action: func(ctx *cli.Context) error {
+		policy := file.PurgePolicy{
+			MaxAge:   ctx.Duration("max-age"),
+			MaxCount: ctx.Int("max-count"),
+			All:      ctx.Bool("all"),
+		}
+		if policy.MaxAge <= 0 && policy.MaxCount <= 0 && !policy.All {
+			log.Fatal(stacktrace.NewError("[ERROR] one of --max-age, --max-count and --all is needed"))
+		}
+		withVersionedStorage(ctx, func(store *file.Storage) {
+			removed, err := store.PurgeVersions(context.Background(), ctx.String("prefix"), policy)
+			if err != nil {
+				log.Fatal(err)
+			}
+			colorstring.Printf("[green]removed (%d) versions\n", removed)
+		})
+		return nil
+	},
+}
+
+// withVersionedStorage opens the file repository given as the first
+// argument with versioning enabled, and calls fn with it
+func withVersionedStorage(ctx *cli.Context, fn func(store *file.Storage)) {
+	if backend := ctx.String("backend"); backend != "" && backend != "file" {
+		log.Fatal(stacktrace.NewError("[ERROR] versions are only kept by the file backend, not (%s)", backend))
+	}
+	path := repositoryPath(ctx)
+	kr, err := repositoryKey(ctx, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store := newFileStorage(ctx, path, kr, file.WithVersioning())
+	err = store.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fn(store)
+}
+
+// restoreSnapshotVersion restores the objects of snapshot tag to what they
+// were when version id of its metadata was written. a re-used tag
+// overwrites chunks too, so the metadata alone would not do. snapshot keys
+// are left alone; they are never kept as versions
+func restoreSnapshotVersion(store *file.Storage, tag, id string) {
+	out, err := store.ListVersions(context.Background(), utils.PathJoin(".metadata", tag))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var at time.Time
+	for _, v := range out {
+		if v.ID == id {
+			at = v.ModTime
+		}
+	}
+	if at.IsZero() {
+		log.Fatal(stacktrace.NewError("[ERROR] snapshot (%s) has no version (%s)", tag, id))
+	}
+	restored := 0
+	for _, prefix := range []string{".metadata", ".chunks"} {
+		n, err := store.RestoreVersions(context.Background(), utils.PathJoin(prefix, tag), at)
+		if err != nil {
+			log.Fatal(err)
+		}
+		restored += n
+	}
+	colorstring.Printf("[green]restored (%d) objects of snapshot (%s) as of %s\n", restored, tag, at.Format(time.RFC3339))
+}
+
+// versionedKey returns the key selected by --key or --tag
+func versionedKey(ctx *cli.Context) string {
+	if tag := ctx.String("tag"); len(tag) != 0 {
+		return utils.PathJoin(".metadata", tag)
+	}
+	key := ctx.String("key")
+	if len(key) == 0 {
+		log.Fatal(stacktrace.NewError("[ERROR] one of --key and --tag is needed"))
+	}
+	return key
+}
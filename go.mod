@@ -4,10 +4,14 @@ go 1.12
 
 require (
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0
+	github.com/klauspost/cpuid v1.2.1 // indirect
+	github.com/klauspost/reedsolomon v1.9.3
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db
 	github.com/mitchellh/hashstructure v1.0.0
 	github.com/palantir/stacktrace v0.0.0-20161112013806-78658fd2d177
 	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/urfave/cli v1.21.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 )
@@ -0,0 +1,3 @@
+// Package keylock is used to guard objects stored at keys with a fixed
+// number of striped read/write locks
+package keylock
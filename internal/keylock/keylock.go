@@ -0,0 +1,24 @@
+package keylock
+
+import (
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// count is the number of locks keys are spread over. operations on keys
+// sharing a lock are serialised, others run in parallel
+const count = 256
+
+// Locks - striped read/write locks guarding the objects stored at keys.
+// the zero value is ready to use
+type Locks [count]sync.RWMutex
+
+// ForKey returns the lock guarding the object stored at key. keys naming
+// the same path share a lock
+func (l *Locks) ForKey(key string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(filepath.Clean(strings.TrimPrefix(key, "/"))))
+	return &l[h.Sum32()%count]
+}
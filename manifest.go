@@ -0,0 +1,223 @@
+package chunker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sort"
+
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
+)
+
+// manifestDomain separates manifest signatures from any other use of a
+// signing key
+const manifestDomain = "splitter manifest v1\x00"
+
+var (
+	// ErrUnsignedManifest is returned when a manifest that must be signed
+	// is not
+	ErrUnsignedManifest = stacktrace.NewError("[ERROR] manifest is not signed")
+	// ErrMerkleRoot is returned when the Merkle root of a manifest does not
+	// match its entities and chunks
+	ErrMerkleRoot = stacktrace.NewError("[ERROR] manifest does not match its Merkle root")
+	// ErrSignature is returned when the signature of a manifest does not
+	// verify with any of the trusted keys
+	ErrSignature = stacktrace.NewError("[ERROR] manifest signature does not verify")
+)
+
+// GenerateSigningKey - returns a new Ed25519 key pair manifests are signed
+// with
+func GenerateSigningKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not generate signing key")
+		return nil, nil, err
+	}
+	return public, private, nil
+}
+
+// ComputeMerkleRoot - returns the root of the Merkle tree whose leaves are
+// the header of md and each of its entities, along with the digests of
+// their chunks, in path order
+func (md *SnapshotMetadata) ComputeMerkleRoot() []byte {
+	entities := append(md.Entities[:0:0], md.Entities...)
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Path < entities[j].Path
+	})
+	leaves := make([][]byte, 0, len(entities)+1)
+	h := newLeaf()
+	writeString(h, md.Tag)
+	writeUint(h, uint64(md.StartTime))
+	writeUint(h, uint64(md.EndTime))
+	writeUint(h, uint64(md.NumberOfFiles))
+	leaves = append(leaves, h.Sum(nil))
+	for _, fw := range entities {
+		h := newLeaf()
+		writeString(h, fw.Path)
+		writeUint(h, uint64(fw.Size))
+		writeUint(h, uint64(fw.Time))
+		writeUint(h, uint64(fw.Mode))
+		writeUint(h, fw.Hash)
+		sections := append(md.ChunkMap[fw.Hash][:0:0], md.ChunkMap[fw.Hash]...)
+		sort.SliceStable(sections, func(i, j int) bool {
+			return sections[i].Number < sections[j].Number
+		})
+		writeUint(h, uint64(len(sections)))
+		for _, sec := range sections {
+			writeUint(h, uint64(sec.Number))
+			writeUint(h, uint64(sec.Start))
+			writeUint(h, uint64(sec.Size))
+			writeString(h, sec.Hash)
+			writeString(h, sec.Digest)
+			writeString(h, sec.ID)
+			writeString(h, string(sec.Key))
+		}
+		leaves = append(leaves, h.Sum(nil))
+	}
+	// odd nodes are promoted to the next level as they are
+	for len(leaves) > 1 {
+		next := make([][]byte, 0, (len(leaves)+1)/2)
+		for i := 0; i < len(leaves); i += 2 {
+			if i+1 == len(leaves) {
+				next = append(next, leaves[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(leaves[i])
+			h.Write(leaves[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		leaves = next
+	}
+	return leaves[0]
+}
+
+// Sign - sets the Merkle root of md and signs it with key
+func (md *SnapshotMetadata) Sign(key ed25519.PrivateKey) {
+	md.MerkleRoot = md.ComputeMerkleRoot()
+	md.SignedBy = key.Public().(ed25519.PublicKey)
+	md.Signature = ed25519.Sign(key, manifestMessage(md.MerkleRoot))
+}
+
+// Verify - checks md against its Merkle root, and the root against its
+// signature, which must be made by one of trusted. the key md names as its
+// signer is never trusted on its own, since whoever rewrote md could have
+// named theirs
+func (md *SnapshotMetadata) Verify(trusted ...ed25519.PublicKey) error {
+	if len(md.Signature) == 0 {
+		return ErrUnsignedManifest
+	}
+	err := md.VerifyMerkleRoot()
+	if err != nil {
+		return err
+	}
+	for _, key := range trusted {
+		if len(key) != ed25519.PublicKeySize {
+			continue
+		}
+		if ed25519.Verify(key, manifestMessage(md.MerkleRoot), md.Signature) {
+			return nil
+		}
+	}
+	return ErrSignature
+}
+
+// VerifyMerkleRoot - checks md against its Merkle root. this proves md was
+// not damaged, not who wrote it; see Verify
+func (md *SnapshotMetadata) VerifyMerkleRoot() error {
+	if !bytes.Equal(md.ComputeMerkleRoot(), md.MerkleRoot) {
+		return ErrMerkleRoot
+	}
+	return nil
+}
+
+// VerifySignature - returns the metadata of snapshot tag once its Merkle
+// root and signature verify with the keys given WithVerifyKeys
+func (s *Multipart) VerifySignature(ctx context.Context, tag string) (*SnapshotMetadata, error) {
+	md, _, err := s.loadMetadata(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	err = s.verifyMetadata(tag, md, true)
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// loadMetadata reads and decodes the metadata of snapshot tag, returning
+// its snapshot key as well
+func (s *Multipart) loadMetadata(ctx context.Context, tag string) (*SnapshotMetadata, []byte, error) {
+	result, err := s.disk.Get(ctx, s.metadataKey(tag))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Failed to retrieve metadata for (%s)", tag)
+		return nil, nil, err
+	}
+	if result == nil {
+		err = stacktrace.NewError("[ERROR] snapshot (%s) was not found", tag)
+		return nil, nil, err
+	}
+	return s.decodeMetadata(ctx, tag, result.Value)
+}
+
+// verifyMetadata rejects the metadata of snapshot tag unless it is signed
+// by one of the keys given WithVerifyKeys. without such keys, signed is
+// set when a signature is required, so nothing can be verified; otherwise
+// unsigned metadata is accepted and signed metadata must still be intact
+func (s *Multipart) verifyMetadata(tag string, md *SnapshotMetadata, signed bool) error {
+	if len(s.verifyKeys) == 0 {
+		if signed {
+			return stacktrace.NewError("[ERROR] refusing snapshot (%s) : no signing key is trusted to verify it with", tag)
+		}
+		if len(md.Signature) == 0 {
+			return nil
+		}
+		err := md.VerifyMerkleRoot()
+		if err != nil {
+			return stacktrace.Propagate(err, "[ERROR] refusing snapshot (%s)", tag)
+		}
+		colorstring.Printf("[yellow][WARN] snapshot (%s) is intact, but no signing key is trusted, so who signed it is not checked\n", tag)
+	} else {
+		err := md.Verify(s.verifyKeys...)
+		if err != nil {
+			return stacktrace.Propagate(err, "[ERROR] refusing snapshot (%s)", tag)
+		}
+	}
+	// the tag is signed along with the rest of the metadata, so metadata
+	// copied under another tag is refused
+	if md.Tag != tag {
+		err := stacktrace.NewError("[ERROR] refusing snapshot (%s) : its metadata was signed for snapshot (%s)", tag, md.Tag)
+		return err
+	}
+	return nil
+}
+
+func manifestMessage(root []byte) []byte {
+	return append([]byte(manifestDomain), root...)
+}
+
+// newLeaf returns a hash for a leaf of the manifest Merkle tree
+func newLeaf() hash.Hash {
+	h := sha256.New()
+	h.Write([]byte{0})
+	return h
+}
+
+func writeUint(h hash.Hash, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
+
+// writeString writes s prefixed with its length, so field boundaries are
+// unambiguous
+func writeString(h hash.Hash, s string) {
+	writeUint(h, uint64(len(s)))
+	h.Write([]byte(s))
+}
@@ -0,0 +1,101 @@
+package chunker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+func TestVerify(t *testing.T) {
+	public, private, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestSplitter(t, WithSigningKey(private), WithVerifyKeys(public))
+	err = s.Snapshot(context.Background(), "signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := s.VerifySignature(context.Background(), "signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = md.Verify(other); err != ErrSignature {
+		t.Errorf("a manifest verified with an untrusted key: %v", err)
+	}
+	for name, tamper := range map[string]func(md *SnapshotMetadata){
+		"tag":  func(md *SnapshotMetadata) { md.Tag = "other" },
+		"size": func(md *SnapshotMetadata) { md.Entities[0].Size++ },
+		"chunk": func(md *SnapshotMetadata) {
+			for _, sections := range md.ChunkMap {
+				sections[0].Digest = "forged"
+			}
+		},
+		"signer": func(md *SnapshotMetadata) {
+			_, forger, err := GenerateSigningKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			md.Sign(forger)
+		},
+	} {
+		tampered, err := s.VerifySignature(context.Background(), "signed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tamper(tampered)
+		err = tampered.Verify(public)
+		if err == nil {
+			t.Errorf("a manifest whose %s was changed verified", name)
+		}
+	}
+	// signed metadata copied under another tag is refused
+	entry, err := s.disk.Get(context.Background(), s.metadataKey("signed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.disk.Put(context.Background(), &file.Entry{Key: s.metadataKey("copy"), Value: entry.Value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.VerifySignature(context.Background(), "copy")
+	if err == nil {
+		t.Error("a signed snapshot verified under another tag")
+	}
+	md.Signature = nil
+	if err = md.Verify(public); err != ErrUnsignedManifest {
+		t.Errorf("an unsigned manifest returned %v", err)
+	}
+}
+
+// snapshots whose manifest is not signed by a trusted key must not be
+// restored
+func TestRestoreUnsigned(t *testing.T) {
+	ctx := context.Background()
+	public, _, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, data := newTestSplitter(t)
+	err = s.Snapshot(ctx, "unsigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := restored(t, s, "unsigned")
+	if err != nil || string(value) != string(data) {
+		t.Fatalf("an unsigned snapshot was not restored without trusted keys: %v", err)
+	}
+	err = s.Option(WithVerifyKeys(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restored(t, s, "unsigned")
+	if err == nil {
+		t.Fatal("an unsigned snapshot was restored")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -13,11 +14,31 @@ import (
 	"github.com/damoonazarpazhooh/File-Ingestion/internal/permitpool"
 	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
 	"github.com/damoonazarpazhooh/File-Ingestion/pkg/filewrapper"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/keys"
 	"github.com/damoonazarpazhooh/File-Ingestion/pkg/section"
 	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
 	"github.com/kardianos/osext"
 	"github.com/mitchellh/colorstring"
 	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ConvergentPrefix is where convergently encrypted chunks are stored, one
+// object per distinct chunk. backends must store objects under it as is,
+// since they are sealed already
+const ConvergentPrefix = ".chunks/convergent"
+
+// SnapshotKeyPrefix is where the keys of snapshots taken with
+// per-snapshot keys are stored. they are encrypted by the backend like any
+// other object, so they are wrapped by the repository key. they must be
+// stored as loose objects, never in packs, so deleting one destroys it
+const SnapshotKeyPrefix = ".snapshot-keys"
+
+// maxBatchEntries and maxBatchSize bound the entries and bytes queued for
+// a single batch on backends that commit writes in batches
+const (
+	maxBatchEntries = 4096
+	maxBatchSize    = 64 << 20
 )
 
 // Multipart ...
@@ -30,12 +51,23 @@ type Multipart struct {
 	rootMetaName           string
 	rootChunksDir          string
 	encryptionKey          string
+	dataKey                []byte
+	namingKey              []byte
+	convergenceSecret      []byte
+	snapshotKeys           bool
+	signingKey             ed25519.PrivateKey
+	verifyKeys             []ed25519.PublicKey
 	encryptionHeaderString string
 	chunkSize              int64
+	numberOfThreads        int
 	gzipCompressionLevel   int
 	wg                     sync.WaitGroup
-	disk                   *file.Storage
+	disk                   file.Backend
 	permitpool             permitpool.PermitPool
+	// pending holds the entries of the snapshot in progress when disk
+	// commits them in batches, and pendingSize the bytes they hold
+	pending     []*file.Entry
+	pendingSize int
 }
 
 // New ...
@@ -66,28 +98,31 @@ func New(opts ...Option) *Multipart {
 		result.rootChunksDir = ".chunks"
 	}
 
-	// TODO FIX THIS
-	disk := file.New(
-		file.WithNumberOfThreads(1),
-		file.WithPath(result.root),
-		file.WithEncryption(result.encryptionKey),
-	)
-	if result.logOps {
-		disk = file.New(
-			file.WithNumberOfThreads(1),
+	if result.numberOfThreads < 1 {
+		result.numberOfThreads = runtime.NumCPU()
+	}
+	if result.disk == nil {
+		diskOpts := []file.Option{
+			file.WithNumberOfThreads(result.numberOfThreads),
 			file.WithPath(result.root),
 			file.WithEncryption(result.encryptionKey),
-			file.LogOps(),
-		)
+			file.WithPlaintextPrefixes(keys.Prefix, ConvergentPrefix),
+		}
+		if result.dataKey != nil {
+			diskOpts = append(diskOpts, file.WithEncryptionKey(result.dataKey))
+		}
+		if result.logOps {
+			diskOpts = append(diskOpts, file.LogOps())
+		}
+		result.disk = file.New(diskOpts...)
 	}
-	err = disk.Init()
+	err = result.disk.Init()
 	if err != nil {
 		err = stacktrace.Propagate(err, "[FATAL] Splitter : Error setting up new filesystem")
 		log.Fatal(err)
 	}
-	result.disk = disk
 	result.permitpool = permitpool.New(
-		permitpool.WithPermits(1),
+		permitpool.WithPermits(result.numberOfThreads),
 	)
 	if result.chunkSize == 0 {
 		// chunk size : 8 MiB default
@@ -104,6 +139,11 @@ type SnapshotMetadata struct {
 	NumberOfFiles int                           `json:"number_of_files" mapstructure:"number_of_files"`
 	Entities      []*filewrapper.File           `json:"entities" mapstructure:"entities"`
 	ChunkMap      map[uint64][]*section.Section `json:"chunk-map" mapstructure:"chunk-map"`
+	// MerkleRoot, SignedBy and Signature are set on snapshots taken with a
+	// signing key. see Sign
+	MerkleRoot []byte `json:"merkle_root,omitempty" mapstructure:"merkle_root"`
+	SignedBy   []byte `json:"signed_by,omitempty" mapstructure:"signed_by"`
+	Signature  []byte `json:"signature,omitempty" mapstructure:"signature"`
 }
 
 // NewMetadata ...
@@ -121,6 +161,12 @@ func (s *Multipart) NewMetadata(tag string) (*SnapshotMetadata, error) {
 			return err
 		}
 		mode := info.Mode()
+		// skip the repository itself, the same way listEntities does
+		if mode.IsDir() && filepath.Dir(path) == s.root {
+			if info.Name() == s.rootMetaName || info.Name() == s.rootChunksDir || info.Name() == keys.Prefix || info.Name() == SnapshotKeyPrefix || info.Name() == file.VersionsPrefix {
+				return filepath.SkipDir
+			}
+		}
 		if !mode.IsDir() {
 			entity := filewrapper.New(s.root, strings.TrimPrefix(path, s.root), info.Size(), info.ModTime().Unix(), uint32(mode))
 			result.NumberOfFiles++
@@ -204,7 +250,7 @@ func (s *Multipart) listEntities(path string, entityList *[]*filewrapper.File) (
 	entries := make([]*filewrapper.File, 0, 4)
 	for _, f := range files {
 		// skipif entity name is the same as metadata entity or chunks
-		if f.Name() == s.rootMetaName || f.Name() == s.rootChunksDir {
+		if f.Name() == s.rootMetaName || f.Name() == s.rootChunksDir || f.Name() == keys.Prefix || f.Name() == SnapshotKeyPrefix || f.Name() == file.VersionsPrefix {
 			continue
 		}
 		entry := filewrapper.CreateFileFromFileInfo(f, s.root, normalizedPath)
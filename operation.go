@@ -2,6 +2,9 @@ package chunker
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
@@ -33,6 +36,15 @@ func (s *Multipart) Snapshot(ctx context.Context, tag string) error {
 		err = stacktrace.Propagate(err, "[ERROR] Failed to extract metadata for (%s)", s.root)
 		return err
 	}
+	var snapshotKey []byte
+	if s.snapshotKeys {
+		// the key is stored before any chunk, so an interrupted snapshot
+		// can still be shredded
+		snapshotKey, err = s.newSnapshotKey(ctx, tag)
+		if err != nil {
+			return err
+		}
+	}
 	openedFiles := md.Entities
 	for _, v := range openedFiles {
 		if !v.IsFile() || v.Size == 0 {
@@ -50,21 +62,48 @@ func (s *Multipart) Snapshot(ctx context.Context, tag string) error {
 
 		s.wg.Add(1)
 		defer osfile.Close()
-		go s.split(ctx, v, osfile, tag, md)
+		go s.split(ctx, v, osfile, tag, md, snapshotKey)
 		// s.split(ctx, v, osfile, tag, md)
 	}
 	s.wg.Wait()
+	// chunks must be durable before the metadata referencing them is stored
+	if flusher, ok := s.disk.(file.Flusher); ok {
+		err = flusher.Flush(ctx)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] : Splitter failed to flush snapshot (%s) chunks to disk\n", tag)
+			return err
+		}
+	}
 	md.EndTime = time.Now().Unix()
+	if s.signingKey != nil {
+		md.Sign(s.signingKey)
+	}
 	mdJSON, err := jsonutil.EncodeJSONWithIndentation(md)
 	if err != nil {
 		err = stacktrace.Propagate(err, "[ERROR] could not encode snapshot metadata as json")
 		return err
 	}
+	if snapshotKey != nil {
+		mdJSON, err = file.Encrypt(snapshotKey, mdJSON)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] could not encrypt snapshot (%s) metadata", tag)
+			return err
+		}
+	}
 	payload := &file.Entry{
-		Key:   utils.PathJoin(s.rootMetaName, tag),
+		Key:   s.metadataKey(tag),
 		Value: mdJSON,
 	}
-	err = s.disk.Put(ctx, payload)
+	if batcher, ok := s.disk.(file.Batcher); ok {
+		s.stateLock.Lock()
+		entries := append(s.pending, payload)
+		s.pending = nil
+		s.pendingSize = 0
+		s.stateLock.Unlock()
+		err = batcher.Batch(ctx, entries)
+	} else {
+		err = s.disk.Put(ctx, payload)
+	}
 	if err != nil {
 		err = stacktrace.Propagate(err, "[ERROR] : Splitter failed to store snapshot (%s) metadata on disk\n", tag)
 		return err
@@ -72,7 +111,7 @@ func (s *Multipart) Snapshot(ctx context.Context, tag string) error {
 	return nil
 }
 
-func (s *Multipart) split(ctx context.Context, fw *filewrapper.File, osfile *os.File, tag string, metadata *SnapshotMetadata) error {
+func (s *Multipart) split(ctx context.Context, fw *filewrapper.File, osfile *os.File, tag string, metadata *SnapshotMetadata, snapshotKey []byte) error {
 	defer s.wg.Done()
 	// defer osfile.Close()
 	fileSize := fw.Size
@@ -105,6 +144,9 @@ func (s *Multipart) split(ctx context.Context, fw *filewrapper.File, osfile *os.
 		// if s.encryptionKey != nil {
 		// 	c.WithEncryption(s.encryptionKey)
 		// }
+		if s.convergenceSecret != nil {
+			c.WithConvergentEncryption(s.convergenceSecret)
+		}
 
 		chunkPathDir := utils.PathJoin(
 			s.rootChunksDir,
@@ -115,15 +157,32 @@ func (s *Multipart) split(ctx context.Context, fw *filewrapper.File, osfile *os.
 		value, _ := c.Data()
 		hash := c.Hash
 		payload := &file.Entry{
-			Key:   utils.PathJoin(chunkPathDir, hash),
+			Key:   s.chunkKey(utils.PathJoin(chunkPathDir, hash)),
 			Value: value,
 		}
+		if len(c.ID) != 0 {
+			payload.Key = convergentKey(c.ID)
+		}
 		md, err := jsonutil.EncodeJSONWithIndentation(c)
 		if err != nil {
 			err = stacktrace.Propagate(err, "[ERROR] could not encode chunk (%s) metadata", chunkPathDir)
 		}
+		if snapshotKey != nil {
+			// convergent chunks are shared with other snapshots, and are
+			// only protected through the metadata holding their keys
+			if len(c.ID) == 0 {
+				payload.Value, err = file.Encrypt(snapshotKey, value)
+			}
+			if err == nil {
+				md, err = file.Encrypt(snapshotKey, md)
+			}
+			if err != nil {
+				err = stacktrace.Propagate(err, "[ERROR] could not encrypt chunk (%s) with the snapshot key", chunkPathDir)
+				log.Fatal(err)
+			}
+		}
 		mdPayload := &file.Entry{
-			Key:   utils.PathJoin(chunkPathDir, ".metadata"),
+			Key:   s.chunkKey(utils.PathJoin(chunkPathDir, ".metadata")),
 			Value: md,
 		}
 		s.wg.Add(1)
@@ -132,13 +191,13 @@ func (s *Multipart) split(ctx context.Context, fw *filewrapper.File, osfile *os.
 			defer s.permitpool.Release()
 			defer s.wg.Done()
 			var err error
-			err = s.disk.Put(ctx, payload)
+			err = s.put(ctx, payload)
 			if err != nil {
 				err = stacktrace.Propagate(err, "[ERROR] : Splitter failed to store chunk (%s) on disk\n", hash)
 				log.Fatal(err)
 				return
 			}
-			err = s.disk.Put(ctx, mdPayload)
+			err = s.put(ctx, mdPayload)
 			if err != nil {
 				err = stacktrace.Propagate(err, "[ERROR] : Splitter failed to store chunk (%s) metadata on disk\n", hash)
 				log.Fatal(err)
@@ -156,6 +215,31 @@ func (s *Multipart) split(ctx context.Context, fw *filewrapper.File, osfile *os.
 	return nil
 }
 
+// put stores entry on disk, or queues it for the next batch when disk
+// supports batched writes. a batch is committed once it holds
+// maxBatchEntries entries or maxBatchSize bytes, so memory stays bounded
+// however large the snapshot; the metadata written last commits the rest.
+func (s *Multipart) put(ctx context.Context, entry *file.Entry) error {
+	batcher, ok := s.disk.(file.Batcher)
+	if !ok {
+		return s.disk.Put(ctx, entry)
+	}
+	s.stateLock.Lock()
+	s.pending = append(s.pending, entry)
+	s.pendingSize += len(entry.Key) + len(entry.Value)
+	var entries []*file.Entry
+	if len(s.pending) >= maxBatchEntries || s.pendingSize >= maxBatchSize {
+		entries = s.pending
+		s.pending = nil
+		s.pendingSize = 0
+	}
+	s.stateLock.Unlock()
+	if entries == nil {
+		return nil
+	}
+	return batcher.Batch(ctx, entries)
+}
+
 // Restore ...
 func (s *Multipart) Restore(ctx context.Context, restoreRoot, tag string) error {
 	if s.logOps {
@@ -165,15 +249,15 @@ func (s *Multipart) Restore(ctx context.Context, restoreRoot, tag string) error
 			log.Println(duration)
 		}()
 	}
-	result, err := s.disk.Get(ctx, utils.PathJoin(s.rootMetaName, tag))
+	// stops prefetching once every chunk is merged
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	md, snapshotKey, err := s.loadMetadata(ctx, tag)
 	if err != nil {
-		err = stacktrace.Propagate(err, "[ERROR] Failed to retrieve metadata for (%s)", tag)
 		return err
 	}
-	md := &SnapshotMetadata{}
-	err = jsonutil.DecodeJSON(result.Value, md)
+	err = s.verifyMetadata(tag, md, false)
 	if err != nil {
-		err = stacktrace.Propagate(err, "[ERROR] Failed to decode metadata of (%s)", tag)
 		return err
 	}
 	snapshotFiles := md.Entities
@@ -204,7 +288,7 @@ func (s *Multipart) Restore(ctx context.Context, restoreRoot, tag string) error
 		defer destination.Close()
 		s.wg.Add(1)
 		// s.permitpool.Acquire()
-		go s.merge(ctx, v, destination, md)
+		go s.merge(ctx, v, destination, md, snapshotKey)
 		// go func(file *filewrapper.File, metadata *SnapshotMetadata) {
 		// 	err := s.merge(ctx, file, destination, metadata)
 		// 	if err != nil {
@@ -239,24 +323,25 @@ func (s *Multipart) Restore(ctx context.Context, restoreRoot, tag string) error
 	}
 	return nil
 }
-func (s *Multipart) merge(ctx context.Context, fw *filewrapper.File, destination *os.File, metadata *SnapshotMetadata) error {
+func (s *Multipart) merge(ctx context.Context, fw *filewrapper.File, destination *os.File, metadata *SnapshotMetadata, snapshotKey []byte) error {
 	// defer func() {
 	defer s.wg.Done()
 	// }()
 	tag := metadata.Tag
-	for _, v := range metadata.ChunkMap[fw.Hash] {
+	sections := metadata.ChunkMap[fw.Hash]
+	chunkPaths := make([]string, len(sections))
+	for i, sec := range sections {
+		chunkPaths[i] = s.sectionKey(tag, fw, sec)
+	}
+	if prefetcher, ok := s.disk.(file.Prefetcher); ok {
+		prefetcher.Prefetch(ctx, chunkPaths)
+	}
+	for i, v := range sections {
 		s.wg.Add(1)
 		s.permitpool.Acquire()
-		go func(sec *section.Section) {
+		go func(sec *section.Section, targetChunkPath string) {
 			defer s.permitpool.Release()
 			defer s.wg.Done()
-			targetChunkPath := utils.PathJoin(
-				s.rootChunksDir,
-				tag,
-				fw.Path,
-				fmt.Sprintf("%d", sec.Number),
-				sec.Hash,
-			)
 			chunkEntity, err := s.disk.Get(ctx, targetChunkPath)
 			if err != nil {
 				err = stacktrace.Propagate(err, "[ERROR] restoring snapshot (%s) failed due to error in retrieving chunk #%d (%s)", tag, sec.Number, sec.Hash)
@@ -283,17 +368,79 @@ func (s *Multipart) merge(ctx context.Context, fw *filewrapper.File, destination
 			// if s.encryptionKey != nil {
 			// 	c.WithEncryption(s.encryptionKey)
 			// }
+			c.ID = sec.ID
+			c.Key = sec.Key
+			c.Digest = sec.Digest
+			value := chunkEntity.Value
+			if snapshotKey != nil && len(sec.ID) == 0 {
+				value, err = file.Decrypt(snapshotKey, value)
+				if err != nil {
+					err = stacktrace.Propagate(err, "[ERROR] restoring snapshot (%s) failed due to not being able to decrypt chunk #%d (%s) with the snapshot key", tag, sec.Number, sec.Hash)
+					log.Fatal(err)
+					return
+				}
+			}
 
-			_, err = c.Merge(chunkEntity.Value)
+			_, err = c.Merge(value)
 			if err != nil {
 				err = stacktrace.Propagate(err, "[ERROR] restoring snapshot (%s) failed due not being able to copy chunk #%d (%s)to target file", tag, sec.Number, sec.Hash)
 				log.Fatal(err)
 				return
 			}
-		}(v)
+		}(v, chunkPaths[i])
 	}
 	return nil
 }
+
+// metadataKey returns the key the metadata of snapshot tag is stored at
+func (s *Multipart) metadataKey(tag string) string {
+	key := utils.PathJoin(s.rootMetaName, tag)
+	if s.namingKey == nil {
+		return key
+	}
+	return utils.PathJoin(s.rootMetaName, s.obfuscate(key))
+}
+
+// chunkKey returns the key a chunk object named key is stored at.
+// obfuscated chunk keys are spread over 256 directories, the way the
+// original layout spreads them over tags and paths
+func (s *Multipart) chunkKey(key string) string {
+	if s.namingKey == nil {
+		return key
+	}
+	name := s.obfuscate(key)
+	return utils.PathJoin(s.rootChunksDir, name[:2], name)
+}
+
+// sectionKey returns the key the chunk sec of file fw in snapshot tag is
+// stored at
+func (s *Multipart) sectionKey(tag string, fw *filewrapper.File, sec *section.Section) string {
+	if len(sec.ID) != 0 {
+		return convergentKey(sec.ID)
+	}
+	return s.chunkKey(utils.PathJoin(
+		s.rootChunksDir,
+		tag,
+		fw.Path,
+		fmt.Sprintf("%d", sec.Number),
+		sec.Hash,
+	))
+}
+
+// convergentKey returns the key the convergently encrypted chunk id is
+// stored at
+func convergentKey(id string) string {
+	return utils.PathJoin(ConvergentPrefix, id[:2], id)
+}
+
+// obfuscate returns the hex encoded HMAC-SHA256 of key under the naming
+// key
+func (s *Multipart) obfuscate(key string) string {
+	mac := hmac.New(sha256.New, s.namingKey)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func prefixes(s string) []string {
 	components := strings.Split(s, "/")
 	result := []string{}
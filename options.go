@@ -3,9 +3,11 @@ package chunker
 import (
 	"path/filepath"
 
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
 	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
 	"github.com/kardianos/osext"
 	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
 )
 
 // Option - this method is used to change splitter's configuration after
@@ -80,6 +82,97 @@ func WithEncryption(key string) Option {
 	}
 }
 
+// WithEncryptionKey - encrypts the default file storage with the given
+// 256-bit data key, as unlocked from a repository key file, instead of
+// deriving one from a string
+func WithEncryptionKey(arg []byte) Option {
+	return func(s *Multipart) {
+		s.stateLock.Lock()
+		defer s.stateLock.Unlock()
+		s.dataKey = arg
+	}
+}
+
+// WithObfuscatedKeys - names objects after an HMAC of their key, keyed
+// with the given naming key, so the storage layout does not reveal tags,
+// file paths or chunk hashes. repositories must be restored with the same
+// naming key they were snapshotted with
+func WithObfuscatedKeys(namingKey []byte) Option {
+	return func(s *Multipart) {
+		s.stateLock.Lock()
+		defer s.stateLock.Unlock()
+		s.namingKey = namingKey
+	}
+}
+
+// WithConvergentEncryption - seals every chunk with a key derived from an
+// HMAC of its contents under secret, and stores it under an id derived from
+// that key. equal chunks are stored once, while repositories with different
+// secrets share nothing. chunk keys are kept in the snapshot metadata.
+// secret must not key anything else, such as obfuscated object keys
+func WithConvergentEncryption(secret []byte) Option {
+	return func(s *Multipart) {
+		s.stateLock.Lock()
+		defer s.stateLock.Unlock()
+		s.convergenceSecret = secret
+	}
+}
+
+// WithSnapshotKeys - encrypts the chunks and metadata of new snapshots
+// with a random key of their own, stored under SnapshotKeyPrefix, so Shred
+// can make a snapshot unreadable by destroying its key. convergently
+// encrypted chunks are shared between snapshots and stay sealed with their
+// content keys only; the snapshot key protects the metadata holding those
+// keys, so a shared chunk stays readable through the other snapshots
+// referencing it
+func WithSnapshotKeys() Option {
+	return func(s *Multipart) {
+		s.stateLock.Lock()
+		defer s.stateLock.Unlock()
+		s.snapshotKeys = true
+	}
+}
+
+// WithSigningKey - signs the Merkle root of the metadata of new snapshots
+// with the given Ed25519 key
+func WithSigningKey(arg ed25519.PrivateKey) Option {
+	return func(s *Multipart) {
+		s.stateLock.Lock()
+		defer s.stateLock.Unlock()
+		s.signingKey = arg
+	}
+}
+
+// WithVerifyKeys - only restores snapshots whose metadata is signed by one
+// of the given Ed25519 keys
+func WithVerifyKeys(arg ...ed25519.PublicKey) Option {
+	return func(s *Multipart) {
+		s.stateLock.Lock()
+		defer s.stateLock.Unlock()
+		s.verifyKeys = append(s.verifyKeys, arg...)
+	}
+}
+
+// WithBackend - stores chunks and metadata on the given backend instead
+// of the default file.Storage rooted at the root path
+func WithBackend(arg file.Backend) Option {
+	return func(s *Multipart) {
+		s.stateLock.Lock()
+		defer s.stateLock.Unlock()
+		s.disk = arg
+	}
+}
+
+// WithNumberOfThreads - sets the number of chunks stored or restored at
+// once. defaults to one per cpu
+func WithNumberOfThreads(arg int) Option {
+	return func(s *Multipart) {
+		s.stateLock.Lock()
+		defer s.stateLock.Unlock()
+		s.numberOfThreads = arg
+	}
+}
+
 // WithChunkSizeInMegabytes -
 func WithChunkSizeInMegabytes(arg int64) Option {
 	return func(s *Multipart) {
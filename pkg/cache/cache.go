@@ -0,0 +1,585 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	objectsDir = "objects"
+	pinnedDir  = "pinned"
+	tmpSuffix  = ".tmp"
+)
+
+// record is an evictable object kept in the cache directory
+type record struct {
+	name string
+	size int64
+}
+
+// fetching is a running fetch of a key. generation counts the writes of
+// the key that landed while it ran, since what it read may predate them
+type fetching struct {
+	done       chan struct{}
+	generation int
+}
+
+// prefetch is a running Prefetch call
+type prefetch struct {
+	position map[string]int
+	// cursor is the position of the furthest key read so far
+	cursor int
+	cond   *sync.Cond
+}
+
+// New - constructs a new caching Storage
+func New(opts ...Option) *Storage {
+	result := &Storage{
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*fetching),
+		jobs:     make(map[*prefetch]struct{}),
+	}
+	for _, opt := range opts {
+		opt(result)
+	}
+	if result.capacity == 0 {
+		result.capacity = 256 << 20
+	}
+	if len(result.pinned) == 0 {
+		result.pinned = []string{".metadata"}
+	}
+	if result.depth == 0 {
+		result.depth = 4
+	}
+	return result
+}
+
+// Init - initializes the backend and indexes the objects already cached
+func (b *Storage) Init() error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if b.initialized {
+		return nil
+	}
+	if b.backend == nil {
+		err := stacktrace.NewError("[FATAL] Cache Storage : no backend is given")
+		return err
+	}
+	if len(b.path) == 0 {
+		err := stacktrace.NewError("[FATAL] Cache Storage : cache directory is not given")
+		return err
+	}
+	err := b.backend.Init()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[FATAL] Cache Storage : could not initialize backend")
+		return err
+	}
+	err = b.load()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[FATAL] Cache Storage : could not index cache directory (%s)", b.path)
+		return err
+	}
+	b.initialized = true
+	if b.logOps {
+		colorstring.Println(fmt.Sprintf("[yellow][INFO] Cache Storage: Initialized at %s holding %s of %s", b.path, utils.PrettyPrintSize(b.used), utils.PrettyPrintSize(b.capacity)))
+	}
+	return nil
+}
+
+// Put - writes entry to the backend. pinned objects are cached right away,
+// any other cached copy of the key is dropped
+func (b *Storage) Put(ctx context.Context, entry *file.Entry) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Cache Storage :was not initialized")
+		return err
+	}
+	err := b.backend.Put(ctx, entry)
+	if err != nil {
+		return err
+	}
+	b.written(entry.Key)
+	if b.isPinned(entry.Key) {
+		b.store(entry.Key, entry.Value)
+		return nil
+	}
+	b.drop(entry.Key)
+	return nil
+}
+
+// Get - serves k from the cache when a copy passing digest validation is
+// there, and from the backend otherwise
+func (b *Storage) Get(ctx context.Context, k string) (*file.Entry, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Cache Storage :was not initialized")
+		return nil, err
+	}
+	defer b.advance(k)
+	value, ok := b.lookup(k)
+	if ok {
+		return &file.Entry{
+			Key:   k,
+			Value: value,
+		}, nil
+	}
+	return b.fetch(ctx, k)
+}
+
+// GetRange - serves length bytes of k, starting at offset, from the cached
+// copy when there is one, and from the backend otherwise. ranges read from
+// the backend are not cached
+func (b *Storage) GetRange(ctx context.Context, k string, offset, length int64) ([]byte, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Cache Storage :was not initialized")
+		return nil, err
+	}
+	if offset < 0 || length < 0 {
+		err := stacktrace.NewError("[ERROR] Cache Storage: GetRange operation error. invalid range (%d,%d) for key (%s)", offset, length, k)
+		return nil, err
+	}
+	value, ok := b.lookup(k)
+	if !ok {
+		if rr, ok := b.backend.(file.RangeReader); ok {
+			return rr.GetRange(ctx, k, offset, length)
+		}
+		entry, err := b.fetch(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			err = stacktrace.NewError("[ERROR] Cache Storage: GetRange operation error. (%s) was not found", k)
+			return nil, err
+		}
+		value = entry.Value
+	}
+	if int64(len(value)) < offset+length {
+		err := stacktrace.NewError("[ERROR] Cache Storage: GetRange operation error. range (%d,%d) is out of bounds for key (%s)", offset, length, k)
+		return nil, err
+	}
+	return value[offset : offset+length], nil
+}
+
+// Delete - deletes k from the backend and the cache
+func (b *Storage) Delete(ctx context.Context, k string) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Cache Storage :was not initialized")
+		return err
+	}
+	err := b.backend.Delete(ctx, k)
+	if err != nil {
+		return err
+	}
+	b.written(k)
+	b.drop(k)
+	return nil
+}
+
+// List - listings are always read from the backend
+func (b *Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Cache Storage :was not initialized")
+		return nil, err
+	}
+	return b.backend.List(ctx, prefix)
+}
+
+// Flush - flushes the backend when it buffers writes
+func (b *Storage) Flush(ctx context.Context) error {
+	if flusher, ok := b.backend.(file.Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Prefetch - fetches keys into the cache in the background, staying at
+// most the prefetch depth ahead of the furthest key read with Get
+func (b *Storage) Prefetch(ctx context.Context, keys []string) {
+	if !b.initialized || len(keys) == 0 {
+		return
+	}
+	job := &prefetch{
+		position: make(map[string]int, len(keys)),
+		cursor:   -1,
+		cond:     sync.NewCond(&b.lruLock),
+	}
+	for i, key := range keys {
+		if _, ok := job.position[key]; !ok {
+			job.position[key] = i
+		}
+	}
+	b.lruLock.Lock()
+	b.jobs[job] = struct{}{}
+	b.lruLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		b.lruLock.Lock()
+		job.cond.Broadcast()
+		b.lruLock.Unlock()
+	}()
+	go func() {
+		defer close(done)
+		defer func() {
+			b.lruLock.Lock()
+			delete(b.jobs, job)
+			b.lruLock.Unlock()
+		}()
+		for i, key := range keys {
+			b.lruLock.Lock()
+			for i > job.cursor+b.depth && ctx.Err() == nil {
+				job.cond.Wait()
+			}
+			b.lruLock.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			if b.cached(key) {
+				continue
+			}
+			_, err := b.fetch(ctx, key)
+			if err != nil && b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Cache Storage: could not prefetch (%s): %v", key, err))
+			}
+		}
+	}()
+}
+
+// Clean - empties the cache directory, returning the number of bytes
+// freed. pinned objects are only removed when all is set
+func (b *Storage) Clean(all bool) (int64, error) {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if len(b.path) == 0 {
+		err := stacktrace.NewError("[ERROR] Cache Storage : cache directory is not given")
+		return 0, err
+	}
+	dirs := []string{objectsDir}
+	if all {
+		dirs = append(dirs, pinnedDir)
+	}
+	b.lruLock.Lock()
+	defer b.lruLock.Unlock()
+	freed := int64(0)
+	for _, dir := range dirs {
+		root := filepath.Join(b.path, dir)
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				freed += info.Size()
+			}
+			return nil
+		})
+		err := os.RemoveAll(root)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Cache Storage: Clean operation could not remove (%s)", root)
+			return freed, err
+		}
+	}
+	b.lru.Init()
+	b.entries = make(map[string]*list.Element)
+	b.used = 0
+	if b.logOps {
+		colorstring.Println(fmt.Sprintf("[yellow][INFO] Cache Storage: freed %s from (%s)", utils.PrettyPrintSize(freed), b.path))
+	}
+	return freed, nil
+}
+
+// load indexes the evictable objects in the cache directory, least
+// recently used last, and removes writes left behind by a crash
+func (b *Storage) load() error {
+	for _, dir := range []string{objectsDir, pinnedDir} {
+		err := os.MkdirAll(filepath.Join(b.path, dir), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	type found struct {
+		record
+		mtime time.Time
+	}
+	all := make([]found, 0)
+	err := filepath.Walk(b.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, tmpSuffix) {
+			os.Remove(path)
+			return nil
+		}
+		if filepath.Base(filepath.Dir(filepath.Dir(path))) != objectsDir {
+			return nil
+		}
+		all = append(all, found{
+			record: record{name: info.Name(), size: info.Size()},
+			mtime:  info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].mtime.Before(all[j].mtime)
+	})
+	b.lruLock.Lock()
+	defer b.lruLock.Unlock()
+	for _, f := range all {
+		r := f.record
+		b.entries[r.name] = b.lru.PushFront(&r)
+		b.used += r.size
+	}
+	b.evict()
+	return nil
+}
+
+// fetch reads k from the backend and caches it. concurrent fetches of the
+// same key wait for the first one instead of reading it again
+func (b *Storage) fetch(ctx context.Context, k string) (*file.Entry, error) {
+	b.lruLock.Lock()
+	f, ok := b.inflight[k]
+	if ok {
+		b.lruLock.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		value, ok := b.lookup(k)
+		if ok {
+			return &file.Entry{
+				Key:   k,
+				Value: value,
+			}, nil
+		}
+		return b.backend.Get(ctx, k)
+	}
+	f = &fetching{done: make(chan struct{})}
+	b.inflight[k] = f
+	b.lruLock.Unlock()
+	defer func() {
+		b.lruLock.Lock()
+		delete(b.inflight, k)
+		b.lruLock.Unlock()
+		close(f.done)
+	}()
+	entry, err := b.backend.Get(ctx, k)
+	if err != nil || entry == nil {
+		return entry, err
+	}
+	b.store(k, entry.Value)
+	// a write that landed after the read may have dropped the cached copy
+	// before it was stored. writes bump the generation before dropping, so
+	// checking it after storing catches every such write
+	b.lruLock.Lock()
+	stale := f.generation != 0
+	b.lruLock.Unlock()
+	if stale {
+		b.drop(k)
+	}
+	return entry, nil
+}
+
+// written bumps the generation of a running fetch of k, so the value it
+// read is not left cached
+func (b *Storage) written(k string) {
+	b.lruLock.Lock()
+	defer b.lruLock.Unlock()
+	if f, ok := b.inflight[k]; ok {
+		f.generation++
+	}
+}
+
+// lookup returns the cached copy of k, dropping copies that fail digest
+// validation
+func (b *Storage) lookup(k string) ([]byte, bool) {
+	path, pinned := b.location(k)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	value, err := b.decode(data)
+	if err != nil {
+		if b.logOps {
+			colorstring.Println(fmt.Sprintf("[red][WARN] Cache Storage: dropping invalid copy of (%s): %v", k, err))
+		}
+		b.drop(k)
+		return nil, false
+	}
+	if !pinned {
+		name := filepath.Base(path)
+		b.lruLock.Lock()
+		if elem, ok := b.entries[name]; ok {
+			b.lru.MoveToFront(elem)
+		}
+		b.lruLock.Unlock()
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	return value, true
+}
+
+// cached reports whether a copy of k is in the cache, without validating
+// it
+func (b *Storage) cached(k string) bool {
+	path, _ := b.location(k)
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// store caches value under k. caching is best effort; failures are only
+// logged
+func (b *Storage) store(k string, value []byte) {
+	path, pinned := b.location(k)
+	data, err := b.encode(value)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path+tmpSuffix, data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(path+tmpSuffix, path)
+	}
+	if err != nil {
+		os.Remove(path + tmpSuffix)
+		if b.logOps {
+			colorstring.Println(fmt.Sprintf("[red][WARN] Cache Storage: could not cache (%s): %v", k, err))
+		}
+		return
+	}
+	if pinned {
+		return
+	}
+	name := filepath.Base(path)
+	size := int64(len(data))
+	b.lruLock.Lock()
+	defer b.lruLock.Unlock()
+	if elem, ok := b.entries[name]; ok {
+		r := elem.Value.(*record)
+		b.used += size - r.size
+		r.size = size
+		b.lru.MoveToFront(elem)
+	} else {
+		b.entries[name] = b.lru.PushFront(&record{name: name, size: size})
+		b.used += size
+	}
+	b.evict()
+}
+
+// drop removes the cached copy of k
+func (b *Storage) drop(k string) {
+	path, _ := b.location(k)
+	os.Remove(path)
+	name := filepath.Base(path)
+	b.lruLock.Lock()
+	defer b.lruLock.Unlock()
+	if elem, ok := b.entries[name]; ok {
+		b.used -= elem.Value.(*record).size
+		b.lru.Remove(elem)
+		delete(b.entries, name)
+	}
+}
+
+// evict removes least recently used objects until the cache fits its
+// capacity. lruLock must be held
+func (b *Storage) evict() {
+	for b.used > b.capacity && b.lru.Len() != 0 {
+		elem := b.lru.Back()
+		r := elem.Value.(*record)
+		os.Remove(filepath.Join(b.path, objectsDir, r.name[:2], r.name))
+		b.used -= r.size
+		b.lru.Remove(elem)
+		delete(b.entries, r.name)
+	}
+}
+
+// advance moves the cursor of every prefetch waiting on k
+func (b *Storage) advance(k string) {
+	b.lruLock.Lock()
+	defer b.lruLock.Unlock()
+	for job := range b.jobs {
+		if p, ok := job.position[k]; ok && p > job.cursor {
+			job.cursor = p
+			job.cond.Broadcast()
+		}
+	}
+}
+
+// location returns the path k is cached at, and whether it is pinned
+func (b *Storage) location(k string) (string, bool) {
+	sum := sha256.Sum256([]byte(k))
+	name := hex.EncodeToString(sum[:])
+	pinned := b.isPinned(k)
+	dir := objectsDir
+	if pinned {
+		dir = pinnedDir
+	}
+	return filepath.Join(b.path, dir, name[:2], name), pinned
+}
+
+func (b *Storage) isPinned(k string) bool {
+	for _, component := range strings.Split(k, "/") {
+		for _, name := range b.pinned {
+			if component == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encode prefixes value with the sha256 digest of what is stored. when a
+// key is set value is encrypted first, so the digest is computed over the
+// ciphertext and reveals nothing about value
+func (b *Storage) encode(value []byte) ([]byte, error) {
+	var err error
+	if b.encryptionKey != nil {
+		value, err = file.EncryptWithCipher(b.cipherID, b.encryptionKey, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256(value)
+	return append(sum[:], value...), nil
+}
+
+// decode reverses encode, failing when the digest does not match
+func (b *Storage) decode(data []byte) ([]byte, error) {
+	if len(data) < sha256.Size {
+		return nil, stacktrace.NewError("cached copy is truncated")
+	}
+	digest, value := data[:sha256.Size], data[sha256.Size:]
+	sum := sha256.Sum256(value)
+	if !bytes.Equal(sum[:], digest) {
+		return nil, stacktrace.NewError("digest mismatch")
+	}
+	var err error
+	if b.encryptionKey != nil {
+		value, err = file.Decrypt(b.encryptionKey, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	path, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	return path
+}
+
+// newTestStorage caches a new file.Storage in a one megabyte cache
+func newTestStorage(t *testing.T, opts ...Option) (*Storage, *file.Storage) {
+	t.Helper()
+	backend := file.New(file.WithPath(tempDir(t)))
+	opts = append([]Option{WithBackend(backend), WithPath(tempDir(t)), WithSizeInMegabytes(1)}, opts...)
+	b := New(opts...)
+	err := b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, backend
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestStorage(t)
+	pinned := "snapshot/.metadata/tag"
+	err := b.Put(ctx, &file.Entry{Key: pinned, Value: []byte("metadata")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 3)
+	for i := range keys {
+		keys[i] = fmt.Sprintf(".chunks/%d", i)
+		err = b.Put(ctx, &file.Entry{Key: keys[i], Value: bytes.Repeat([]byte{byte(i)}, 400<<10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.cached(keys[i]) {
+			t.Fatalf("%s was cached on write", keys[i])
+		}
+	}
+	for _, key := range keys {
+		_, err = b.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.cached(keys[0]) {
+		t.Error("the least recently used object was not evicted")
+	}
+	for _, key := range append(keys[1:], pinned) {
+		if !b.cached(key) {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestInvalidCopy(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestStorage(t, WithEncryptionKey(bytes.Repeat([]byte{0x42}, 32)))
+	value := []byte("a value only the backend may hold in the clear")
+	err := b.Put(ctx, &file.Entry{Key: ".chunks/object", Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Get(ctx, ".chunks/object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := b.location(".chunks/object")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, value) {
+		t.Error("the cached copy is not encrypted")
+	}
+	data[len(data)-1] ^= 0xff
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := b.Get(ctx, ".chunks/object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || !bytes.Equal(entry.Value, value) {
+		t.Fatalf("read %v from a corrupt cached copy", entry)
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.decode(data); err != nil {
+		t.Errorf("the corrupt copy was not replaced: %v", err)
+	}
+}
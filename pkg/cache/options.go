@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"container/list"
+	"log"
+	"sync"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/palantir/stacktrace"
+)
+
+// Option - options setter method
+type Option func(*Storage)
+
+// Storage - a backend that keeps copies of the objects read from another
+// backend in a local directory. pinned objects are kept until deleted;
+// every other object is evicted least recently used first once the cache
+// grows past its capacity
+type Storage struct {
+	stateLock   sync.RWMutex
+	logOps      bool
+	initialized bool
+	// -----
+	backend       file.Backend
+	path          string
+	capacity      int64
+	pinned        []string
+	depth         int
+	encryptionKey []byte
+	cipherID      byte
+	// lruLock guards the fields below, which change on reads as well
+	lruLock  sync.Mutex
+	used     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	inflight map[string]*fetching
+	jobs     map[*prefetch]struct{}
+}
+
+// LogOps -
+func LogOps() Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.logOps = true
+	}
+}
+
+// WithBackend - sets the backend objects are read from
+func WithBackend(arg file.Backend) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.backend = arg
+	}
+}
+
+// WithPath - sets the directory cached objects are kept in
+func WithPath(arg string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.path = arg
+	}
+}
+
+// WithSizeInMegabytes - sets the capacity of the cache. pinned objects do
+// not count against it
+func WithSizeInMegabytes(arg int64) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.capacity = arg * 1 << 20
+	}
+}
+
+// WithPinned - objects with a path component equal to any of the given
+// names are never evicted. defaults to [.metadata], which pins snapshot
+// and chunk metadata
+func WithPinned(arg ...string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.pinned = append(e.pinned, arg...)
+	}
+}
+
+// WithPrefetchDepth - sets how many objects prefetching may run ahead of
+// the last object read
+func WithPrefetchDepth(arg int) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.depth = arg
+	}
+}
+
+// WithEncryption - encrypts cached objects with the same stream framing as
+// file.Storage
+func WithEncryption(arg string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		key, err := file.DeriveKey(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		e.encryptionKey = key
+	}
+}
+
+// WithEncryptionKey - encrypts cached objects with the given 256-bit key
+// as is, instead of deriving one from a string
+func WithEncryptionKey(arg []byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		if len(arg) != file.KeySize {
+			err := stacktrace.NewError("[FATAL] encryption key must be %d bytes long, got %d", file.KeySize, len(arg))
+			log.Fatal(err)
+		}
+		e.encryptionKey = arg
+	}
+}
+
+// WithCipher - sets the cipher suite cached objects are encrypted with
+func WithCipher(arg byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.cipherID = arg
+	}
+}
@@ -0,0 +1,499 @@
+package erasure
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/klauspost/reedsolomon"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+)
+
+// shard header layout :
+// [0] version | [1:9] object size | [9] data shards | [10] parity shards |
+// [11] shard index | [12:44] sha256 of the shard payload | [44:60] write id |
+// [60:92] sha256 of the object
+const (
+	shardVersion    byte = 2
+	shardHeaderSize      = 92
+	writeIDSize          = 16
+)
+
+// write - what every shard of one Put of an object records, so shards of
+// different writes of the same key are never combined. the write id
+// starts with the time of the write, so newer writes sort after older ones
+type write struct {
+	size   int
+	id     [writeIDSize]byte
+	digest [sha256.Size]byte
+}
+
+func newWrite(value []byte) (*write, error) {
+	result := &write{
+		size:   len(value),
+		digest: sha256.Sum256(value),
+	}
+	binary.BigEndian.PutUint64(result.id[:8], uint64(time.Now().UnixNano()))
+	_, err := rand.Read(result.id[8:])
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// verify rejects an object whose digest does not match the one its shards
+// recorded
+func (w *write) verify(value []byte) error {
+	sum := sha256.Sum256(value)
+	if subtle.ConstantTimeCompare(sum[:], w.digest[:]) != 1 {
+		return stacktrace.NewError("object checksum mismatch")
+	}
+	return nil
+}
+
+// Report - outcome of a scrub
+type Report struct {
+	// Checked is the number of objects whose shards were verified
+	Checked int
+	// Repaired lists objects that had missing or corrupt shards rebuilt
+	Repaired []string
+	// Unrecoverable lists objects with fewer healthy shards than data
+	// shards
+	Unrecoverable []string
+}
+
+// New - constructs a new erasure coded Storage
+func New(opts ...Option) *Storage {
+	result := &Storage{}
+	for _, opt := range opts {
+		opt(result)
+	}
+	if result.parityShards == 0 {
+		result.parityShards = 1
+	}
+	if result.writeQuorum < 1 || result.writeQuorum > len(result.shards) {
+		result.writeQuorum = len(result.shards)
+	}
+	return result
+}
+
+// Init - initializes every shard backend and the Reed-Solomon encoder
+func (b *Storage) Init() error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if b.initialized {
+		return nil
+	}
+	dataShards := len(b.shards) - b.parityShards
+	if dataShards < 1 {
+		err := stacktrace.NewError("[FATAL] Erasure Storage : (%d) shard backends cannot hold (%d) parity shards and at least one data shard", len(b.shards), b.parityShards)
+		return err
+	}
+	if b.writeQuorum < dataShards {
+		err := stacktrace.NewError("[FATAL] Erasure Storage : a write quorum of (%d) shards cannot be read back, at least (%d) data shards are needed", b.writeQuorum, dataShards)
+		return err
+	}
+	encoder, err := reedsolomon.New(dataShards, b.parityShards)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[FATAL] Erasure Storage : could not create encoder")
+		return err
+	}
+	b.encoder = encoder
+	healthy := 0
+	for i, shard := range b.shards {
+		err := shard.Init()
+		if err != nil {
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Erasure Storage: shard backend #%d failed to initialize: %v", i, err))
+			}
+			continue
+		}
+		healthy++
+	}
+	if healthy < dataShards {
+		err := stacktrace.NewError("[FATAL] Erasure Storage : only (%d) shard backends are healthy, (%d) are needed to read data", healthy, dataShards)
+		return err
+	}
+	b.initialized = true
+	return nil
+}
+
+// Put - encodes entry into shards and stores each on its backend
+func (b *Storage) Put(ctx context.Context, entry *file.Entry) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Erasure Storage :was not initialized")
+		return err
+	}
+	w, err := newWrite(entry.Value)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Erasure Storage: Put operation error. could not generate a write id for (%s)", entry.Key)
+		return err
+	}
+	shards, err := b.encode(entry.Value)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Erasure Storage: Put operation error. could not encode (%s)", entry.Key)
+		return err
+	}
+	errs := b.fanOut(func(i int, shard file.Backend) error {
+		return shard.Put(ctx, &file.Entry{
+			Key:   entry.Key,
+			Value: b.frame(shards[i], w, i),
+		})
+	})
+	return b.quorum("Put", entry.Key, errs)
+}
+
+// Get - reads the shards of k, reconstructing the object when up to the
+// number of parity shards are missing, fail their checksum or belong to
+// another write of k
+func (b *Storage) Get(ctx context.Context, k string) (*file.Entry, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Erasure Storage :was not initialized")
+		return nil, err
+	}
+	shards, w, present, err := b.readShards(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if present == 0 {
+		return nil, nil
+	}
+	size := w.size
+	if size == 0 {
+		// empty objects are stored as header only shards
+		return &file.Entry{Key: k, Value: make([]byte, 0)}, nil
+	}
+	err = b.encoder.ReconstructData(shards)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Erasure Storage: Get operation error. could not reconstruct (%s)", k)
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	err = b.encoder.Join(buf, shards, size)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Erasure Storage: Get operation error. could not join shards of (%s)", k)
+		return nil, err
+	}
+	err = w.verify(buf.Bytes())
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Erasure Storage: Get operation error. shards of (%s) do not add up to the object written", k)
+		return nil, err
+	}
+	return &file.Entry{
+		Key:   k,
+		Value: buf.Bytes(),
+	}, nil
+}
+
+// GetRange - reads length bytes of k, starting at offset. shards are
+// checked against the write they belong to as a whole, so the object is
+// read and verified like Get does and the range is cut out of it
+func (b *Storage) GetRange(ctx context.Context, k string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		err := stacktrace.NewError("[ERROR] Erasure Storage: GetRange operation error. invalid range (%d,%d) for key (%s)", offset, length, k)
+		return nil, err
+	}
+	entry, err := b.Get(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || int64(len(entry.Value)) < offset+length {
+		err = stacktrace.NewError("[ERROR] Erasure Storage: GetRange operation error. range (%d,%d) is out of bounds for key (%s)", offset, length, k)
+		return nil, err
+	}
+	return entry.Value[offset : offset+length], nil
+}
+
+// Delete - deletes every shard of k
+func (b *Storage) Delete(ctx context.Context, k string) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Erasure Storage :was not initialized")
+		return err
+	}
+	errs := b.fanOut(func(i int, shard file.Backend) error {
+		return shard.Delete(ctx, k)
+	})
+	return b.quorum("Delete", k, errs)
+}
+
+// List - merges the listings of every shard backend
+func (b *Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Erasure Storage :was not initialized")
+		return nil, err
+	}
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	failed := 0
+	var lastErr error
+	for _, shard := range b.shards {
+		out, err := shard.List(ctx, prefix)
+		if err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		for _, name := range out {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	if failed > b.parityShards {
+		err := stacktrace.Propagate(lastErr, "[ERROR] Erasure Storage: List operation error. (%d) shard backends could not be listed", failed)
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Scrub - verifies the shards of every object under prefix and rebuilds
+// the ones that are missing, fail their checksum or belong to another
+// write of the object
+func (b *Storage) Scrub(ctx context.Context, prefix string) (*Report, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Erasure Storage :was not initialized")
+		return nil, err
+	}
+	result := &Report{
+		Repaired:      make([]string, 0),
+		Unrecoverable: make([]string, 0),
+	}
+	err := file.WalkKeys(ctx, b, prefix, func(key string) error {
+		result.Checked++
+		shards, w, _, err := b.readShards(ctx, key)
+		if err == nil && w.size != 0 {
+			err = b.verify(shards, w)
+		}
+		if err != nil {
+			result.Unrecoverable = append(result.Unrecoverable, key)
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Erasure Storage: (%s) cannot be recovered: %v", key, err))
+			}
+			return nil
+		}
+		damaged := make([]int, 0)
+		for i, shard := range shards {
+			if shard == nil {
+				damaged = append(damaged, i)
+			}
+		}
+		if len(damaged) == 0 {
+			return nil
+		}
+		if w.size != 0 {
+			err = b.encoder.Reconstruct(shards)
+			if err != nil {
+				result.Unrecoverable = append(result.Unrecoverable, key)
+				return nil
+			}
+		}
+		for _, i := range damaged {
+			err = b.shards[i].Put(ctx, &file.Entry{
+				Key:   key,
+				Value: b.frame(shards[i], w, i),
+			})
+			if err != nil {
+				err = stacktrace.Propagate(err, "[ERROR] Erasure Storage: Scrub operation could not rebuild shard #%d of (%s)", i, key)
+				return err
+			}
+		}
+		if b.logOps {
+			colorstring.Println(fmt.Sprintf("[yellow][INFO] Erasure Storage: rebuilt (%d) shards of (%s)", len(damaged), key))
+		}
+		result.Repaired = append(result.Repaired, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// encode splits value into data shards and computes the parity shards
+func (b *Storage) encode(value []byte) ([][]byte, error) {
+	if len(value) == 0 {
+		return make([][]byte, len(b.shards)), nil
+	}
+	shards, err := b.encoder.Split(value)
+	if err != nil {
+		return nil, err
+	}
+	err = b.encoder.Encode(shards)
+	if err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// frame prepends the shard header to payload
+func (b *Storage) frame(payload []byte, w *write, index int) []byte {
+	result := make([]byte, shardHeaderSize+len(payload))
+	result[0] = shardVersion
+	binary.LittleEndian.PutUint64(result[1:9], uint64(w.size))
+	result[9] = byte(len(b.shards) - b.parityShards)
+	result[10] = byte(b.parityShards)
+	result[11] = byte(index)
+	sum := sha256.Sum256(payload)
+	copy(result[12:44], sum[:])
+	copy(result[44:60], w.id[:])
+	copy(result[60:shardHeaderSize], w.digest[:])
+	copy(result[shardHeaderSize:], payload)
+	return result
+}
+
+// unframe validates the header of a stored shard and returns its payload
+// and the write it belongs to
+func (b *Storage) unframe(value []byte, index int) ([]byte, *write, error) {
+	if len(value) < shardHeaderSize || value[0] != shardVersion {
+		return nil, nil, stacktrace.NewError("shard header is malformed")
+	}
+	if int(value[9]) != len(b.shards)-b.parityShards || int(value[10]) != b.parityShards || int(value[11]) != index {
+		return nil, nil, stacktrace.NewError("shard #%d of a %d+%d layout does not belong to this %d+%d layout", value[11], value[9], value[10], len(b.shards)-b.parityShards, b.parityShards)
+	}
+	payload := value[shardHeaderSize:]
+	sum := sha256.Sum256(payload)
+	if subtle.ConstantTimeCompare(sum[:], value[12:44]) != 1 {
+		return nil, nil, stacktrace.NewError("shard checksum mismatch")
+	}
+	w := &write{size: int(binary.LittleEndian.Uint64(value[1:9]))}
+	copy(w.id[:], value[44:60])
+	copy(w.digest[:], value[60:shardHeaderSize])
+	return payload, w, nil
+}
+
+// verify reconstructs the object shards hold, without altering them, and
+// checks it against the digest w recorded
+func (b *Storage) verify(shards [][]byte, w *write) error {
+	copies := make([][]byte, len(shards))
+	copy(copies, shards)
+	err := b.encoder.ReconstructData(copies)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, w.size))
+	err = b.encoder.Join(buf, copies, w.size)
+	if err != nil {
+		return err
+	}
+	return w.verify(buf.Bytes())
+}
+
+// readShards reads every shard of key. missing and corrupt shards, and
+// shards of another write of key, are left nil. of the writes enough
+// shards are left of to read the object, the newest is picked. present
+// counts shards found on their backend, healthy or not
+func (b *Storage) readShards(ctx context.Context, key string) ([][]byte, *write, int, error) {
+	shards := make([][]byte, len(b.shards))
+	writes := make([]*write, len(b.shards))
+	found := make([]bool, len(b.shards))
+	b.fanOut(func(i int, shard file.Backend) error {
+		entry, err := shard.Get(ctx, key)
+		if err != nil || entry == nil {
+			return err
+		}
+		found[i] = true
+		payload, w, err := b.unframe(entry.Value, i)
+		if err != nil {
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Erasure Storage: shard #%d of (%s) is corrupt: %v", i, key, err))
+			}
+			return err
+		}
+		shards[i] = payload
+		writes[i] = w
+		return nil
+	})
+	present := 0
+	counts := make(map[write]int)
+	for i := range shards {
+		if found[i] {
+			present++
+		}
+		if shards[i] != nil {
+			counts[*writes[i]]++
+		}
+	}
+	if present == 0 {
+		return shards, &write{}, 0, nil
+	}
+	dataShards := len(b.shards) - b.parityShards
+	var picked *write
+	healthy := 0
+	for w, count := range counts {
+		if count > healthy {
+			healthy = count
+		}
+		if count < dataShards {
+			continue
+		}
+		if picked == nil || bytes.Compare(w.id[:], picked.id[:]) > 0 {
+			w := w
+			picked = &w
+		}
+	}
+	if picked == nil {
+		err := stacktrace.NewError("[ERROR] Erasure Storage: only (%d) healthy shards of one write of (%s) are left, (%d) are needed", healthy, key, dataShards)
+		return nil, nil, present, err
+	}
+	// shards of different writes of the same key cannot be combined
+	for i := range shards {
+		if shards[i] != nil && *writes[i] != *picked {
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Erasure Storage: shard #%d of (%s) belongs to another write", i, key))
+			}
+			shards[i] = nil
+		}
+	}
+	return shards, picked, present, nil
+}
+
+// fanOut runs op against every shard backend concurrently and returns the
+// error of each
+func (b *Storage) fanOut(op func(int, file.Backend) error) []error {
+	errs := make([]error, len(b.shards))
+	var wg sync.WaitGroup
+	for i, shard := range b.shards {
+		wg.Add(1)
+		go func(i int, shard file.Backend) {
+			defer wg.Done()
+			errs[i] = op(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (b *Storage) quorum(op, key string, errs []error) error {
+	acks := 0
+	var lastErr error
+	for i, err := range errs {
+		if err != nil {
+			lastErr = err
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Erasure Storage: %s operation of (%s) failed on shard backend #%d: %v", op, key, i, err))
+			}
+			continue
+		}
+		acks++
+	}
+	if acks < b.writeQuorum {
+		err := stacktrace.Propagate(lastErr, "[ERROR] Erasure Storage: %s operation error. only (%d) shard backends acknowledged (%s), write quorum is (%d)", op, acks, key, b.writeQuorum)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package erasure
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+func newShards(t *testing.T, count int) []file.Backend {
+	t.Helper()
+	result := make([]file.Backend, count)
+	for i := range result {
+		path, err := ioutil.TempDir("", "erasure")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(path) })
+		result[i] = file.New(file.WithPath(path))
+	}
+	return result
+}
+
+func newTestStorage(t *testing.T, shards []file.Backend, opts ...Option) *Storage {
+	t.Helper()
+	b := New(append([]Option{WithShards(shards...), WithParityShards(1)}, opts...)...)
+	err := b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWriteQuorum(t *testing.T) {
+	cases := []struct {
+		quorum int
+		valid  bool
+	}{
+		{quorum: 0, valid: true},
+		{quorum: 1, valid: false},
+		{quorum: 2, valid: false},
+		{quorum: 3, valid: true},
+		{quorum: 4, valid: true},
+	}
+	for _, c := range cases {
+		b := New(WithShards(newShards(t, 4)...), WithParityShards(1), WithWriteQuorum(c.quorum))
+		err := b.Init()
+		if c.valid && err != nil {
+			t.Errorf("quorum %d: %v", c.quorum, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("quorum %d below the data shard count was accepted", c.quorum)
+		}
+	}
+}
+
+func TestReconstruct(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(t, 4)
+	b := newTestStorage(t, shards)
+	value := bytes.Repeat([]byte("erasure coded "), 100)
+	err := b.Put(ctx, &file.Entry{Key: "object", Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = shards[1].Delete(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := b.Get(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || !bytes.Equal(entry.Value, value) {
+		t.Fatal("object was not reconstructed from the remaining shards")
+	}
+	out, err := b.GetRange(ctx, "object", 14, 28)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, value[14:42]) {
+		t.Fatalf("range: got %q", out)
+	}
+	// a second missing shard is more than one parity shard can make up for
+	err = shards[2].Delete(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Get(ctx, "object")
+	if err == nil {
+		t.Fatal("object missing two of four shards was read")
+	}
+}
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(t, 4)
+	b := newTestStorage(t, shards)
+	for _, key := range []string{"healthy", "missing", "corrupt", "lost"} {
+		err := b.Put(ctx, &file.Entry{Key: key, Value: []byte("value of " + key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt := func(i int, key string) {
+		entry, err := shards[i].Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Value[len(entry.Value)-1] ^= 0xff
+		err = shards[i].Put(ctx, entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := shards[0].Delete(ctx, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(3, "corrupt")
+	corrupt(0, "lost")
+	corrupt(1, "lost")
+	report, err := b.Scrub(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 4 {
+		t.Errorf("checked %d objects, want 4", report.Checked)
+	}
+	if len(report.Repaired) != 2 || report.Repaired[0] != "corrupt" || report.Repaired[1] != "missing" {
+		t.Errorf("repaired %v, want [corrupt missing]", report.Repaired)
+	}
+	if len(report.Unrecoverable) != 1 || report.Unrecoverable[0] != "lost" {
+		t.Errorf("unrecoverable %v, want [lost]", report.Unrecoverable)
+	}
+	// rebuilt shards let the objects lose another shard
+	for _, key := range []string{"missing", "corrupt"} {
+		err = shards[2].Delete(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := b.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || string(entry.Value) != "value of "+key {
+			t.Errorf("%s was not rebuilt", key)
+		}
+	}
+}
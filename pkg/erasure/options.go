@@ -0,0 +1,64 @@
+package erasure
+
+import (
+	"sync"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/klauspost/reedsolomon"
+)
+
+// Option - options setter method
+type Option func(*Storage)
+
+// Storage - a backend that splits every object into data and parity shards
+// with Reed-Solomon coding, storing each shard on a different backend
+type Storage struct {
+	stateLock   sync.RWMutex
+	logOps      bool
+	initialized bool
+	// -----
+	shards       []file.Backend
+	parityShards int
+	writeQuorum  int
+	encoder      reedsolomon.Encoder
+}
+
+// LogOps -
+func LogOps() Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.logOps = true
+	}
+}
+
+// WithShards - appends the backends shards are stored on, one shard per
+// backend. the first ones hold data shards, the rest hold parity shards
+func WithShards(arg ...file.Backend) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.shards = append(e.shards, arg...)
+	}
+}
+
+// WithParityShards - number of shards that can be lost without losing
+// data. defaults to 1
+func WithParityShards(arg int) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.parityShards = arg
+	}
+}
+
+// WithWriteQuorum - number of shards that must be stored for a write to
+// succeed. it cannot be lower than the number of data shards, since fewer
+// shards cannot be read back. defaults to all shards
+func WithWriteQuorum(arg int) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.writeQuorum = arg
+	}
+}
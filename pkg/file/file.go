@@ -26,8 +26,10 @@ func New(opts ...Option) *Storage {
 		opt(result)
 	}
 	result.permitPool = permitpool.New(
-		permitpool.WithPermits(1),
+		permitpool.WithPermits(result.numberOfThreads),
 	)
+	result.uploadLimiter = newRateLimiter(result.uploadRateLimit)
+	result.downloadLimiter = newRateLimiter(result.downloadRateLimit)
 	return result
 }
 
@@ -62,6 +64,12 @@ func (b *Storage) Init() error {
 				return
 			}
 		}
+		// writes interrupted by a crash leave their temporary files behind
+		err = b.removeTempFiles()
+		if err != nil {
+			errCh <- err
+			return
+		}
 		errCh <- nil
 		return
 	})
@@ -87,8 +95,26 @@ func (b *Storage) Init() error {
 	}
 }
 
-// Put -
+// Path - returns the directory data is stored in
+func (b *Storage) Path() string {
+	return b.path
+}
+
+// Put - stores entry, and sets its ETag, Size and ModTime to those of the
+// stored object
 func (b *Storage) Put(ctx context.Context, entry *Entry) error {
+	return b.put(ctx, entry, nil, true)
+}
+
+// PutUnversioned - stores entry like Put, but never keeps the object it
+// replaces as a prior version
+func (b *Storage) PutUnversioned(ctx context.Context, entry *Entry) error {
+	return b.put(ctx, entry, nil, false)
+}
+
+// put stores entry once cond, when given, holds for the object it
+// replaces, which is archived when versioned is set
+func (b *Storage) put(ctx context.Context, entry *Entry, cond func(current *Entry) bool, versioned bool) error {
 	var err error
 	if !b.initialized {
 		err = stacktrace.NewError("[ERROR] Storage :was not initialized")
@@ -97,8 +123,11 @@ func (b *Storage) Put(ctx context.Context, entry *Entry) error {
 	b.permitPool.Acquire()
 	defer b.permitPool.Release()
 
-	b.stateLock.Lock()
-	defer b.stateLock.Unlock()
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(entry.Key)
+	lock.Lock()
+	defer lock.Unlock()
 	if b.logOps {
 		start := time.Now()
 		defer func() {
@@ -108,9 +137,16 @@ func (b *Storage) Put(ctx context.Context, entry *Entry) error {
 
 	}
 
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 	go func() {
-		errCh <- b.PutInternal(ctx, entry)
+		if cond != nil {
+			err := b.check(ctx, entry.Key, cond)
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- b.putInternal(ctx, entry, versioned)
 	}()
 	for {
 		select {
@@ -144,6 +180,9 @@ func (b *Storage) Get(ctx context.Context, k string) (*Entry, error) {
 
 	b.stateLock.RLock()
 	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(k)
+	lock.RLock()
+	defer lock.RUnlock()
 	if b.logOps {
 		start := time.Now()
 		defer func() {
@@ -151,13 +190,18 @@ func (b *Storage) Get(ctx context.Context, k string) (*Entry, error) {
 			colorstring.Println(duration)
 		}()
 	}
-	errCh := make(chan error)
-	entryCh := make(chan *Entry)
+	errCh := make(chan error, 1)
+	entryCh := make(chan *Entry, 1)
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		entry, err := b.GetInternal(ctx, k)
+		if err != nil {
+			errCh <- err
+			return
+		}
 		entryCh <- entry
-		errCh <- err
 	}()
 	for {
 		select {
@@ -178,22 +222,89 @@ func (b *Storage) Get(ctx context.Context, k string) (*Entry, error) {
 			}
 
 		case <-ctx.Done():
+			b.drain(done)
 			err := stacktrace.Propagate(ctx.Err(), "[FATAL] Storage: Get operation error ")
 			return nil, err
 		}
 	}
 }
 
+// GetRange - returns length bytes of the object stored at k, starting at
+// offset
+func (b *Storage) GetRange(ctx context.Context, k string, offset, length int64) ([]byte, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Storage :was not initialized")
+		return nil, err
+	}
+	b.permitPool.Acquire()
+	defer b.permitPool.Release()
+
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	if b.logOps {
+		start := time.Now()
+		defer func() {
+			duration := fmt.Sprintf("[bold][yellow][INFO] Storage: GetRange operation took (%v) to complete", time.Now().Sub(start))
+			colorstring.Println(duration)
+		}()
+	}
+	errCh := make(chan error, 1)
+	outCh := make(chan []byte, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		out, err := b.GetRangeInternal(ctx, k, offset, length)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		outCh <- out
+	}()
+	for {
+		select {
+		case out := <-outCh:
+			{
+				return out, nil
+			}
+		case logs := <-b.logCh:
+			{
+				if b.logOps {
+					colorstring.Println(logs)
+				}
+			}
+		case err := <-errCh:
+			{
+				return nil, err
+			}
+		case <-ctx.Done():
+			b.drain(done)
+			err := stacktrace.Propagate(ctx.Err(), "[FATAL] Storage: GetRange operation error ")
+			return nil, err
+		}
+	}
+}
+
 // Delete -
 func (b *Storage) Delete(ctx context.Context, path string) error {
+	return b.delete(ctx, path, nil)
+}
+
+// delete removes the object at path once cond, when given, holds for it
+func (b *Storage) delete(ctx context.Context, path string, cond func(current *Entry) bool) error {
 	if !b.initialized {
 		err := stacktrace.NewError("[ERROR] Storage :was not initialized")
 		return err
 	}
 	b.permitPool.Acquire()
 	defer b.permitPool.Release()
-	b.stateLock.Lock()
-	defer b.stateLock.Unlock()
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(path)
+	lock.Lock()
+	defer lock.Unlock()
 	if b.logOps {
 		start := time.Now()
 		defer func() {
@@ -201,8 +312,17 @@ func (b *Storage) Delete(ctx context.Context, path string) error {
 			log.Println(duration)
 		}()
 	}
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+		if cond != nil {
+			err := b.check(ctx, path, cond)
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
 		errCh <- b.DeleteInternal(ctx, path)
 	}()
 
@@ -223,7 +343,7 @@ func (b *Storage) Delete(ctx context.Context, path string) error {
 			}
 		case <-ctx.Done():
 			{
-
+				b.drain(done)
 				return stacktrace.NewError("[ERROR] Storage: Delete operation timeout ")
 			}
 		}
@@ -250,12 +370,17 @@ func (b *Storage) List(ctx context.Context, prefix string) ([]string, error) {
 			log.Println(duration)
 		}()
 	}
-	outCh := make(chan []string)
-	errCh := make(chan error)
+	outCh := make(chan []string, 1)
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		out, err := b.ListInternal(ctx, prefix)
+		if err != nil {
+			errCh <- err
+			return
+		}
 		outCh <- out
-		errCh <- err
 	}()
 	for {
 		select {
@@ -275,8 +400,26 @@ func (b *Storage) List(ctx context.Context, prefix string) ([]string, error) {
 				}
 			}
 		case <-ctx.Done():
+			b.drain(done)
 			err := stacktrace.NewError("[ERROR] Storage: List operation timeout")
 			return nil, err
 		}
 	}
 }
+
+// drain prints the logs of an operation whose caller gave up on it until
+// done is closed. the operation keeps running until it notices the
+// cancellation, and must neither block on logCh nor run after the locks
+// guarding it are released
+func (b *Storage) drain(done <-chan struct{}) {
+	for {
+		select {
+		case logs := <-b.logCh:
+			if b.logOps {
+				colorstring.Println(logs)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+// newTestStorage returns an initialized Storage in a temporary directory,
+// unless opts give it another path
+func newTestStorage(t *testing.T, opts ...Option) *Storage {
+	t.Helper()
+	path, err := ioutil.TempDir("", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	b := New(append([]Option{WithPath(path)}, opts...)...)
+	err = b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// operations given up on by their caller must not leave their worker
+// behind, blocked on logs nobody reads
+func TestCancelledOperations(t *testing.T) {
+	b := newTestStorage(t)
+	err := b.Put(context.Background(), &Entry{Key: "object", Value: []byte("value")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 16; i++ {
+		b.Get(cancelled, "object")
+		b.GetRange(cancelled, "object", 0, 1)
+		b.Stat(cancelled, "object")
+		b.List(cancelled, "")
+		b.ListVersions(cancelled, "object")
+	}
+	// workers close their done channel right before they exit
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Fatalf("%d workers outlived their cancelled operation", n-baseline)
+	}
+	// a leaked worker would hold on to its lock and keep this from running
+	err = b.Put(context.Background(), &Entry{Key: "object", Value: []byte("other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
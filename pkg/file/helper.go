@@ -1,112 +1,62 @@
 package file
 
 import (
-	"encoding/binary"
-
-	"github.com/palantir/stacktrace"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/stream"
 )
 
+// the encrypted stream format is implemented by the stream package. its
+// names are kept here for backends built on Storage
+
 // Errors
 var (
 	// ErrInvalidPayloadSize ...
-	ErrInvalidPayloadSize = stacktrace.NewError("invalid payload size")
+	ErrInvalidPayloadSize = stream.ErrInvalidPayloadSize
 	// ErrAuthentication ...
-	ErrAuthentication = stacktrace.NewError("authentication failed")
+	ErrAuthentication = stream.ErrAuthentication
 	// ErrLargerSizeThanExpected ...
-	ErrLargerSizeThanExpected = stacktrace.NewError("data size is too large")
+	ErrLargerSizeThanExpected = stream.ErrLargerSizeThanExpected
 	// ErrNonceMismatch ...
-	ErrNonceMismatch = stacktrace.NewError("header nonce mismatch")
+	ErrNonceMismatch = stream.ErrNonceMismatch
 	// ErrUnexpectedEOF ...
-	ErrUnexpectedEOF = stacktrace.NewError("unexpected end of file (EOF)")
+	ErrUnexpectedEOF = stream.ErrUnexpectedEOF
 	// ErrUnexpectedData ...
-	ErrUnexpectedData = stacktrace.NewError("unexpected data after final burst of data")
+	ErrUnexpectedData = stream.ErrUnexpectedData
 	// ErrInvalidDecryptedSize ...
-	ErrInvalidDecryptedSize = stacktrace.NewError("size is not valid")
+	ErrInvalidDecryptedSize = stream.ErrInvalidDecryptedSize
+	// ErrUnknownCipher ...
+	ErrUnknownCipher = stream.ErrUnknownCipher
+	// ErrCipherMismatch ...
+	ErrCipherMismatch = stream.ErrCipherMismatch
 )
 
 // Consts
 const (
 	// AES256GCM ...
-	AES256GCM byte = iota
+	AES256GCM = stream.AES256GCM
+	// XChaCha20Poly1305 ...
+	XChaCha20Poly1305 = stream.XChaCha20Poly1305
 	// TagSize ...
-	TagSize = 16
+	TagSize = stream.TagSize
 	// HeaderSize ...
-	HeaderSize = 16
-	// GCM standard nounce size
-	StandardNonceSize = 12
-	// 1000 0000
-	HeaderFinalFlag = 0x80
+	HeaderSize = stream.HeaderSize
+	// StandardNonceSize ...
+	StandardNonceSize = stream.StandardNonceSize
+	// HeaderFinalFlag ...
+	HeaderFinalFlag = stream.HeaderFinalFlag
 	// KeySize ...
-	KeySize = 32
+	KeySize = stream.KeySize
 	// MaxPayloadSize ...
-	MaxPayloadSize = 1 << 16
+	MaxPayloadSize = stream.MaxPayloadSize
 	// MaxBufferSize ...
-	MaxBufferSize = HeaderSize + MaxPayloadSize + TagSize
+	MaxBufferSize = stream.MaxBufferSize
 	// MaxDecryptedSize ...
-	MaxDecryptedSize = 1 << 48
+	MaxDecryptedSize = stream.MaxDecryptedSize
 	// MaxEncryptedSize ...
-	MaxEncryptedSize = MaxDecryptedSize + ((HeaderSize + TagSize) * 1 << 32)
+	MaxEncryptedSize = stream.MaxEncryptedSize
 )
 
 // Buffer ...
-type Buffer []byte
-
-// Header ...
-func (b Buffer) Header() Header {
-	return Header(b[:HeaderSize])
-}
-
-// Data ...
-func (b Buffer) Data() []byte {
-	return b[HeaderSize : HeaderSize+b.Header().GetLength()]
-}
-
-// Ciphertext ...
-func (b Buffer) Ciphertext() []byte {
-	return b[HeaderSize:b.GetLength()]
-}
-
-// GetLength ...
-func (b Buffer) GetLength() int {
-	return HeaderSize + TagSize + b.Header().GetLength()
-}
+type Buffer = stream.Buffer
 
 // Header ...
-type Header []byte
-
-// GetLength ...
-func (h Header) GetLength() int {
-	return int(binary.LittleEndian.Uint32(h[0:HeaderSize-StandardNonceSize])) + 1
-}
-
-// SetLength ...
-func (h Header) SetLength(length int) {
-	binary.LittleEndian.PutUint32(h[0:HeaderSize-StandardNonceSize], uint32(length-1))
-}
-
-// IsFinal ...
-func (h Header) IsFinal() bool {
-	return h[HeaderSize-StandardNonceSize]&HeaderFinalFlag == HeaderFinalFlag
-}
-
-// Nonce ...
-func (h Header) Nonce() []byte {
-	return h[HeaderSize-StandardNonceSize : HeaderSize]
-}
-
-// AddData ...
-func (h Header) AddData() []byte {
-	return h[:HeaderSize-StandardNonceSize]
-}
-
-// SetRand ...
-func (h Header) SetRand(randVal []byte, final bool) {
-	copy(h[HeaderSize-StandardNonceSize:], randVal)
-	if final {
-		//  h[HeaderSize - StandardNonceSize] | 1000 0000
-		h[HeaderSize-StandardNonceSize] |= HeaderFinalFlag
-	} else {
-		//  h[HeaderSize - StandardNonceSize] | 0111 1111
-		h[HeaderSize-StandardNonceSize] &= 0x7F
-	}
-}
+type Header = stream.Header
@@ -1,15 +1,95 @@
 package file
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/hex"
+	"time"
 )
 
+// Backend is the interface every physical storage backend implements.
+// Storage is the reference implementation; composite backends wrap one or
+// more Backends and expose the same interface.
+type Backend interface {
+	Init() error
+	Put(ctx context.Context, entry *Entry) error
+	Get(ctx context.Context, key string) (*Entry, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Batcher is implemented by backends that can commit a group of entries
+// atomically, in a single transaction.
+type Batcher interface {
+	Batch(ctx context.Context, entries []*Entry) error
+}
+
+// Flusher is implemented by backends that buffer writes. Flush returns
+// once everything written so far is stored durably.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// RangeReader is implemented by backends that can read part of an object
+// without fetching all of it.
+type RangeReader interface {
+	GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error)
+}
+
+// Prefetcher is implemented by backends that can fetch objects ahead of
+// time. keys are given in the order they are going to be read in; fetching
+// stops once ctx is done.
+type Prefetcher interface {
+	Prefetch(ctx context.Context, keys []string)
+}
+
+// Walker is implemented by backends that can list every object under a
+// prefix in one call. objects are visited in key order, starting after the
+// key startAfter; fn returning an error stops the walk.
+type Walker interface {
+	Walk(ctx context.Context, prefix, startAfter string, fn func(info *ObjectInfo) error) error
+}
+
+// Versioner is implemented by backends that keep the prior versions of
+// objects that are overwritten or deleted.
+type Versioner interface {
+	ListVersions(ctx context.Context, key string) ([]*Version, error)
+	PurgeVersions(ctx context.Context, prefix string, policy PurgePolicy) (int, error)
+	// PutUnversioned stores entry without keeping the object it replaces
+	PutUnversioned(ctx context.Context, entry *Entry) error
+}
+
+// ObjectInfo describes an object listed by a Walker
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// ConditionalWriter is implemented by backends that can put and delete
+// objects on condition of what is stored, so concurrent writers can compare
+// and swap instead of overwriting each other. operations whose condition
+// does not hold fail with ErrPreconditionFailed.
+type ConditionalWriter interface {
+	Stat(ctx context.Context, key string) (*Entry, error)
+	PutIfAbsent(ctx context.Context, entry *Entry) error
+	PutIfMatch(ctx context.Context, entry *Entry, etag string) error
+	DeleteIfMatch(ctx context.Context, key string, etag string) error
+}
+
 // Entry is used to represent data stored by the physical Storage
 type Entry struct {
 	Key   string
 	Value []byte
+	// ETag is the MD5 checksum of Value, in hex. it, Size and ModTime are
+	// set by the backend on Put and Get
+	ETag    string
+	Size    int64
+	ModTime time.Time
+	// Metadata is stored along with Value. see MetadataContentType,
+	// MetadataCodec and MetadataKeyID for well known keys
+	Metadata map[string]string
 }
 
 // MD5CurrentHexString -
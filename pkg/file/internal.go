@@ -3,8 +3,11 @@ package file
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -12,13 +15,24 @@ import (
 
 	// "github.com/damoonazarpazhooh/File-Ingestion/pkg/iosecure/decryptor"
 
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/stream"
 	utils "github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
 
 	"github.com/palantir/stacktrace"
 )
 
+// tempPrefix starts the names of the temporary files objects are written
+// to before they are renamed into place
+const tempPrefix = ".splitter-tmp-"
+
 // PutInternal -
 func (b *Storage) PutInternal(ctx context.Context, entry *Entry) error {
+	return b.putInternal(ctx, entry, true)
+}
+
+// putInternal stores entry, archiving the object it replaces when
+// versioned is set
+func (b *Storage) putInternal(ctx context.Context, entry *Entry, versioned bool) error {
 	var err error
 	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Put operation.starting to validate entry key (%s)", entry.Key)
 	err = b.validatePath(entry.Key)
@@ -27,6 +41,9 @@ func (b *Storage) PutInternal(ctx context.Context, entry *Entry) error {
 		return err
 	}
 	path, key := b.expandPath(entry.Key)
+	// the parent tree must outlive the write
+	b.treeLock.RLock()
+	defer b.treeLock.RUnlock()
 	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Put operation.making parent tree at (%s)", path)
 	err = os.MkdirAll(path, 0700)
 	if err != nil {
@@ -34,33 +51,65 @@ func (b *Storage) PutInternal(ctx context.Context, entry *Entry) error {
 		return err
 	}
 	fullPath := utils.PathJoin(path, key)
-	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Put operation. creating empty file for the stream at (%s)", fullPath)
-	f, err := os.OpenFile(
-		fullPath,
-		os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
-		0600)
-	if err != nil {
-		if f != nil {
-			f.Close()
+	entry.ETag = entry.MD5CurrentHexString()
+	entry.Size = int64(len(entry.Value))
+	// the object being replaced is archived before the new one is written,
+	// so versions are archived before the objects replacing them were
+	// modified
+	if versioned {
+		err = b.archive(entry.Key, entry.ETag)
+		if err != nil {
+			return err
 		}
-		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. Could not create empty file at (%s) ", fullPath)
-		return err
 	}
-	if f == nil {
-		err = stacktrace.NewError("[ERROR] Storage: Put operation could not successfully get a file handle ")
+	// the object is written to a temporary file next to it and renamed
+	// into place once durable, so a crash never leaves a partial object
+	// at the real key
+	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Put operation. creating temporary file for the stream in (%s)", path)
+	f, err := ioutil.TempFile(path, tempPrefix)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. Could not create temporary file in (%s) ", path)
 		return err
 	}
-	defer f.Close()
+	tempPath := f.Name()
+	committed := false
+	defer func() {
+		f.Close()
+		if !committed {
+			os.Remove(tempPath)
+		}
+	}()
 	reader := bytes.NewBuffer(entry.Value)
 	var length int64
-	// reader := ratelimitedreader.New(entry.Value, b.uploadRateLimit/b.numberOfThreads)
-	if b.encryptionKey != nil {
-
-		encReader, err := b.newEncryptor(reader)
+	// the leading bytes of the file, or its checksum, bind the sidecar to
+	// it
+	stored := md5.New()
+	header := &leadingBytes{n: headerSize}
+	w := &rateLimitedWriter{ctx: ctx, w: io.MultiWriter(f, stored, header), limiter: b.uploadLimiter}
+	value := entry.Value
+	opts := []stream.Option{stream.WithCipher(b.cipherID)}
+	if b.padding != nil && !b.isPlaintext(entry.Key) && (len(b.recipients) != 0 || b.encryptionKey != nil) {
+		value = Pad(b.padding, value)
+		reader = bytes.NewBuffer(value)
+		opts = append(opts, stream.WithPadded())
+	}
+	if len(b.recipients) != 0 && !b.isPlaintext(entry.Key) {
+		var sealed []byte
+		sealed, err = sealToRecipients(b.recipients, value, opts...)
+		if err != nil {
+			return err
+		}
+		length, err = io.Copy(w, bytes.NewReader(sealed))
+		if err != nil {
+			return err
+		}
+	} else if encryptionKey := b.keyFor(entry.Key); encryptionKey != nil {
+		var encReader io.Reader
+		encReader, err = stream.NewEncryptReader(reader, encryptionKey, append(opts, stream.WithConcurrency(b.cryptoWorkers))...)
 		if err != nil {
 			return err
 		}
-		length, err = io.CopyBuffer(f, encReader, make([]byte, HeaderSize+MaxPayloadSize+TagSize))
+		length, err = io.CopyBuffer(w, encReader, make([]byte, HeaderSize+MaxPayloadSize+TagSize))
 
 		// 	length, err = iosecure.EncryptIO(
 		// 		f,
@@ -68,28 +117,60 @@ func (b *Storage) PutInternal(ctx context.Context, entry *Entry) error {
 		// 		encryptor.WithKey(b.encryptionKey),
 		// 	)
 	} else {
-		length, err = io.Copy(f, reader)
+		length, err = io.Copy(w, reader)
 		if err != nil {
 			return err
 		}
 	}
-	err = f.Sync()
 	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. could not write to temporary file at (%s)", tempPath)
 		return err
 	}
-	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Put operation.IO Buffer copied (%s) bytes to file at (%s)", utils.PrettyPrintSize(length), path)
-	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Put operation. stating file at (%s) for confirmation", path)
-	fi, err := os.Stat(fullPath)
+	err = f.Sync()
 	if err != nil {
-		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. could not stat file at (%s) after writing to it", path)
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. could not sync temporary file at (%s)", tempPath)
 		return err
 	}
-	if fi == nil {
-		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. target file for storing bytes at path (%s) was empty after writing to it", path)
+	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Put operation.IO Buffer copied (%s) bytes to file at (%s)", utils.PrettyPrintSize(length), path)
+	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Put operation. stating file at (%s) for confirmation", tempPath)
+	fi, err := f.Stat()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. could not stat file at (%s) after writing to it", tempPath)
 		return err
 	}
 	if fi.Size() == 0 {
+		// no entry is ever zero length; an empty value deletes the object
+		b.removeSidecar(entry.Key)
 		os.Remove(fullPath)
+		return nil
+	}
+	err = f.Close()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. could not close temporary file at (%s)", tempPath)
+		return err
+	}
+	err = os.Rename(tempPath, fullPath)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. could not rename (%s) to (%s)", tempPath, fullPath)
+		return err
+	}
+	committed = true
+	// the rename is only durable once the directory holding it is
+	err = syncDir(path)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Put operation error. could not sync directory (%s)", path)
+		return err
+	}
+	entry.ModTime = fi.ModTime()
+	storedETag := hex.EncodeToString(stored.Sum(nil))
+	if len(b.recipients) != 0 && !b.isPlaintext(entry.Key) {
+		// the ETag of the value would tell what it holds to anyone reading
+		// the sidecar
+		entry.ETag = storedETag
+	}
+	err = b.writeSidecar(entry, fi, header.data, storedETag)
+	if err != nil {
+		return err
 	}
 	return nil
 
@@ -98,16 +179,22 @@ func (b *Storage) PutInternal(ctx context.Context, entry *Entry) error {
 // GetInternal -
 // TODO FIX ERROR propogation
 func (b *Storage) GetInternal(ctx context.Context, key string) (*Entry, error) {
+	return b.getInternal(ctx, key, key)
+}
+
+// getInternal reads the object stored at key at, and decrypts it the way
+// objects stored at key are. at differs from key for prior versions
+func (b *Storage) getInternal(ctx context.Context, key, at string) (*Entry, error) {
 	var err error
-	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Get operation.validating key (%s) ...", key)
-	err = b.validatePath(key)
+	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Get operation.validating key (%s) ...", at)
+	err = b.validatePath(at)
 	if err != nil {
-		err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error.could not validate entry key (%s) ", key)
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error.could not validate entry key (%s) ", at)
 		return nil, err
 
 	}
 
-	path, keyExpanded := b.expandPath(key)
+	path, keyExpanded := b.expandPath(at)
 	path = filepath.Join(path, keyExpanded)
 	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Get operation.stating file at (%s)", path)
 
@@ -138,6 +225,11 @@ func (b *Storage) GetInternal(ctx context.Context, key string) (*Entry, error) {
 		err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error.could not open the file at (%s) ", path)
 		return nil, err
 	}
+	fi, err = f.Stat()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error.could not stat the file at (%s) ", path)
+		return nil, err
+	}
 	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Get operation. starting to read bytes from (%s) into memory", path)
 	buf := bytes.NewBuffer(nil)
 	// _, err = buf.ReadFrom(f)
@@ -145,34 +237,162 @@ func (b *Storage) GetInternal(ctx context.Context, key string) (*Entry, error) {
 	// 	err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error. could not read the bytes from the opeend file ")
 	// 	return nil, err
 	// }
-	_, err = io.CopyBuffer(buf, f, make([]byte, MaxPayloadSize))
+	r := &rateLimitedReader{ctx: ctx, r: f, limiter: b.downloadLimiter}
+	_, err = io.CopyBuffer(buf, r, make([]byte, MaxPayloadSize))
 	if err != nil {
 		err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error. could not decrypt and read the bytes from the opeend file ")
 		return nil, err
 	}
-	if b.encryptionKey != nil {
-		target := bytes.NewBuffer(nil)
-		decReader, err := b.newDecryptor(buf)
+	stored := buf.Bytes()
+	value := stored
+	// the stream an object is sealed in tells whether it is padded
+	padded := false
+	if IsSealed(value) && !b.isPlaintext(key) {
+		value, padded, err = openWithIdentities(b.identities, value)
 		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error. could not open the object sealed at (%s)", path)
 			return nil, err
 		}
-		_, err = io.CopyBuffer(target, decReader, make([]byte, MaxPayloadSize))
+	} else if encryptionKey := b.keyFor(key); encryptionKey != nil {
+		padded = IsPadded(value)
+		value, err = decryptAny(value, []stream.Option{stream.WithConcurrency(b.cryptoWorkers)}, append([][]byte{encryptionKey}, b.fallbackKeys...)...)
 		if err != nil {
 			err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error. could not decrypt and read the bytes from the opeend file ")
 			return nil, err
 		}
-		buf = target
-
+	}
+	if padded {
+		value, err = Unpad(value)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Storage: Get operation error. could not strip the padding of the file at (%s)", path)
+			return nil, err
+		}
 	}
 	result := &Entry{
-		Key:   key,
-		Value: buf.Bytes(),
+		Key:     key,
+		Value:   value,
+		Size:    int64(len(value)),
+		ModTime: fi.ModTime(),
+	}
+	if md := b.readSidecar(key, at, fi, stored); md != nil {
+		result.ETag = md.ETag
+		result.Metadata = md.Metadata
+	} else if IsSealed(stored) {
+		sum := md5.Sum(stored)
+		result.ETag = hex.EncodeToString(sum[:])
+	} else {
+		result.ETag = result.MD5CurrentHexString()
 	}
 
 	return result, nil
 
 }
 
+// GetRangeInternal -
+func (b *Storage) GetRangeInternal(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		err := stacktrace.NewError("[ERROR] Storage: GetRange operation error. invalid range (%d,%d) for key (%s)", offset, length, key)
+		return nil, err
+	}
+	encryptionKey := b.keyFor(key)
+	if encryptionKey != nil {
+		out, err := b.getDecryptedRange(ctx, key, append([][]byte{encryptionKey}, b.fallbackKeys...), offset, length)
+		if err != errSealedObject {
+			return out, err
+		}
+	}
+	if encryptionKey != nil || (len(b.recipients)+len(b.identities) != 0 && !b.isPlaintext(key)) {
+		// objects sealed to recipients start with their wrapped keys, so
+		// the whole object is opened and the range is cut out of it
+		entry, err := b.GetInternal(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || int64(len(entry.Value)) < offset+length {
+			err = stacktrace.NewError("[ERROR] Storage: GetRange operation error. range (%d,%d) is out of bounds for key (%s)", offset, length, key)
+			return nil, err
+		}
+		return entry.Value[offset : offset+length], nil
+	}
+	err := b.validatePath(key)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: GetRange operation error.could not validate entry key (%s) ", key)
+		return nil, err
+	}
+	path, keyExpanded := b.expandPath(key)
+	path = filepath.Join(path, keyExpanded)
+	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: GetRange operation.reading (%d) bytes at offset (%d) of file at (%s)", length, offset, path)
+	f, err := os.Open(path)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: GetRange operation error.could not open the file at (%s) ", path)
+		return nil, err
+	}
+	defer f.Close()
+	result := make([]byte, length)
+	r := &rateLimitedReaderAt{ctx: ctx, r: f, limiter: b.downloadLimiter}
+	_, err = r.ReadAt(result, offset)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: GetRange operation error.could not read range (%d,%d) of the file at (%s) ", offset, length, path)
+		return nil, err
+	}
+	return result, nil
+}
+
+// getDecryptedRange decrypts the bursts of the object at key holding the
+// range with the first of keys that authenticates them. it returns
+// errSealedObject for objects sealed to recipients
+func (b *Storage) getDecryptedRange(ctx context.Context, key string, keys [][]byte, offset, length int64) ([]byte, error) {
+	err := b.validatePath(key)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: GetRange operation error.could not validate entry key (%s) ", key)
+		return nil, err
+	}
+	path, keyExpanded := b.expandPath(key)
+	path = filepath.Join(path, keyExpanded)
+	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: GetRange operation.decrypting (%d) bytes at offset (%d) of file at (%s)", length, offset, path)
+	f, err := os.Open(path)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: GetRange operation error.could not open the file at (%s) ", path)
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: GetRange operation error.could not stat the file at (%s) ", path)
+		return nil, err
+	}
+	magic := make([]byte, len(recipientMagic))
+	_, err = f.ReadAt(magic, 0)
+	if err == nil && IsSealed(magic) {
+		return nil, errSealedObject
+	}
+	result := make([]byte, length)
+	r := &rateLimitedReaderAt{ctx: ctx, r: f, limiter: b.downloadLimiter}
+	for _, k := range keys {
+		var reader *stream.DecryptingReader
+		reader, err = stream.NewDecryptingReader(r, fi.Size(), k)
+		if err != nil {
+			continue
+		}
+		// a padded object holds its plaintext after the padding header
+		var base, size int64
+		base, size, err = unpaddedRange(reader)
+		if err != nil {
+			continue
+		}
+		if size < offset+length {
+			err = stacktrace.NewError("[ERROR] Storage: GetRange operation error. range (%d,%d) is out of bounds for key (%s)", offset, length, key)
+			return nil, err
+		}
+		_, err = reader.ReadAt(result, base+offset)
+		if err == nil {
+			return result, nil
+		}
+	}
+	err = stacktrace.Propagate(err, "[ERROR] Storage: GetRange operation error. could not decrypt range (%d,%d) of the file at (%s) ", offset, length, path)
+	return nil, err
+}
+
 // DeleteInternal -
 func (b *Storage) DeleteInternal(ctx context.Context, key string) error {
 	var err error
@@ -190,6 +410,17 @@ func (b *Storage) DeleteInternal(ctx context.Context, key string) error {
 	basePath, keyExpanded := b.expandPath(key)
 	fullPath := filepath.Join(basePath, keyExpanded)
 	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Delete operation.deleting file at (%s)", fullPath)
+	b.treeLock.RLock()
+	err = b.archive(key, "")
+	b.treeLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	// the sidecar goes first, so a crash never leaves one without its object
+	err = b.removeSidecar(key)
+	if err != nil {
+		return err
+	}
 	err = os.Remove(fullPath)
 	if err != nil && !os.IsNotExist(err) {
 		err = stacktrace.Propagate(err, "[ERROR] Storage: Delete operation failed to remove %q", fullPath)
@@ -197,7 +428,9 @@ func (b *Storage) DeleteInternal(ctx context.Context, key string) error {
 
 	}
 	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: Delete operation.cleaning up logical path (%s). Removing all empty nodes, beginning with deepest one, aborting on first non-empty one, up to top-level node", key)
+	b.treeLock.Lock()
 	err = b.cleanupPath(key)
+	b.treeLock.Unlock()
 	if err != nil {
 		return err
 	}
@@ -234,11 +467,22 @@ func (b *Storage) ListInternal(ctx context.Context, prefix string) ([]string, er
 		return nil, err
 
 	}
-	names, err := f.Readdirnames(-1)
+	all, err := f.Readdirnames(-1)
 	if err != nil {
 		err = stacktrace.Propagate(err, "[ERROR] Storage: List operation error. could not read and return slice of names from (%v) ", path)
 		return nil, err
 	}
+	// objects being written are not listed until they are renamed into
+	// place, and sidecars and prior versions are not objects
+	names := all[:0]
+	for _, name := range all {
+		if prefix == "" && name == VersionsPrefix {
+			continue
+		}
+		if !strings.HasPrefix(name, tempPrefix) && !strings.HasPrefix(name, metaPrefix) {
+			names = append(names, name)
+		}
+	}
 
 	for i, name := range names {
 		fi, err := os.Stat(filepath.Join(path, name))
@@ -263,6 +507,56 @@ func (b *Storage) ListInternal(ctx context.Context, prefix string) ([]string, er
 
 }
 
+// removeTempFiles deletes the temporary files writes interrupted by a
+// crash left under the root path
+func (b *Storage) removeTempFiles() error {
+	removed := 0
+	err := filepath.Walk(b.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasPrefix(info.Name(), tempPrefix) {
+			err = os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage : could not remove temporary files under (%s)", b.path)
+		return err
+	}
+	if removed != 0 {
+		b.logCh <- fmt.Sprintf("[red][WARN] Storage : removed (%d) temporary files left by interrupted writes", removed)
+	}
+	return nil
+}
+
+// keyFor returns the key objects stored under key are encrypted with, or
+// nil when they are stored unencrypted
+func (b *Storage) keyFor(key string) []byte {
+	if b.isPlaintext(key) {
+		return nil
+	}
+	return b.encryptionKey
+}
+
+// isPlaintext reports whether key is under one of the plaintext prefixes
+func (b *Storage) isPlaintext(key string) bool {
+	key = strings.TrimPrefix(key, "/")
+	for _, prefix := range b.plaintext {
+		if key == prefix || strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // cleanupPath is used to remove all empty nodes, beginning with deepest
 // one, aborting on first non-empty one, up to top-level node.
 func (b *Storage) cleanupPath(path string) error {
@@ -315,3 +609,19 @@ func (b *Storage) validatePath(path string) error {
 	}
 	return nil
 }
+
+// leadingBytes keeps the first n bytes written to it
+type leadingBytes struct {
+	n    int
+	data []byte
+}
+
+func (l *leadingBytes) Write(p []byte) (int, error) {
+	if missing := l.n - len(l.data); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		l.data = append(l.data, p[:missing]...)
+	}
+	return len(p), nil
+}
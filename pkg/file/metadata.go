@@ -0,0 +1,469 @@
+package file
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	jsonutil "github.com/damoonazarpazhooh/File-Ingestion/internal/jsonutil"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+)
+
+// metaPrefix starts the names of the sidecar files holding the metadata of
+// the objects stored next to them
+const metaPrefix = ".splitter-meta-"
+
+// well known keys of Entry.Metadata
+const (
+	// MetadataContentType is the media type of the value
+	MetadataContentType = "content-type"
+	// MetadataCodec names the codec the value was compressed with
+	MetadataCodec = "codec"
+	// MetadataKeyID names the key the value was encrypted with
+	MetadataKeyID = "key-id"
+)
+
+// ErrPreconditionFailed is returned by conditional operations whose
+// condition does not hold
+var ErrPreconditionFailed = stacktrace.NewError("[ERROR] precondition failed")
+
+// headerSize is the number of leading bytes of an encrypted object file
+// its sidecar is bound to. they hold the random nonce of its stream, or the
+// ephemeral keys it was sealed to recipients with, which every write draws
+// afresh
+const headerSize = 64
+
+// sidecar is the metadata persisted next to an object. it is bound to the
+// object file it describes, so a sidecar left stale by a crash between
+// writing the two, or by a rewrite of the same size, is told apart and
+// ignored. the binding is in the clear; what the object holds is encrypted
+// the way the object is
+type sidecar struct {
+	StoredSize int64 `json:"stored_size"`
+	// HeaderDigest is the SHA-256 checksum of the leading bytes of an
+	// encrypted object file, in hex
+	HeaderDigest string `json:"header_digest,omitempty"`
+	// StoredETag is the MD5 checksum of a plaintext object file, in hex
+	StoredETag string `json:"stored_etag,omitempty"`
+	// ETag of objects sealed to recipients is the MD5 checksum of the
+	// object file, which hosts without an identity can compute as well
+	ETag string `json:"etag,omitempty"`
+	// Sealed is the objectMetadata of an encrypted object, encrypted with
+	// its key or sealed to its recipients. plaintext objects keep it in
+	// Object
+	Sealed []byte          `json:"sealed,omitempty"`
+	Object *objectMetadata `json:"object,omitempty"`
+}
+
+// objectMetadata is what a sidecar knows about the value of an object
+type objectMetadata struct {
+	// ETag is the MD5 checksum of the value. objects sealed to recipients
+	// use the one of their sidecar instead
+	ETag     string            `json:"etag,omitempty"`
+	Size     int64             `json:"size"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Stat - returns the metadata of the object stored at k, without its value.
+// it returns nil when there is no such object
+func (b *Storage) Stat(ctx context.Context, k string) (*Entry, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Storage :was not initialized")
+		return nil, err
+	}
+	b.permitPool.Acquire()
+	defer b.permitPool.Release()
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	errCh := make(chan error, 1)
+	entryCh := make(chan *Entry, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		entry, err := b.StatInternal(ctx, k)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		entryCh <- entry
+	}()
+	for {
+		select {
+		case ent := <-entryCh:
+			{
+				return ent, nil
+			}
+		case logs := <-b.logCh:
+			{
+				if b.logOps {
+					colorstring.Println(logs)
+				}
+			}
+		case err := <-errCh:
+			{
+				return nil, err
+			}
+		case <-ctx.Done():
+			b.drain(done)
+			err := stacktrace.Propagate(ctx.Err(), "[FATAL] Storage: Stat operation error ")
+			return nil, err
+		}
+	}
+}
+
+// PutIfAbsent - puts entry unless an object is already stored at its key,
+// in which case it returns ErrPreconditionFailed
+func (b *Storage) PutIfAbsent(ctx context.Context, entry *Entry) error {
+	return b.put(ctx, entry, func(current *Entry) bool {
+		return current == nil
+	}, true)
+}
+
+// PutIfMatch - puts entry only if the object stored at its key has the
+// given ETag, and returns ErrPreconditionFailed otherwise
+func (b *Storage) PutIfMatch(ctx context.Context, entry *Entry, etag string) error {
+	return b.put(ctx, entry, func(current *Entry) bool {
+		return current != nil && current.ETag == etag
+	}, true)
+}
+
+// DeleteIfMatch - deletes the object stored at k only if it has the given
+// ETag, and returns ErrPreconditionFailed otherwise
+func (b *Storage) DeleteIfMatch(ctx context.Context, k string, etag string) error {
+	return b.delete(ctx, k, func(current *Entry) bool {
+		return current != nil && current.ETag == etag
+	})
+}
+
+// StatInternal -
+func (b *Storage) StatInternal(ctx context.Context, key string) (*Entry, error) {
+	err := b.validatePath(key)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Stat operation error.could not validate entry key (%s) ", key)
+		return nil, err
+	}
+	path, keyExpanded := b.expandPath(key)
+	fi, err := os.Stat(filepath.Join(path, keyExpanded))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Stat operation error.could not stat entry key (%s) ", key)
+		return nil, err
+	}
+	md := b.readSidecar(key, key, fi, nil)
+	if md != nil {
+		result := &Entry{
+			Key:      key,
+			ETag:     md.ETag,
+			Size:     md.Size,
+			ModTime:  fi.ModTime(),
+			Metadata: md.Metadata,
+		}
+		return result, nil
+	}
+	// objects sealed to recipients cannot be read without an identity, so
+	// only their existence and ETag are known
+	if len(b.identities) == 0 && !b.isPlaintext(key) {
+		objectPath := filepath.Join(path, keyExpanded)
+		sealed, err := b.isSealedFile(objectPath)
+		if err != nil {
+			return nil, err
+		}
+		if sealed {
+			etag, err := fileETag(objectPath)
+			if err != nil {
+				err = stacktrace.Propagate(err, "[ERROR] Storage: Stat operation error.could not checksum the file at (%s) ", objectPath)
+				return nil, err
+			}
+			return &Entry{Key: key, ETag: etag, ModTime: fi.ModTime()}, nil
+		}
+	}
+	// objects without a sidecar are read to find their ETag
+	result, err := b.GetInternal(ctx, key)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	result.Value = nil
+	return result, nil
+}
+
+// isSealedFile reports whether the object file at path is sealed to
+// recipients
+func (b *Storage) isSealedFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not open the file at (%s)", path)
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(recipientMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not read the file at (%s)", path)
+		return false, err
+	}
+	return IsSealed(magic), nil
+}
+
+// check fails with ErrPreconditionFailed unless cond holds for the object
+// currently stored at key
+func (b *Storage) check(ctx context.Context, key string, cond func(current *Entry) bool) error {
+	current, err := b.StatInternal(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !cond(current) {
+		b.logCh <- fmt.Sprintf("[red][WARN] Storage: precondition on key (%s) does not hold", key)
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// sidecarPath returns the path of the sidecar of the object at key
+func (b *Storage) sidecarPath(key string) string {
+	path, keyExpanded := b.expandPath(key)
+	return filepath.Join(path, metaPrefix+keyExpanded)
+}
+
+// writeSidecar persists the metadata of entry, just written to a file
+// described by fi. header holds the leading bytes of the file and
+// storedETag is its MD5 checksum. it is written the way objects are, so a
+// crash leaves either the previous sidecar or this one; a sidecar lost to
+// a crash is rebuilt from its object, and one left stale is ignored
+func (b *Storage) writeSidecar(entry *Entry, fi os.FileInfo, header []byte, storedETag string) error {
+	md := &objectMetadata{
+		ETag:     entry.ETag,
+		Size:     entry.Size,
+		Metadata: entry.Metadata,
+	}
+	sc := &sidecar{StoredSize: fi.Size()}
+	var err error
+	switch {
+	case b.isPlaintext(entry.Key) || (len(b.recipients) == 0 && b.keyFor(entry.Key) == nil):
+		sc.StoredETag = storedETag
+		sc.Object = md
+	case len(b.recipients) != 0:
+		sc.HeaderDigest = headerDigest(header)
+		sc.ETag = storedETag
+		md.ETag = ""
+		sc.Sealed, err = b.sealMetadata(entry.Key, md)
+	default:
+		sc.HeaderDigest = headerDigest(header)
+		sc.Sealed, err = b.sealMetadata(entry.Key, md)
+	}
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not encrypt the metadata of key (%s)", entry.Key)
+		return err
+	}
+	data, err := jsonutil.EncodeJSON(sc)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not encode the metadata of key (%s)", entry.Key)
+		return err
+	}
+	path := b.sidecarPath(entry.Key)
+	f, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not create temporary file for the metadata of key (%s)", entry.Key)
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not write the metadata of key (%s) to (%s)", entry.Key, path)
+		return err
+	}
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not sync directory (%s)", filepath.Dir(path))
+		return err
+	}
+	return nil
+}
+
+// readSidecar returns the metadata persisted for the object stored at key
+// at, whose file is described by fi. stored is the content of the file
+// when the caller already read it. it returns nil when there is none, or
+// when it cannot be read or does not describe that file. the size and
+// metadata of objects sealed to recipients are left empty without an
+// identity to open them with
+func (b *Storage) readSidecar(key, at string, fi os.FileInfo, stored []byte) *objectMetadata {
+	path := b.sidecarPath(at)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			b.logCh <- fmt.Sprintf("[red][WARN] Storage: could not read the metadata of key (%s) at (%s) : %v", key, path, err)
+		}
+		return nil
+	}
+	sc := &sidecar{}
+	err = jsonutil.DecodeJSON(data, sc)
+	if err != nil {
+		b.logCh <- fmt.Sprintf("[red][WARN] Storage: could not decode the metadata of key (%s) at (%s) : %v", key, path, err)
+		return nil
+	}
+	if sc.StoredSize != fi.Size() {
+		return nil
+	}
+	objectPath, keyExpanded := b.expandPath(at)
+	objectPath = filepath.Join(objectPath, keyExpanded)
+	switch {
+	case len(sc.HeaderDigest) != 0:
+		header := stored
+		if header == nil {
+			header, err = readHeader(objectPath)
+		}
+		if err != nil {
+			b.logCh <- fmt.Sprintf("[red][WARN] Storage: could not read the object of key (%s) : %v", key, err)
+			return nil
+		}
+		if headerDigest(header) != sc.HeaderDigest {
+			return nil
+		}
+	case len(sc.StoredETag) != 0:
+		var storedETag string
+		if stored != nil {
+			sum := md5.Sum(stored)
+			storedETag = hex.EncodeToString(sum[:])
+		} else {
+			storedETag, err = fileETag(objectPath)
+		}
+		if err != nil {
+			b.logCh <- fmt.Sprintf("[red][WARN] Storage: could not checksum the object of key (%s) : %v", key, err)
+			return nil
+		}
+		if sc.StoredETag != storedETag {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if sc.Object != nil {
+		return sc.Object
+	}
+	md := &objectMetadata{}
+	if IsSealed(sc.Sealed) && len(b.identities) == 0 {
+		md.ETag = sc.ETag
+		return md
+	}
+	md, err = b.openMetadata(key, sc.Sealed)
+	if err != nil {
+		b.logCh <- fmt.Sprintf("[red][WARN] Storage: could not decrypt the metadata of key (%s) at (%s) : %v", key, path, err)
+		return nil
+	}
+	if len(sc.ETag) != 0 {
+		md.ETag = sc.ETag
+	}
+	return md
+}
+
+// headerDigest returns the SHA-256 checksum of the leading bytes of an
+// object file, in hex
+func headerDigest(data []byte) string {
+	if len(data) > headerSize {
+		data = data[:headerSize]
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readHeader returns the leading bytes of the file at path
+func readHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(f, header)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return header[:n], err
+}
+
+// fileETag returns the MD5 checksum of the file at path, in hex
+func fileETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// removeSidecar deletes the metadata persisted for the object at key
+func (b *Storage) removeSidecar(key string) error {
+	path := b.sidecarPath(key)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not remove the metadata of key (%s) at (%s)", key, path)
+		return err
+	}
+	return nil
+}
+
+// sealMetadata encrypts md the way the object at key is, so sidecars
+// reveal nothing the object does not
+func (b *Storage) sealMetadata(key string, md *objectMetadata) ([]byte, error) {
+	data, err := jsonutil.EncodeJSON(md)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.recipients) != 0 {
+		return SealToRecipients(b.recipients, b.cipherID, data)
+	}
+	return EncryptWithCipher(b.cipherID, b.keyFor(key), data)
+}
+
+// openMetadata decrypts metadata sealed by sealMetadata
+func (b *Storage) openMetadata(key string, sealed []byte) (*objectMetadata, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if IsSealed(sealed) {
+		data, err = OpenWithIdentities(b.identities, sealed)
+	} else if encryptionKey := b.keyFor(key); encryptionKey != nil {
+		data, err = decryptAny(sealed, nil, append([][]byte{encryptionKey}, b.fallbackKeys...)...)
+	} else {
+		err = stacktrace.NewError("[ERROR] no key to decrypt the metadata with")
+	}
+	if err != nil {
+		return nil, err
+	}
+	md := &objectMetadata{}
+	err = jsonutil.DecodeJSON(data, md)
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
@@ -0,0 +1,144 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hosts sealing to recipients hold no identity, yet must be able to use
+// conditional operations on what they write
+func TestConditionalWithoutIdentity(t *testing.T) {
+	public, private, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := newTestStorage(t, WithRecipients(public))
+	ctx := context.Background()
+	first := &Entry{Key: "object", Value: []byte("first"), Metadata: map[string]string{MetadataContentType: "text/plain"}}
+	err = writer.PutIfAbsent(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.PutIfAbsent(ctx, &Entry{Key: "object", Value: []byte("again")})
+	if err != ErrPreconditionFailed {
+		t.Fatalf("PutIfAbsent over an object returned (%v), want ErrPreconditionFailed", err)
+	}
+	current, err := writer.Stat(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current == nil || current.ETag != first.ETag {
+		t.Fatalf("Stat returned %+v, want ETag %s", current, first.ETag)
+	}
+	second := &Entry{Key: "object", Value: []byte("second")}
+	err = writer.PutIfMatch(ctx, second, first.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.DeleteIfMatch(ctx, "object", first.ETag)
+	if err != ErrPreconditionFailed {
+		t.Fatalf("DeleteIfMatch with a stale ETag returned (%v), want ErrPreconditionFailed", err)
+	}
+	// the owner of the identity reads the sidecars the writer wrote
+	reader := newTestStorage(t, WithPath(writer.Path()), WithIdentities(private))
+	entry, err := reader.Get(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || !bytes.Equal(entry.Value, second.Value) || entry.ETag != second.ETag {
+		t.Fatalf("Get returned %+v, want value %q with ETag %s", entry, second.Value, second.ETag)
+	}
+	err = writer.DeleteIfMatch(ctx, "object", second.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a sidecar left stale by a rewrite of the same size, with the same
+// mtime, must not describe the new object
+func TestStaleSidecar(t *testing.T) {
+	b := newTestStorage(t, WithEncryptionKey(testKey))
+	ctx := context.Background()
+	err := b.Put(ctx, &Entry{Key: "object", Value: []byte("aaaa")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objectPath := filepath.Join(b.Path(), "object")
+	fi, err := os.Stat(objectPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := ioutil.ReadFile(b.sidecarPath("object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &Entry{Key: "object", Value: []byte("bbbb")}
+	err = b.Put(ctx, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(b.sidecarPath("object"), stale, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(objectPath, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := b.Stat(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current == nil || current.ETag != entry.ETag {
+		t.Fatalf("Stat returned %+v, want ETag %s", current, entry.ETag)
+	}
+}
+
+// sidecars must not reveal anything about a value its object hides,
+// including to hosts that only hold the public keys it was sealed to
+func TestSidecarConfidentiality(t *testing.T) {
+	public, private, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	value := []byte("the plaintext of the object")
+	metadata := map[string]string{MetadataContentType: "application/secret"}
+	writer := newTestStorage(t, WithRecipients(public))
+	reader := newTestStorage(t, WithPath(writer.Path()), WithIdentities(private))
+	keyed := newTestStorage(t, WithEncryptionKey(testKey))
+	for _, b := range []*Storage{writer, keyed} {
+		err = b.Put(ctx, &Entry{Key: "object", Value: value, Metadata: metadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadFile(b.sidecarPath("object"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain := &Entry{Value: value}
+		for _, leak := range []string{plain.MD5CurrentHexString(), "application/secret", `"size"`} {
+			if bytes.Contains(raw, []byte(leak)) {
+				t.Errorf("sidecar %s reveals %s", raw, leak)
+			}
+		}
+	}
+	written, err := writer.Stat(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written.Size != 0 || written.Metadata != nil {
+		t.Errorf("a host without an identity learnt size %d and metadata %v", written.Size, written.Metadata)
+	}
+	read, err := reader.Stat(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.ETag != written.ETag || read.Size != int64(len(value)) || read.Metadata[MetadataContentType] != "application/secret" {
+		t.Errorf("the owner of the identity read %+v", read)
+	}
+}
@@ -3,14 +3,15 @@ package file
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
 	"io"
 	"log"
 	"sync"
 
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/keylock"
 	permitpool "github.com/damoonazarpazhooh/File-Ingestion/internal/permitpool"
 	"github.com/palantir/stacktrace"
 	"golang.org/x/crypto/hkdf"
+	"golang.org/x/time/rate"
 )
 
 // Option - options setter method
@@ -32,6 +33,24 @@ type Storage struct {
 	numberOfThreads   int
 	encryptionKey     []byte
 	nonce             []byte
+	plaintext         []string
+	fallbackKeys      [][]byte
+	cipherID          byte
+	cryptoWorkers     int
+	recipients        [][]byte
+	identities        [][]byte
+	padding           Padding
+	versioning        bool
+	unversioned       []string
+	// locks guard objects, so operations on different keys run in
+	// parallel. treeLock keeps deletes from removing directories puts are
+	// writing into
+	locks    keylock.Locks
+	treeLock sync.RWMutex
+	// limiters are shared by every operation, so limits hold however many
+	// run at once
+	uploadLimiter   *rate.Limiter
+	downloadLimiter *rate.Limiter
 }
 
 // LogOps -
@@ -52,7 +71,8 @@ func WithPath(arg string) Option {
 	}
 }
 
-// WithUploadRateLimit -
+// WithUploadRateLimit - limits writes to arg bytes a second, across all
+// operations. zero disables the limit
 func WithUploadRateLimit(arg int) Option {
 	return func(e *Storage) {
 		e.stateLock.Lock()
@@ -61,7 +81,8 @@ func WithUploadRateLimit(arg int) Option {
 	}
 }
 
-// WithDownloadRateLimit -
+// WithDownloadRateLimit - limits reads to arg bytes a second, across all
+// operations. zero disables the limit
 func WithDownloadRateLimit(arg int) Option {
 	return func(e *Storage) {
 		e.stateLock.Lock()
@@ -70,7 +91,8 @@ func WithDownloadRateLimit(arg int) Option {
 	}
 }
 
-// WithNumberOfThreads -
+// WithNumberOfThreads - sets the number of operations that may run at
+// once. defaults to 128
 func WithNumberOfThreads(arg int) Option {
 	return func(e *Storage) {
 		e.stateLock.Lock()
@@ -84,33 +106,149 @@ func WithEncryption(arg string) Option {
 	return func(e *Storage) {
 		e.stateLock.Lock()
 		defer e.stateLock.Unlock()
-		var (
-			key [32]byte
-		)
-
-		hx := hex.EncodeToString([]byte(arg))
-		masterkey, err := hex.DecodeString(hx)
+		key, err := DeriveKey(arg)
 		if err != nil {
-			err = stacktrace.Propagate(err, "[ERROR] Cannot decode hex key")
 			log.Fatal(err)
 		}
-		nonce, err := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000001")
-		if err != nil {
-			fmt.Printf("[ERROR] Cannot decode hex key: %v", err)
-			log.Fatal(err)
-		}
-		// _, err = io.ReadFull(rand.Reader, nonce[:])
-		// if err != nil {
-		// 	err = stacktrace.Propagate(err, "[ERROR] Failed to read random data")
-		// 	log.Fatal(err)
-		// }
-		kdf := hkdf.New(sha256.New, masterkey, nonce[:], nil)
-		_, err = io.ReadFull(kdf, key[:])
-		if err != nil {
-			err = stacktrace.Propagate(err, "ERROR] Failed to derive encryption key")
+		e.encryptionKey = key
+		e.nonce = derivationSalt
+	}
+}
+
+// WithEncryptionKey - encrypts objects with the given 256-bit key as is,
+// instead of deriving one from a string
+func WithEncryptionKey(arg []byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		if len(arg) != KeySize {
+			err := stacktrace.NewError("[FATAL] encryption key must be %d bytes long, got %d", KeySize, len(arg))
 			log.Fatal(err)
 		}
-		e.encryptionKey = key[:]
-		e.nonce = nonce
+		e.encryptionKey = arg
+		e.nonce = derivationSalt
+	}
+}
+
+// WithCipher - sets the cipher suite new objects are encrypted with.
+// objects are decrypted with the suite recorded in their stream, so
+// repositories may hold objects of any suite
+func WithCipher(arg byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.cipherID = arg
+	}
+}
+
+// WithCryptoWorkers - seals and opens the bursts of an object on up to
+// arg goroutines. objects are byte identical either way
+func WithCryptoWorkers(arg int) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.cryptoWorkers = arg
+	}
+}
+
+// WithPadding - pads new encrypted objects with the given policy before
+// encrypting them, so their stored size does not reveal the exact size of
+// their contents. padding is stripped on read whatever the policy
+func WithPadding(arg Padding) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.padding = arg
+	}
+}
+
+// WithVersioning - keeps the prior version of objects that are overwritten
+// or deleted under VersionsPrefix, instead of destroying it
+func WithVersioning() Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.versioning = true
+	}
+}
+
+// WithUnversionedPrefixes - objects under any of the given prefixes are
+// never kept as versions, so overwriting or deleting them destroys them.
+// it is meant for key material
+func WithUnversionedPrefixes(arg ...string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.unversioned = append(e.unversioned, arg...)
+	}
+}
+
+// WithRecipients - seals new objects to the given X25519 public keys
+// instead of the encryption key, so writing needs no secret
+func WithRecipients(arg ...[]byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.recipients = append(e.recipients, arg...)
+	}
+}
+
+// WithIdentities - reads objects sealed to recipients with the given
+// X25519 private keys
+func WithIdentities(arg ...[]byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.identities = append(e.identities, arg...)
+	}
+}
+
+// WithFallbackKeys - objects the encryption key cannot decrypt are tried
+// with these keys, in order. writes always use the encryption key
+func WithFallbackKeys(arg ...[]byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.fallbackKeys = append(e.fallbackKeys, arg...)
+	}
+}
+
+// WithPlaintextPrefixes - objects under any of the given prefixes are stored
+// unencrypted, even when encryption is enabled
+func WithPlaintextPrefixes(arg ...string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.plaintext = append(e.plaintext, arg...)
+	}
+}
+
+// derivationSalt is the salt DeriveKey feeds to HKDF.
+var derivationSalt, _ = hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000001")
+
+// DeriveKey - derives the 256-bit encryption key that WithEncryption uses
+// from the given string
+func DeriveKey(arg string) ([]byte, error) {
+	var (
+		key [32]byte
+	)
+
+	hx := hex.EncodeToString([]byte(arg))
+	masterkey, err := hex.DecodeString(hx)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Cannot decode hex key")
+		return nil, err
+	}
+	// _, err = io.ReadFull(rand.Reader, nonce[:])
+	// if err != nil {
+	// 	err = stacktrace.Propagate(err, "[ERROR] Failed to read random data")
+	// 	log.Fatal(err)
+	// }
+	kdf := hkdf.New(sha256.New, masterkey, derivationSalt, nil)
+	_, err = io.ReadFull(kdf, key[:])
+	if err != nil {
+		err = stacktrace.Propagate(err, "ERROR] Failed to derive encryption key")
+		return nil, err
 	}
+	return key[:], nil
 }
@@ -0,0 +1,146 @@
+package file
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/stream"
+	"github.com/palantir/stacktrace"
+)
+
+// paddingMagic starts padded plaintexts. whether a plaintext is padded is
+// told by the stream it is sealed in, see stream.WithPadded; the magic only
+// guards against a malformed frame
+var paddingMagic = []byte{0xFF, 'P', 'A', 'D', 'D', 'I', 'N', 'G'}
+
+// PaddingHeaderSize is the size of the magic and length padded plaintexts
+// start with
+const PaddingHeaderSize = 16
+
+// Padding - a policy returning the size a plaintext of size bytes,
+// including the padding header, is padded to before it is encrypted. the
+// result must not be smaller than size
+type Padding func(size int64) int64
+
+// PadPowerOfTwo - pads plaintexts to the next power of two, so stored
+// objects only reveal the magnitude of their size. it costs up to twice
+// the space
+func PadPowerOfTwo() Padding {
+	return func(size int64) int64 {
+		padded := int64(1)
+		for padded < size {
+			padded <<= 1
+		}
+		return padded
+	}
+}
+
+// PadRandom - pads plaintexts by a random number of bytes, up to overhead
+// times their size, so equal plaintexts are stored with different sizes
+func PadRandom(overhead float64) Padding {
+	return func(size int64) int64 {
+		max := int64(float64(size) * overhead)
+		if max <= 0 {
+			return size
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(max+1))
+		if err != nil {
+			return size + max
+		}
+		return size + n.Int64()
+	}
+}
+
+// ParsePadding - returns the padding policy named name, one of [none,
+// pow2, random]. random pads by up to overhead times the plaintext size.
+// none returns a nil policy
+func ParsePadding(name string, overhead float64) (Padding, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "pow2":
+		return PadPowerOfTwo(), nil
+	case "random":
+		if overhead <= 0 {
+			return nil, stacktrace.NewError("[ERROR] random padding needs a positive overhead, got %v", overhead)
+		}
+		return PadRandom(overhead), nil
+	}
+	return nil, stacktrace.NewError("[ERROR] unknown padding policy (%s). must be one of [none, pow2, random]", name)
+}
+
+// Pad - returns plaintext framed with its length and grown to the size
+// policy picks. the frame is encrypted along with plaintext, so its length
+// is authenticated; Unpad strips it. padded plaintexts must be sealed with
+// stream.WithPadded, as EncryptWithPadding does
+func Pad(policy Padding, plaintext []byte) []byte {
+	size := int64(PaddingHeaderSize + len(plaintext))
+	padded := policy(size)
+	if padded < size {
+		padded = size
+	}
+	out := make([]byte, padded)
+	copy(out, paddingMagic)
+	binary.BigEndian.PutUint64(out[len(paddingMagic):], uint64(len(plaintext)))
+	copy(out[PaddingHeaderSize:], plaintext)
+	return out
+}
+
+// Unpad - returns the plaintext a padded value frames. it must only be
+// given values IsPadded reported padded
+func Unpad(value []byte) ([]byte, error) {
+	if len(value) < PaddingHeaderSize {
+		return nil, stacktrace.NewError("[ERROR] padded value is truncated")
+	}
+	if !bytes.HasPrefix(value, paddingMagic) {
+		return nil, stacktrace.NewError("[ERROR] padded value does not start with a padding header")
+	}
+	length := binary.BigEndian.Uint64(value[len(paddingMagic):])
+	if length > uint64(len(value)-PaddingHeaderSize) {
+		return nil, stacktrace.NewError("[ERROR] padded value claims (%d) bytes, holds (%d)", length, len(value)-PaddingHeaderSize)
+	}
+	return value[PaddingHeaderSize : PaddingHeaderSize+int(length)], nil
+}
+
+// IsPadded - reports whether ciphertext, as sealed by EncryptWithPadding,
+// holds a padded plaintext. the answer is only authentic once ciphertext
+// was decrypted
+func IsPadded(ciphertext []byte) bool {
+	return stream.IsPadded(ciphertext)
+}
+
+// EncryptWithPadding - is EncryptWithCipher, padding plaintext to the size
+// policy picks first. a nil policy does not pad
+func EncryptWithPadding(cipherID byte, key []byte, policy Padding, plaintext []byte) ([]byte, error) {
+	if policy == nil {
+		return EncryptWithCipher(cipherID, key, plaintext)
+	}
+	return encrypt(key, Pad(policy, plaintext), stream.WithCipher(cipherID), stream.WithPadded())
+}
+
+// unpaddedRange returns the offset and size of the plaintext held by the
+// decrypted object r, stripping its padding if it has any
+func unpaddedRange(r *stream.DecryptingReader) (int64, int64, error) {
+	size := r.Size()
+	if !r.Padded() {
+		return 0, size, nil
+	}
+	if size < PaddingHeaderSize {
+		return 0, 0, stacktrace.NewError("[ERROR] padded object is truncated")
+	}
+	header := make([]byte, PaddingHeaderSize)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !bytes.HasPrefix(header, paddingMagic) {
+		return 0, 0, stacktrace.NewError("[ERROR] padded object does not start with a padding header")
+	}
+	length := int64(binary.BigEndian.Uint64(header[len(paddingMagic):]))
+	if length < 0 || length > size-PaddingHeaderSize {
+		return 0, 0, stacktrace.NewError("[ERROR] padded object claims (%d) bytes, holds (%d)", length, size-PaddingHeaderSize)
+	}
+	return PaddingHeaderSize, length, nil
+}
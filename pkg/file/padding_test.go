@@ -0,0 +1,72 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// paddedLike returns a plaintext that starts like a padded one
+func paddedLike(plaintext []byte) []byte {
+	header := make([]byte, PaddingHeaderSize)
+	copy(header, paddingMagic)
+	binary.BigEndian.PutUint64(header[len(paddingMagic):], uint64(len(plaintext)))
+	return append(header, plaintext...)
+}
+
+func TestPadding(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  []Option
+		value []byte
+	}{
+		{
+			name:  "unpadded value that looks padded",
+			value: paddedLike([]byte("hello world")),
+		},
+		{
+			name:  "padded value that looks padded",
+			opts:  []Option{WithPadding(PadPowerOfTwo())},
+			value: paddedLike([]byte("hello world")),
+		},
+		{
+			name:  "padded value",
+			opts:  []Option{WithPadding(PadPowerOfTwo())},
+			value: []byte("hello world"),
+		},
+		{
+			name:  "padded empty value",
+			opts:  []Option{WithPadding(PadPowerOfTwo())},
+			value: []byte{},
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			b := newTestStorage(t, append([]Option{WithEncryptionKey(testKey)}, c.opts...)...)
+			ctx := context.Background()
+			err := b.Put(ctx, &Entry{Key: "object", Value: c.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, err := b.Get(ctx, "object")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry == nil || !bytes.Equal(entry.Value, c.value) {
+				t.Fatalf("Get returned %q, want %q", entry.Value, c.value)
+			}
+			if len(c.value) < 6 {
+				return
+			}
+			value, err := b.GetRange(ctx, "object", 1, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, c.value[1:6]) {
+				t.Fatalf("GetRange returned %q, want %q", value, c.value[1:6])
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package file
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitBurst is the most bytes a rate limited operation may move
+// without waiting; larger reads and writes are throttled piece by piece
+const rateLimitBurst = 1 << 16
+
+// newRateLimiter returns a token bucket filled with bytesPerSecond tokens a
+// second. limits below one byte a second disable it
+func newRateLimiter(bytesPerSecond int) *rate.Limiter {
+	return rate.NewLimiter(rateLimit(bytesPerSecond), rateLimitBurst)
+}
+
+func rateLimit(bytesPerSecond int) rate.Limit {
+	if bytesPerSecond < 1 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSecond)
+}
+
+// SetUploadRateLimit - changes the number of bytes a second every Put of
+// b may write, in total. it applies to operations already running. limits
+// below one byte a second disable it
+func (b *Storage) SetUploadRateLimit(bytesPerSecond int) {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	b.uploadLimiter.SetLimit(rateLimit(bytesPerSecond))
+}
+
+// SetDownloadRateLimit - changes the number of bytes a second every Get of
+// b may read, in total. it applies to operations already running. limits
+// below one byte a second disable it
+func (b *Storage) SetDownloadRateLimit(bytesPerSecond int) {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	b.downloadLimiter.SetLimit(rateLimit(bytesPerSecond))
+}
+
+// waitN blocks until limiter allows n bytes, taking them a burst at a time
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		take := n
+		if take > rateLimitBurst {
+			take = rateLimitBurst
+		}
+		err := limiter.WaitN(ctx, take)
+		if err != nil {
+			return err
+		}
+		n -= take
+	}
+	return nil
+}
+
+// rateLimitedWriter throttles writes to w
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedWriter) Write(p []byte) (int, error) {
+	err := waitN(r.ctx, r.limiter, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return r.w.Write(p)
+}
+
+// rateLimitedReader throttles reads from r
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		waitErr := waitN(r.ctx, r.limiter, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// rateLimitedReaderAt throttles reads from r
+type rateLimitedReaderAt struct {
+	ctx     context.Context
+	r       io.ReaderAt
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	if n > 0 {
+		waitErr := waitN(r.ctx, r.limiter, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
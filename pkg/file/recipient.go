@@ -0,0 +1,212 @@
+package file
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/stream"
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// recipientMagic starts objects sealed to recipients. its last byte is
+// where a stream header keeps its cipher id, and is never a valid one, so
+// sealed objects and streams cannot be mistaken for each other
+var recipientMagic = []byte{'R', 'C', 'P', 0xFF}
+
+var (
+	// ErrNoIdentity is returned when an object sealed to recipients is read
+	// without an identity
+	ErrNoIdentity = stacktrace.NewError("[ERROR] object is sealed to recipients; an identity is needed to read it")
+	// ErrNotRecipient is returned when none of the identities an object
+	// is read with is one of its recipients
+	ErrNotRecipient = stacktrace.NewError("[ERROR] none of the identities is a recipient of the object")
+	// errSealedObject is returned by readers that cannot open objects
+	// sealed to recipients in place
+	errSealedObject = stacktrace.NewError("[ERROR] object is sealed to recipients")
+)
+
+// GenerateIdentity - returns a new X25519 key pair. objects sealed to the
+// public key can only be read with the private one
+func GenerateIdentity() (public, private []byte, err error) {
+	var scalar, point [32]byte
+	_, err = io.ReadFull(rand.Reader, scalar[:])
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not generate identity")
+		return nil, nil, err
+	}
+	curve25519.ScalarBaseMult(&point, &scalar)
+	return point[:], scalar[:], nil
+}
+
+// Recipient - returns the public key of identity
+func Recipient(identity []byte) ([]byte, error) {
+	if len(identity) != 32 {
+		return nil, stacktrace.NewError("[ERROR] identity must be 32 bytes long, got %d", len(identity))
+	}
+	var scalar, point [32]byte
+	copy(scalar[:], identity)
+	curve25519.ScalarBaseMult(&point, &scalar)
+	return point[:], nil
+}
+
+// ParseKey - decodes a hex encoded recipient or identity, ignoring
+// surrounding whitespace
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, stacktrace.NewError("[ERROR] key must be 64 hex characters")
+	}
+	return key, nil
+}
+
+// IsSealed - reports whether value was sealed to recipients
+func IsSealed(value []byte) bool {
+	return bytes.HasPrefix(value, recipientMagic)
+}
+
+// SealToRecipients - encrypts plaintext with a random file key, wrapped
+// for every recipient with a key agreed from a fresh ephemeral X25519 key.
+// sealing only needs public keys
+func SealToRecipients(recipients [][]byte, cipherID byte, plaintext []byte) ([]byte, error) {
+	return sealToRecipients(recipients, plaintext, stream.WithCipher(cipherID))
+}
+
+func sealToRecipients(recipients [][]byte, plaintext []byte, opts ...stream.Option) ([]byte, error) {
+	if len(recipients) == 0 || len(recipients) > 255 {
+		return nil, stacktrace.NewError("[ERROR] objects must be sealed to between 1 and 255 recipients, got %d", len(recipients))
+	}
+	fileKey := make([]byte, KeySize)
+	_, err := io.ReadFull(rand.Reader, fileKey)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not generate file key")
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	buf.Write(recipientMagic)
+	buf.WriteByte(byte(len(recipients)))
+	for _, recipient := range recipients {
+		ephemeralPublic, ephemeral, err := GenerateIdentity()
+		if err != nil {
+			return nil, err
+		}
+		wrapKey, err := wrappingKey(ephemeral, recipient, ephemeralPublic, recipient)
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := Encrypt(wrapKey, fileKey)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] could not wrap file key")
+			return nil, err
+		}
+		buf.Write(ephemeralPublic)
+		var size [2]byte
+		binary.LittleEndian.PutUint16(size[:], uint16(len(wrapped)))
+		buf.Write(size[:])
+		buf.Write(wrapped)
+	}
+	body, err := encrypt(fileKey, plaintext, opts...)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// OpenWithIdentities - decrypts an object sealed by SealToRecipients with
+// the first identity it was sealed to
+func OpenWithIdentities(identities [][]byte, sealed []byte) ([]byte, error) {
+	plaintext, _, err := openWithIdentities(identities, sealed)
+	return plaintext, err
+}
+
+// openWithIdentities is OpenWithIdentities, also reporting whether the
+// plaintext is padded
+func openWithIdentities(identities [][]byte, sealed []byte) ([]byte, bool, error) {
+	if !IsSealed(sealed) {
+		return nil, false, stacktrace.NewError("[ERROR] object is not sealed to recipients")
+	}
+	if len(identities) == 0 {
+		return nil, false, ErrNoIdentity
+	}
+	reader := bytes.NewReader(sealed[len(recipientMagic):])
+	count, err := reader.ReadByte()
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "[ERROR] sealed object is truncated")
+	}
+	publics := make([][]byte, len(identities))
+	for i, identity := range identities {
+		publics[i], err = Recipient(identity)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	var fileKey []byte
+	for i := 0; i < int(count); i++ {
+		ephemeralPublic := make([]byte, 32)
+		var size [2]byte
+		_, err = io.ReadFull(reader, ephemeralPublic)
+		if err == nil {
+			_, err = io.ReadFull(reader, size[:])
+		}
+		wrapped := make([]byte, binary.LittleEndian.Uint16(size[:]))
+		if err == nil {
+			_, err = io.ReadFull(reader, wrapped)
+		}
+		if err != nil {
+			return nil, false, stacktrace.Propagate(err, "[ERROR] sealed object is truncated")
+		}
+		if fileKey != nil {
+			continue
+		}
+		for j, identity := range identities {
+			wrapKey, err := wrappingKey(identity, ephemeralPublic, ephemeralPublic, publics[j])
+			if err != nil {
+				continue
+			}
+			// the wrapped key only authenticates under the recipient's
+			// wrapping key
+			key, err := Decrypt(wrapKey, wrapped)
+			if err == nil && len(key) == KeySize {
+				fileKey = key
+				break
+			}
+		}
+	}
+	if fileKey == nil {
+		return nil, false, ErrNotRecipient
+	}
+	body := sealed[len(sealed)-reader.Len():]
+	plaintext, err := Decrypt(fileKey, body)
+	return plaintext, IsPadded(body), err
+}
+
+// wrappingKey derives the key a file key is wrapped with from the X25519
+// agreement of scalar and point, bound to the ephemeral public key and the
+// recipient
+func wrappingKey(scalar, point, ephemeralPublic, recipient []byte) ([]byte, error) {
+	if len(scalar) != 32 || len(point) != 32 {
+		return nil, stacktrace.NewError("[ERROR] X25519 keys must be 32 bytes long")
+	}
+	var s, p, shared [32]byte
+	copy(s[:], scalar)
+	copy(p[:], point)
+	curve25519.ScalarMult(&shared, &s, &p)
+	var zero [32]byte
+	if bytes.Equal(shared[:], zero[:]) {
+		return nil, stacktrace.NewError("[ERROR] X25519 agreement with a low order point")
+	}
+	salt := append(append([]byte{}, ephemeralPublic...), recipient...)
+	result := make([]byte, KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared[:], salt, []byte("splitter recipient")), result)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "[ERROR] could not derive wrapping key")
+	}
+	return result, nil
+}
@@ -0,0 +1,18 @@
+// +build linux darwin freebsd
+
+package file
+
+import (
+	"os"
+)
+
+// syncDir flushes the entries of the directory at path, such as a file
+// just renamed into it, to disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,442 @@
+package file
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+)
+
+// VersionsPrefix is the key prefix versioned Storage keeps prior versions
+// of objects under, as [VersionsPrefix/<key>/<version id>]. it is left out
+// of listings of the whole repository
+const VersionsPrefix = ".versions"
+
+// Version describes a prior version of an object
+type Version struct {
+	ID  string
+	Key string
+	// ETag and Size are those of the value, and are empty for versions
+	// whose metadata is lost
+	ETag string
+	Size int64
+	// ModTime is when the version was written, Archived when it was
+	// overwritten or deleted
+	ModTime  time.Time
+	Archived time.Time
+}
+
+// PurgePolicy selects the versions PurgeVersions removes
+type PurgePolicy struct {
+	// MaxAge removes versions archived longer ago than it. zero keeps
+	// versions of any age
+	MaxAge time.Duration
+	// MaxCount removes all but the newest MaxCount versions of every key.
+	// zero keeps any number of them
+	MaxCount int
+	// All removes every version, whatever its age and count
+	All bool
+}
+
+// ListVersions - returns the prior versions of the object at k, oldest
+// first
+func (b *Storage) ListVersions(ctx context.Context, k string) ([]*Version, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Storage :was not initialized")
+		return nil, err
+	}
+	b.permitPool.Acquire()
+	defer b.permitPool.Release()
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	errCh := make(chan error, 1)
+	outCh := make(chan []*Version, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		out, err := b.ListVersionsInternal(ctx, k)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		outCh <- out
+	}()
+	for {
+		select {
+		case out := <-outCh:
+			{
+				return out, nil
+			}
+		case logs := <-b.logCh:
+			{
+				if b.logOps {
+					colorstring.Println(logs)
+				}
+			}
+		case err := <-errCh:
+			{
+				return nil, err
+			}
+		case <-ctx.Done():
+			b.drain(done)
+			err := stacktrace.Propagate(ctx.Err(), "[FATAL] Storage: ListVersions operation error ")
+			return nil, err
+		}
+	}
+}
+
+// GetVersion - returns the version id of the object at k, or nil when
+// there is no such version
+func (b *Storage) GetVersion(ctx context.Context, k, id string) (*Entry, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Storage :was not initialized")
+		return nil, err
+	}
+	if !isVersionID(id) {
+		err := stacktrace.NewError("[ERROR] Storage: GetVersion operation error. invalid version id (%s)", id)
+		return nil, err
+	}
+	b.permitPool.Acquire()
+	defer b.permitPool.Release()
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	errCh := make(chan error, 1)
+	entryCh := make(chan *Entry, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		entry, err := b.getInternal(ctx, k, versionKey(k, id))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		entryCh <- entry
+	}()
+	for {
+		select {
+		case ent := <-entryCh:
+			{
+				return ent, nil
+			}
+		case logs := <-b.logCh:
+			{
+				if b.logOps {
+					colorstring.Println(logs)
+				}
+			}
+		case err := <-errCh:
+			{
+				return nil, err
+			}
+		case <-ctx.Done():
+			b.drain(done)
+			err := stacktrace.Propagate(ctx.Err(), "[FATAL] Storage: GetVersion operation error ")
+			return nil, err
+		}
+	}
+}
+
+// PurgeVersions - removes the prior versions of objects under prefix that
+// policy selects, and returns how many it removed
+func (b *Storage) PurgeVersions(ctx context.Context, prefix string, policy PurgePolicy) (int, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Storage :was not initialized")
+		return 0, err
+	}
+	if b.logOps {
+		start := time.Now()
+		defer func() {
+			duration := fmt.Sprintf("[bold][yellow][INFO] Storage: PurgeVersions operation took (%v) to complete", time.Now().Sub(start))
+			colorstring.Println(duration)
+		}()
+	}
+	versions, err := b.versionIDs(ctx, prefix)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: PurgeVersions operation error ")
+		return 0, err
+	}
+	now := time.Now()
+	removed := 0
+	for key, ids := range versions {
+		sort.Strings(ids)
+		for i, id := range ids {
+			expired := policy.MaxAge > 0 && now.Sub(archivedAt(id)) > policy.MaxAge
+			surplus := policy.MaxCount > 0 && i < len(ids)-policy.MaxCount
+			if !expired && !surplus && !policy.All {
+				continue
+			}
+			err = b.removeVersion(key, id)
+			if err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// RestoreVersions - makes every object under prefix what it was at time
+// at, from its prior versions, and returns how many objects it restored.
+// objects unchanged since then, or first written after it, are left alone.
+// the objects replaced are kept as versions of their own
+func (b *Storage) RestoreVersions(ctx context.Context, prefix string, at time.Time) (int, error) {
+	versions, err := b.versionIDs(ctx, prefix)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: RestoreVersions operation error ")
+		return 0, err
+	}
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	restored := 0
+	for _, key := range keys {
+		out, err := b.ListVersions(ctx, key)
+		if err != nil {
+			return restored, err
+		}
+		// the version current at the time is the first one archived after
+		// it, provided it was written before it. a version replaced one
+		// archived earlier when that one was archived; its ModTime only
+		// tells when the oldest one was written, since rewriting the same
+		// value touches the object without archiving it
+		for i, v := range out {
+			if !v.Archived.After(at) {
+				continue
+			}
+			if i == 0 && v.ModTime.After(at) {
+				break
+			}
+			entry, err := b.GetVersion(ctx, key, v.ID)
+			if err != nil {
+				return restored, err
+			}
+			if entry == nil {
+				break
+			}
+			err = b.Put(ctx, entry)
+			if err != nil {
+				return restored, err
+			}
+			restored++
+			break
+		}
+	}
+	return restored, nil
+}
+
+// versionIDs returns the ids of the versions of objects under prefix,
+// grouped by the key of the object
+func (b *Storage) versionIDs(ctx context.Context, prefix string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	err := b.Walk(ctx, utils.PathJoin(VersionsPrefix, prefix), "", func(info *ObjectInfo) error {
+		key, id := filepath.ToSlash(filepath.Dir(info.Key)), filepath.Base(info.Key)
+		if isVersionID(id) {
+			key = strings.TrimPrefix(key, VersionsPrefix+"/")
+			result[key] = append(result[key], id)
+		}
+		return nil
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not list the versions under (%s)", prefix)
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListVersionsInternal -
+func (b *Storage) ListVersionsInternal(ctx context.Context, key string) ([]*Version, error) {
+	err := b.validatePath(key)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: ListVersions operation error.could not validate entry key (%s) ", key)
+		return nil, err
+	}
+	dir := utils.PathJoin(VersionsPrefix, key)
+	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: ListVersions operation.reading versions of (%s) under (%s)", key, dir)
+	f, err := os.Open(filepath.Join(b.path, dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		err = stacktrace.Propagate(err, "[ERROR] Storage: ListVersions operation error.could not open the versions of (%s)", key)
+		return nil, err
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: ListVersions operation error.could not read the versions of (%s)", key)
+		return nil, err
+	}
+	result := make([]*Version, 0, len(infos))
+	for _, fi := range infos {
+		id := fi.Name()
+		if !fi.Mode().IsRegular() || !isVersionID(id) {
+			continue
+		}
+		v := &Version{
+			ID:       id,
+			Key:      key,
+			ModTime:  fi.ModTime(),
+			Archived: archivedAt(id),
+		}
+		if md := b.readSidecar(key, versionKey(key, id), fi, nil); md != nil {
+			v.ETag = md.ETag
+			v.Size = md.Size
+		}
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+// archive keeps the object at key as a prior version before it is
+// overwritten or deleted. objects whose ETag is etag are not archived, as
+// the write replacing them changes nothing. the object is linked, not
+// moved, so it stays in place until replaced. callers hold the lock of key
+// and treeLock
+func (b *Storage) archive(key, etag string) error {
+	if !b.versioning || strings.HasPrefix(key, VersionsPrefix+"/") || b.isUnversioned(key) {
+		return nil
+	}
+	path, keyExpanded := b.expandPath(key)
+	fullPath := filepath.Join(path, keyExpanded)
+	fi, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not stat (%s) to archive it", fullPath)
+		return err
+	}
+	if len(etag) != 0 {
+		if md := b.readSidecar(key, key, fi, nil); md != nil && md.ETag == etag {
+			return nil
+		}
+	}
+	id, err := newVersionID()
+	if err != nil {
+		return err
+	}
+	at := versionKey(key, id)
+	versionPath, versionExpanded := b.expandPath(at)
+	err = os.MkdirAll(versionPath, 0700)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not make the versions tree at (%s)", versionPath)
+		return err
+	}
+	err = os.Link(fullPath, filepath.Join(versionPath, versionExpanded))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not archive (%s) as version (%s)", key, id)
+		return err
+	}
+	err = os.Link(b.sidecarPath(key), b.sidecarPath(at))
+	if err != nil && !os.IsNotExist(err) {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not archive the metadata of (%s)", key)
+		return err
+	}
+	err = syncDir(versionPath)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not sync directory (%s)", versionPath)
+		return err
+	}
+	b.logCh <- fmt.Sprintf("[yellow][INFO] Storage: archived (%s) as version (%s)", key, id)
+	return nil
+}
+
+// isUnversioned reports whether key is under a prefix whose objects are
+// never kept as versions
+func (b *Storage) isUnversioned(key string) bool {
+	key = strings.TrimPrefix(key, "/")
+	for _, prefix := range b.unversioned {
+		prefix = strings.Trim(prefix, "/")
+		if key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeVersion deletes version id of the object at key
+func (b *Storage) removeVersion(key, id string) error {
+	b.permitPool.Acquire()
+	defer b.permitPool.Release()
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+	at := versionKey(key, id)
+	err := b.removeSidecar(at)
+	if err != nil {
+		return err
+	}
+	path, keyExpanded := b.expandPath(at)
+	fullPath := filepath.Join(path, keyExpanded)
+	err = os.Remove(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not remove version (%s) of (%s)", id, key)
+		return err
+	}
+	b.treeLock.Lock()
+	err = b.cleanupPath(at)
+	b.treeLock.Unlock()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not clean up the versions tree of (%s)", key)
+		return err
+	}
+	return nil
+}
+
+func versionKey(key, id string) string {
+	return utils.PathJoin(VersionsPrefix, key, id)
+}
+
+// newVersionID returns an id made of the current time in nanoseconds and a
+// random suffix, both in hex, so ids sort in the order versions were
+// archived in
+func newVersionID() (string, error) {
+	var suffix [4]byte
+	_, err := rand.Read(suffix[:])
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: could not generate a version id")
+		return "", err
+	}
+	return fmt.Sprintf("%016x%08x", time.Now().UnixNano(), binary.BigEndian.Uint32(suffix[:])), nil
+}
+
+func isVersionID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	_, err := strconv.ParseUint(id[:16], 16, 64)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(id[16:], 16, 32)
+	return err == nil
+}
+
+// archivedAt returns the time version id was archived at
+func archivedAt(id string) time.Time {
+	nanos, _ := strconv.ParseUint(id[:16], 16, 64)
+	return time.Unix(0, int64(nanos))
+}
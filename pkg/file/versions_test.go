@@ -0,0 +1,115 @@
+package file
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// putAt writes value at key, and returns a time after the write and before
+// any later one
+func putAt(t *testing.T, b *Storage, key, value string) time.Time {
+	t.Helper()
+	err := b.Put(context.Background(), &Entry{Key: key, Value: []byte(value)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	return at
+}
+
+func versionValues(t *testing.T, b *Storage, key string) []string {
+	t.Helper()
+	ctx := context.Background()
+	versions, err := b.ListVersions(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, len(versions))
+	for i, v := range versions {
+		entry, err := b.GetVersion(ctx, key, v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || entry.ETag != v.ETag || int64(len(entry.Value)) != v.Size {
+			t.Fatalf("version %s of %s reads %+v", v.ID, key, entry)
+		}
+		result[i] = string(entry.Value)
+	}
+	return result
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	b := newTestStorage(t, WithEncryptionKey(testKey), WithVersioning(), WithUnversionedPrefixes(".keys"))
+	putAt(t, b, "object", "first")
+	second := putAt(t, b, "object", "second")
+	putAt(t, b, "object", "second")
+	putAt(t, b, "object", "third")
+	err := b.Delete(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versionValues(t, b, "object"); len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "third" {
+		t.Fatalf("kept versions %v, want [first second third]", got)
+	}
+	putAt(t, b, ".keys/slot", "old key")
+	putAt(t, b, ".keys/slot", "new key")
+	if got := versionValues(t, b, ".keys/slot"); len(got) != 0 {
+		t.Errorf("kept versions %v of an unversioned key", got)
+	}
+
+	// objects first written after the time are left alone
+	putAt(t, b, "later", "first")
+	putAt(t, b, "later", "second")
+
+	restored, err := b.RestoreVersions(ctx, "", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := b.Get(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 || entry == nil || string(entry.Value) != "second" {
+		t.Fatalf("restored %d objects, object reads %+v, want second", restored, entry)
+	}
+	entry, err = b.Get(ctx, "later")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || string(entry.Value) != "second" {
+		t.Fatalf("restoring to before later was written made it %+v", entry)
+	}
+
+	removed, err := b.PurgeVersions(ctx, "", PurgePolicy{MaxCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versionValues(t, b, "object"); removed != 1 || len(got) != 2 || got[0] != "second" {
+		t.Errorf("purging all but 2 versions removed %d, left %v", removed, got)
+	}
+	removed, err = b.PurgeVersions(ctx, "", PurgePolicy{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("purging versions older than an hour removed %d", removed)
+	}
+	_, err = b.PurgeVersions(ctx, "", PurgePolicy{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versionValues(t, b, "object"); len(got) != 0 {
+		t.Errorf("purging every version left %v", got)
+	}
+	entry, err = b.Get(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || string(entry.Value) != "second" {
+		t.Error("purging versions changed the current object")
+	}
+}
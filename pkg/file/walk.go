@@ -0,0 +1,186 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/palantir/stacktrace"
+)
+
+// DefaultPageSize is the number of objects ListRecursive returns when no
+// page size is given
+const DefaultPageSize = 1000
+
+// errPageFull stops a walk once a page holds as many objects as asked for
+var errPageFull = stacktrace.NewError("[ERROR] page is full")
+
+// WalkKeys - calls fn for every object key stored under prefix on backend,
+// descending into the "directories" List returns. backends implementing
+// Walker are walked in one call
+func WalkKeys(ctx context.Context, backend Backend, prefix string, fn func(key string) error) error {
+	if walker, ok := backend.(Walker); ok {
+		return walker.Walk(ctx, prefix, "", func(info *ObjectInfo) error {
+			return fn(info.Key)
+		})
+	}
+	names, err := backend.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		key := utils.PathJoin(prefix, name)
+		if strings.HasSuffix(name, "/") {
+			err = WalkKeys(ctx, backend, key, fn)
+		} else {
+			err = fn(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk - calls fn, in key order, for every object stored under prefix whose
+// key sorts after startAfter. directories are read one at a time, so memory
+// does not grow with the number of objects, and walking stops at the first
+// error fn returns
+func (b *Storage) Walk(ctx context.Context, prefix, startAfter string, fn func(info *ObjectInfo) error) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Storage :was not initialized")
+		return err
+	}
+	if b.logOps {
+		start := time.Now()
+		defer func() {
+			duration := fmt.Sprintf("[INFO] Storage: Walk operation took (%v) to complete", time.Now().Sub(start))
+			log.Println(duration)
+		}()
+	}
+	err := b.validatePath(prefix)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Walk operation error.could not validate path prefix (%s) ", prefix)
+		return err
+	}
+	dir := strings.Trim(prefix, "/")
+	if dir != "" {
+		dir += "/"
+	}
+	return b.walkDir(ctx, dir, startAfter, fn)
+}
+
+// ListRecursive - returns, in key order, up to limit objects stored under
+// prefix whose key sorts after startAfter. the key of the last object is the
+// cursor of the next page; a page shorter than limit is the last one
+func (b *Storage) ListRecursive(ctx context.Context, prefix, startAfter string, limit int) ([]*ObjectInfo, error) {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	page := make([]*ObjectInfo, 0, limit)
+	err := b.Walk(ctx, prefix, startAfter, func(info *ObjectInfo) error {
+		page = append(page, info)
+		if len(page) == limit {
+			return errPageFull
+		}
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		return nil, err
+	}
+	return page, nil
+}
+
+// walkDir walks the objects under dir, a key prefix ending in a slash or
+// empty. its entries are visited in the order their keys sort in, which
+// keeps the whole walk in key order
+func (b *Storage) walkDir(ctx context.Context, dir, startAfter string, fn func(info *ObjectInfo) error) error {
+	infos, err := b.readDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(infos))
+	byName := make(map[string]os.FileInfo, len(infos))
+	for _, fi := range infos {
+		name := fi.Name()
+		switch {
+		case strings.HasPrefix(name, tempPrefix), strings.HasPrefix(name, metaPrefix):
+			continue
+		case dir == "" && name == VersionsPrefix:
+			// prior versions are not objects
+			continue
+		case fi.IsDir():
+			name += "/"
+		case !fi.Mode().IsRegular():
+			continue
+		}
+		names = append(names, name)
+		byName[name] = fi
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		key := dir + name
+		if strings.HasSuffix(name, "/") {
+			// every key under a directory sorting before the cursor sorts
+			// before it too, unless the cursor is itself under it
+			if key < startAfter && !strings.HasPrefix(startAfter, key) {
+				continue
+			}
+			err = b.walkDir(ctx, key, startAfter, fn)
+		} else {
+			if key <= startAfter {
+				continue
+			}
+			fi := byName[name]
+			err = fn(&ObjectInfo{
+				Key:     key,
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDir returns the entries of the directory holding the objects under
+// dir, with their size and mtime read in the same pass
+func (b *Storage) readDir(dir string) ([]os.FileInfo, error) {
+	b.permitPool.Acquire()
+	defer b.permitPool.Release()
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	path := filepath.Join(b.path, filepath.FromSlash(dir))
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed by a delete since its parent was read
+			return nil, nil
+		}
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Walk operation error.Could not open directory at (%s) ", path)
+		return nil, err
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Storage: Walk operation error. could not read the entries of (%s) ", path)
+		return nil, err
+	}
+	return infos, nil
+}
@@ -0,0 +1,75 @@
+package file
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+	b := newTestStorage(t, WithVersioning())
+	keys := []string{"b/1", "b/2", "b-c", "b0", "c/d/e", "c/f", "d"}
+	for _, key := range keys {
+		err := b.Put(ctx, &Entry{Key: key, Value: []byte(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// prior versions and metadata sidecars are not objects
+	err := b.Put(ctx, &Entry{Key: "d", Value: []byte("overwritten")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := b.ListVersions(ctx, "d")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("overwriting d kept %d versions: %v", len(versions), err)
+	}
+	sort.Strings(keys)
+	for _, limit := range []int{1, 2, 3, len(keys), len(keys) + 1} {
+		walked := []string{}
+		cursor := ""
+		for {
+			page, err := b.ListRecursive(ctx, "", cursor, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range page {
+				walked = append(walked, info.Key)
+			}
+			if len(page) < limit {
+				break
+			}
+			cursor = page[len(page)-1].Key
+		}
+		if !reflect.DeepEqual(walked, keys) {
+			t.Errorf("pages of %d listed %v, want %v", limit, walked, keys)
+		}
+	}
+	for _, c := range []struct {
+		prefix, startAfter string
+		want               []string
+	}{
+		{"", "b/1", []string{"b/2", "b0", "c/d/e", "c/f", "d"}},
+		{"", "c", []string{"c/d/e", "c/f", "d"}},
+		{"", "c/d/e", []string{"c/f", "d"}},
+		{"", "b-", []string{"b-c", "b/1", "b/2", "b0", "c/d/e", "c/f", "d"}},
+		{"c", "", []string{"c/d/e", "c/f"}},
+		{"c", "c/d", []string{"c/d/e", "c/f"}},
+		{"b", "b/1", []string{"b/2"}},
+		{"", "d", []string{}},
+	} {
+		walked := []string{}
+		err := b.Walk(ctx, c.prefix, c.startAfter, func(info *ObjectInfo) error {
+			walked = append(walked, info.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(walked, c.want) {
+			t.Errorf("walking (%s) after (%s) listed %v, want %v", c.prefix, c.startAfter, walked, c.want)
+		}
+	}
+}
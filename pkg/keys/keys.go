@@ -0,0 +1,520 @@
+package keys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/jsonutil"
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/uuid"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Prefix is where key files are stored in a repository. backends must
+// store objects under it unencrypted, since they are read before the data
+// key is known
+const Prefix = ".keys"
+
+const (
+	// Scrypt - derives the master key with scrypt
+	Scrypt = "scrypt"
+	// Argon2id - derives the master key with Argon2id
+	Argon2id = "argon2id"
+)
+
+// Params - the key derivation function turning a passphrase into a master
+// key, and its cost parameters
+type Params struct {
+	KDF  string `json:"kdf" mapstructure:"kdf"`
+	Salt []byte `json:"salt" mapstructure:"salt"`
+	// scrypt
+	N int `json:"n,omitempty" mapstructure:"n"`
+	R int `json:"r,omitempty" mapstructure:"r"`
+	P int `json:"p,omitempty" mapstructure:"p"`
+	// Argon2id. Memory is in KiB
+	Time    uint32 `json:"time,omitempty" mapstructure:"time"`
+	Memory  uint32 `json:"memory,omitempty" mapstructure:"memory"`
+	Threads uint8  `json:"threads,omitempty" mapstructure:"threads"`
+}
+
+// KeyFile - a data key, encrypted with a master key derived from a
+// passphrase, or wrapped by a KeyProvider
+type KeyFile struct {
+	ID      string  `json:"id" mapstructure:"id"`
+	Created int64   `json:"created" mapstructure:"created"`
+	Params  *Params `json:"params" mapstructure:"params"`
+	// Provider is the name of the KeyProvider wrapping the keys of the
+	// slot. slots protected by a passphrase have none
+	Provider string `json:"provider,omitempty" mapstructure:"provider"`
+	// Data is the data key, encrypted with the master key
+	Data []byte `json:"data" mapstructure:"data"`
+	// Naming is the naming key, encrypted with the master key
+	Naming []byte `json:"naming" mapstructure:"naming"`
+	// Signing is the signing policy of the repository. every slot holds it
+	Signing *SigningPolicy `json:"signing" mapstructure:"signing"`
+}
+
+// DefaultParams - recommended cost parameters of kdf. the salt is left for
+// Create to fill in
+func DefaultParams(kdf string) (*Params, error) {
+	switch kdf {
+	case Scrypt:
+		return &Params{KDF: Scrypt, N: 1 << 15, R: 8, P: 1}, nil
+	case Argon2id:
+		return &Params{KDF: Argon2id, Time: 3, Memory: 64 * 1024, Threads: 4}, nil
+	}
+	return nil, stacktrace.NewError("[ERROR] unknown key derivation function (%s)", kdf)
+}
+
+// MasterKey - derives the master key from passphrase
+func (p *Params) MasterKey(passphrase []byte) ([]byte, error) {
+	switch p.KDF {
+	case Scrypt:
+		key, err := scrypt.Key(passphrase, p.Salt, p.N, p.R, p.P, file.KeySize)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] could not derive master key with scrypt")
+			return nil, err
+		}
+		return key, nil
+	case Argon2id:
+		if p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+			return nil, stacktrace.NewError("[ERROR] invalid Argon2id parameters")
+		}
+		return argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, file.KeySize), nil
+	}
+	return nil, stacktrace.NewError("[ERROR] unknown key derivation function (%s)", p.KDF)
+}
+
+// Keyring - the keys objects of a repository are encrypted with. while a
+// rotation is in progress, objects not rotated yet are still encrypted with
+// a fallback key
+type Keyring struct {
+	// Primary encrypts new objects
+	Primary []byte
+	// Fallback decrypts objects Primary cannot
+	Fallback [][]byte
+	// Naming keys the HMAC obfuscated object keys are derived with. it
+	// survives rotations, since objects keep their keys when re-encrypted
+	Naming []byte
+	// slotKey is the data key wrapped by key slots. it only differs from
+	// Primary during a rotation
+	slotKey []byte
+	// provider unlocked the keyring, if it was not a passphrase
+	provider KeyProvider
+	// signing is the signing policy key slots are written with
+	signing *SigningPolicy
+}
+
+// Exists - reports whether the repository on backend holds a key file
+func Exists(ctx context.Context, backend file.Backend) (bool, error) {
+	names, err := list(ctx, backend)
+	if err != nil {
+		return false, err
+	}
+	return len(names) != 0, nil
+}
+
+// Create - generates a random data key and stores it in the first key
+// slot, protected by passphrase. a repository that was encrypted before
+// having key slots passes its current key as dataKey instead
+func Create(ctx context.Context, backend file.Backend, passphrase []byte, params *Params, dataKey []byte) (*Keyring, error) {
+	kr, err := newKeyring(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	_, err = Add(ctx, backend, kr, passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// CreateWithProvider - Create, storing the data key in a key slot wrapped
+// by p instead of a passphrase
+func CreateWithProvider(ctx context.Context, backend file.Backend, p KeyProvider, dataKey []byte) (*Keyring, error) {
+	kr, err := newKeyring(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	kr.provider = p
+	_, err = AddWithProvider(ctx, backend, kr, p)
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// newKeyring returns the keyring of a new repository with data key
+// dataKey, generating one if it is nil
+func newKeyring(dataKey []byte) (*Keyring, error) {
+	if dataKey == nil {
+		dataKey = make([]byte, file.KeySize)
+		_, err := io.ReadFull(rand.Reader, dataKey)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] could not generate data key")
+			return nil, err
+		}
+	}
+	if len(dataKey) != file.KeySize {
+		return nil, stacktrace.NewError("[ERROR] data key must be %d bytes long, got %d", file.KeySize, len(dataKey))
+	}
+	naming, err := NamingKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	signing, err := newSigningPolicy(naming, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{
+		Primary: dataKey,
+		Naming:  naming,
+		slotKey: dataKey,
+		signing: signing,
+	}, nil
+}
+
+// Add - stores the data key of kr in a new key slot protected by
+// passphrase, and returns the id of the slot. a random salt is generated
+// for params
+func Add(ctx context.Context, backend file.Backend, kr *Keyring, passphrase []byte, params *Params) (string, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	err = store(ctx, backend, id, kr.slotKey, kr.Naming, kr.signing, passphrase, params)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// AddWithProvider - stores the data key of kr in a new key slot wrapped by
+// p, and returns the id of the slot
+func AddWithProvider(ctx context.Context, backend file.Backend, kr *Keyring, p KeyProvider) (string, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	err = storeWithProvider(ctx, backend, id, kr.slotKey, kr.Naming, kr.signing, p)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Change - protects the key slot id with a new passphrase
+func Change(ctx context.Context, backend file.Backend, kr *Keyring, id string, passphrase []byte, params *Params) error {
+	return store(ctx, backend, id, kr.slotKey, kr.Naming, kr.signing, passphrase, params)
+}
+
+// Remove - deletes the key slot id. the last key slot cannot be removed,
+// since the repository could not be unlocked anymore
+func Remove(ctx context.Context, backend file.Backend, id string) error {
+	names, err := list(ctx, backend)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, name := range names {
+		if name == id {
+			found = true
+		}
+	}
+	if !found {
+		return stacktrace.NewError("[ERROR] key slot (%s) does not exist", id)
+	}
+	if len(names) == 1 {
+		return stacktrace.NewError("[ERROR] key slot (%s) is the last one and cannot be removed", id)
+	}
+	err = backend.Delete(ctx, utils.PathJoin(Prefix, id))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not delete key slot (%s)", id)
+		return err
+	}
+	return nil
+}
+
+// Slots - returns every key slot of the repository
+func Slots(ctx context.Context, backend file.Backend) ([]*KeyFile, error) {
+	names, err := list(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*KeyFile, 0, len(names))
+	for _, name := range names {
+		kf, err := load(ctx, backend, name)
+		if err != nil {
+			return nil, err
+		}
+		if kf != nil {
+			result = append(result, kf)
+		}
+	}
+	return result, nil
+}
+
+// Unlock - unlocks the first key slot passphrase opens, and returns the
+// keyring of the repository along with the id of the slot. the keyring of
+// a repository with a rotation in progress decrypts with both data keys
+func Unlock(ctx context.Context, backend file.Backend, passphrase []byte) (*Keyring, string, error) {
+	slots, err := Slots(ctx, backend)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(slots) == 0 {
+		return nil, "", stacktrace.NewError("[ERROR] repository has no key file")
+	}
+	for _, kf := range slots {
+		if kf.Params == nil {
+			continue
+		}
+		masterKey, err := kf.Params.MasterKey(passphrase)
+		if err != nil {
+			return nil, "", err
+		}
+		// a wrong passphrase fails authentication of the data key
+		dataKey, err := file.Decrypt(masterKey, kf.Data)
+		if err != nil || len(dataKey) != file.KeySize {
+			continue
+		}
+		naming, err := file.Decrypt(masterKey, kf.Naming)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] could not unlock naming key of key slot (%s)", kf.ID)
+			return nil, "", err
+		}
+		kr, err := openKeyring(ctx, backend, dataKey, naming, slots)
+		if err != nil {
+			return nil, "", err
+		}
+		return kr, kf.ID, nil
+	}
+	return nil, "", stacktrace.NewError("[ERROR] wrong passphrase; no key file could be unlocked")
+}
+
+// UnlockWithProvider - Unlock, unwrapping the first key slot p wrapped
+// instead of using a passphrase
+func UnlockWithProvider(ctx context.Context, backend file.Backend, p KeyProvider) (*Keyring, string, error) {
+	slots, err := Slots(ctx, backend)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(slots) == 0 {
+		return nil, "", stacktrace.NewError("[ERROR] repository has no key file")
+	}
+	var lastErr error
+	for _, kf := range slots {
+		if len(kf.Provider) == 0 {
+			continue
+		}
+		// slots wrapped by another master key fail to unwrap
+		dataKey, err := p.Unwrap(ctx, kf.Data)
+		if err != nil || len(dataKey) != file.KeySize {
+			lastErr = err
+			continue
+		}
+		naming, err := p.Unwrap(ctx, kf.Naming)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] could not unwrap naming key of key slot (%s)", kf.ID)
+			return nil, "", err
+		}
+		kr, err := openKeyring(ctx, backend, dataKey, naming, slots)
+		if err != nil {
+			return nil, "", err
+		}
+		kr.provider = p
+		return kr, kf.ID, nil
+	}
+	if lastErr != nil {
+		return nil, "", stacktrace.Propagate(lastErr, "[ERROR] no key file could be unwrapped with the (%s) key provider", p.Name())
+	}
+	return nil, "", stacktrace.NewError("[ERROR] no key file could be unwrapped with the (%s) key provider", p.Name())
+}
+
+// openKeyring returns the keyring of a key slot holding dataKey and
+// naming, along with the signing policy of slots. the keyring of a
+// repository with a rotation in progress decrypts with both data keys
+func openKeyring(ctx context.Context, backend file.Backend, dataKey, naming []byte, slots []*KeyFile) (*Keyring, error) {
+	signing, err := openSigningPolicy(naming, slots)
+	if err != nil {
+		return nil, err
+	}
+	kr := &Keyring{
+		Primary: dataKey,
+		Naming:  naming,
+		slotKey: dataKey,
+		signing: signing,
+	}
+	rotation, err := loadRotation(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	if rotation != nil {
+		newKey, err := file.Decrypt(dataKey, rotation.Data)
+		// a rotation interrupted after rewrapping this slot leaves it
+		// holding the new key already
+		if err == nil {
+			kr.Primary = newKey
+			kr.Fallback = [][]byte{dataKey}
+		}
+	}
+	return kr, nil
+}
+
+// NamingKey - derives the naming key of a repository from its data key.
+// key slots store it on their own afterwards, so it outlives rotations of
+// the data key
+func NamingKey(dataKey []byte) ([]byte, error) {
+	result := make([]byte, file.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, dataKey, nil, []byte("splitter object names")), result)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not derive naming key")
+		return nil, err
+	}
+	return result, nil
+}
+
+// ConvergenceKey - derives the secret convergent chunk keys are derived
+// with from the naming key, so the two never share a key. like the naming
+// key, it survives rotations of the data key : convergently encrypted
+// chunks keep their content keys, and a rotation does not re-key them
+func (kr *Keyring) ConvergenceKey() ([]byte, error) {
+	if len(kr.Naming) == 0 {
+		return nil, stacktrace.NewError("[ERROR] keyring has no naming key to derive the convergence key from")
+	}
+	result := make([]byte, file.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, kr.Naming, nil, []byte("splitter convergent chunk keys")), result)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not derive convergence key")
+		return nil, err
+	}
+	return result, nil
+}
+
+// store writes dataKey and naming into the key slot id, wrapped with the
+// master key derived from passphrase, along with the signing policy
+func store(ctx context.Context, backend file.Backend, id string, dataKey, naming []byte, signing *SigningPolicy, passphrase []byte, params *Params) error {
+	salt := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not generate salt")
+		return err
+	}
+	p := *params
+	p.Salt = salt
+	masterKey, err := p.MasterKey(passphrase)
+	if err != nil {
+		return err
+	}
+	data, err := file.Encrypt(masterKey, dataKey)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not encrypt data key")
+		return err
+	}
+	wrappedNaming, err := file.Encrypt(masterKey, naming)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not encrypt naming key")
+		return err
+	}
+	return save(ctx, backend, &KeyFile{
+		ID:      id,
+		Created: time.Now().Unix(),
+		Params:  &p,
+		Data:    data,
+		Naming:  wrappedNaming,
+		Signing: signing,
+	})
+}
+
+// storeWithProvider writes dataKey and naming into the key slot id,
+// wrapped by p, along with the signing policy
+func storeWithProvider(ctx context.Context, backend file.Backend, id string, dataKey, naming []byte, signing *SigningPolicy, p KeyProvider) error {
+	data, err := p.Wrap(ctx, dataKey)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not wrap data key with the (%s) key provider", p.Name())
+		return err
+	}
+	wrappedNaming, err := p.Wrap(ctx, naming)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not wrap naming key with the (%s) key provider", p.Name())
+		return err
+	}
+	return save(ctx, backend, &KeyFile{
+		ID:       id,
+		Created:  time.Now().Unix(),
+		Provider: p.Name(),
+		Data:     data,
+		Naming:   wrappedNaming,
+		Signing:  signing,
+	})
+}
+
+// save writes the key slot kf
+func save(ctx context.Context, backend file.Backend, kf *KeyFile) error {
+	id := kf.ID
+	value, err := jsonutil.EncodeJSONWithIndentation(kf)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not encode key file")
+		return err
+	}
+	err = backend.Put(ctx, &file.Entry{
+		Key:   utils.PathJoin(Prefix, id),
+		Value: value,
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not store key file (%s)", id)
+		return err
+	}
+	return nil
+}
+
+// load reads the key slot name
+func load(ctx context.Context, backend file.Backend, name string) (*KeyFile, error) {
+	entry, err := backend.Get(ctx, utils.PathJoin(Prefix, name))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not read key file (%s)", name)
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	kf := &KeyFile{}
+	err = jsonutil.DecodeJSON(entry.Value, kf)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not decode key file (%s)", name)
+		return nil, err
+	}
+	if len(kf.ID) == 0 {
+		kf.ID = name
+	}
+	if len(kf.Naming) == 0 {
+		err = stacktrace.NewError("[ERROR] key file (%s) holds no naming key", name)
+		return nil, err
+	}
+	return kf, nil
+}
+
+// list returns the names of the key slots of the repository
+func list(ctx context.Context, backend file.Backend) ([]string, error) {
+	out, err := backend.List(ctx, Prefix)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not list key files")
+		return nil, err
+	}
+	names := make([]string, 0, len(out))
+	for _, name := range out {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -0,0 +1,49 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestUnlock(t *testing.T) {
+	ctx := context.Background()
+	for _, params := range []*Params{
+		testParams(),
+		{KDF: Argon2id, Time: 1, Memory: 1024, Threads: 1},
+	} {
+		t.Run(params.KDF, func(t *testing.T) {
+			var salts [][]byte
+			for i := 0; i < 2; i++ {
+				backend := newTestBackend(t)
+				p := *params
+				kr, err := Create(ctx, backend, testPassphrase, &p, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				slots, err := Slots(ctx, backend)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(slots) != 1 || slots[0].Params.KDF != params.KDF {
+					t.Fatalf("created key slots %+v", slots)
+				}
+				salts = append(salts, slots[0].Params.Salt)
+				unlocked, _, err := Unlock(ctx, backend, testPassphrase)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(unlocked.Primary, kr.Primary) || !bytes.Equal(unlocked.Naming, kr.Naming) {
+					t.Error("the passphrase unlocked other keys than those created")
+				}
+				_, _, err = Unlock(ctx, backend, []byte("wrong"))
+				if err == nil {
+					t.Error("a wrong passphrase unlocked the repository")
+				}
+			}
+			if len(salts[0]) == 0 || bytes.Equal(salts[0], salts[1]) {
+				t.Errorf("repositories share the salt %x", salts[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/jsonutil"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/palantir/stacktrace"
+)
+
+// KeyProvider - holds the master key key slots wrap the data key with.
+// keys are wrapped and unwrapped through the provider, envelope style, so
+// the master key never has to leave it, as with a KMS
+type KeyProvider interface {
+	// Name identifies the kind of provider protecting a key slot
+	Name() string
+	// Wrap encrypts plaintext with the master key
+	Wrap(ctx context.Context, plaintext []byte) ([]byte, error)
+	// Unwrap decrypts what Wrap returned
+	Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// localProvider wraps keys in process with a master key loaded once
+type localProvider struct {
+	name string
+	load func(ctx context.Context) (string, error)
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+// NewFileProvider - a provider reading the hex encoded master key from the
+// file at path
+func NewFileProvider(path string) KeyProvider {
+	return &localProvider{
+		name: "file",
+		load: func(ctx context.Context) (string, error) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				err = stacktrace.Propagate(err, "[ERROR] could not read master key file (%s)", path)
+				return "", err
+			}
+			return string(data), nil
+		},
+	}
+}
+
+// NewEnvProvider - a provider reading the hex encoded master key from the
+// environment variable name
+func NewEnvProvider(name string) KeyProvider {
+	return &localProvider{
+		name: "env",
+		load: func(ctx context.Context) (string, error) {
+			value := os.Getenv(name)
+			if len(value) == 0 {
+				return "", stacktrace.NewError("[ERROR] environment variable (%s) holding the master key is not set", name)
+			}
+			return value, nil
+		},
+	}
+}
+
+// NewCommandProvider - a provider running command, split on whitespace,
+// and reading the hex encoded master key from its output. password
+// managers and hardware token helpers can hand the key out this way
+func NewCommandProvider(command string) KeyProvider {
+	return &localProvider{
+		name: "command",
+		load: func(ctx context.Context) (string, error) {
+			args := strings.Fields(command)
+			if len(args) == 0 {
+				return "", stacktrace.NewError("[ERROR] master key command is empty")
+			}
+			cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+			cmd.Stderr = os.Stderr
+			out, err := cmd.Output()
+			if err != nil {
+				err = stacktrace.Propagate(err, "[ERROR] master key command (%s) failed", args[0])
+				return "", err
+			}
+			return string(out), nil
+		},
+	}
+}
+
+// Name ...
+func (p *localProvider) Name() string {
+	return p.name
+}
+
+// Wrap ...
+func (p *localProvider) Wrap(ctx context.Context, plaintext []byte) ([]byte, error) {
+	key, err := p.masterKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return file.Encrypt(key, plaintext)
+}
+
+// Unwrap ...
+func (p *localProvider) Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	key, err := p.masterKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return file.Decrypt(key, ciphertext)
+}
+
+func (p *localProvider) masterKey(ctx context.Context) ([]byte, error) {
+	p.once.Do(func() {
+		var value string
+		value, p.err = p.load(ctx)
+		if p.err == nil {
+			p.key, p.err = file.ParseKey(value)
+		}
+		if p.err != nil {
+			p.err = stacktrace.Propagate(p.err, "[ERROR] could not load master key from the (%s) key provider", p.name)
+		}
+	})
+	return p.key, p.err
+}
+
+// kmsRequest is the body of requests to the wrap and unwrap endpoints of
+// a KMS. byte slices are base64 encoded
+type kmsRequest struct {
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+// kmsResponse is the body of responses of a KMS
+type kmsResponse struct {
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// httpProvider wraps keys with a KMS over http
+type httpProvider struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewHTTPProvider - a provider wrapping keys with the KMS at url. keys are
+// wrapped by posting {"plaintext"} to <url>/wrap, which answers with
+// {"ciphertext"}, and unwrapped by posting {"ciphertext"} to <url>/unwrap,
+// which answers with {"plaintext"}. the token, if any, is sent as a bearer
+// token
+func NewHTTPProvider(url, token string) KeyProvider {
+	return &httpProvider{
+		url:    strings.TrimRight(url, "/"),
+		token:  token,
+		client: &http.Client{},
+	}
+}
+
+// Name ...
+func (p *httpProvider) Name() string {
+	return "http"
+}
+
+// Wrap ...
+func (p *httpProvider) Wrap(ctx context.Context, plaintext []byte) ([]byte, error) {
+	resp, err := p.call(ctx, "wrap", &kmsRequest{Plaintext: plaintext})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+// Unwrap ...
+func (p *httpProvider) Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	resp, err := p.call(ctx, "unwrap", &kmsRequest{Ciphertext: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+func (p *httpProvider) call(ctx context.Context, endpoint string, body *kmsRequest) (*kmsResponse, error) {
+	payload, err := jsonutil.EncodeJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url+"/"+endpoint, bytes.NewReader(payload))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not create KMS request")
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if len(p.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KMS request to (%s) failed", req.URL)
+		return nil, err
+	}
+	defer res.Body.Close()
+	resp := &kmsResponse{}
+	err = jsonutil.DecodeJSONFromReader(res.Body, resp)
+	if res.StatusCode != http.StatusOK {
+		return nil, stacktrace.NewError("[ERROR] KMS (%s) answered with status (%d) : %s", req.URL, res.StatusCode, resp.Error)
+	}
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not decode KMS response")
+		return nil, err
+	}
+	return resp, nil
+}
+
+// NewKMSHandler - an http.Handler serving the protocol NewHTTPProvider
+// speaks, wrapping keys with masterKey. it stands in for a real KMS in
+// development and tests; requests must carry token when it is not empty
+func NewKMSHandler(masterKey []byte, token string) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(fn func(req *kmsRequest) (*kmsResponse, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			status := http.StatusOK
+			resp := &kmsResponse{}
+			req := &kmsRequest{}
+			err := jsonutil.DecodeJSONFromReader(r.Body, req)
+			switch {
+			case r.Method != http.MethodPost:
+				status, resp.Error = http.StatusMethodNotAllowed, "method not allowed"
+			case len(token) != 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1:
+				status, resp.Error = http.StatusUnauthorized, "unauthorized"
+			case err != nil:
+				status, resp.Error = http.StatusBadRequest, "malformed request"
+			default:
+				resp, err = fn(req)
+				if err != nil {
+					status, resp = http.StatusBadRequest, &kmsResponse{Error: "could not unwrap key"}
+				}
+			}
+			w.WriteHeader(status)
+			w.Write(jsonutil.EncodeJSONWithoutErr(resp))
+		}
+	}
+	mux.Handle("/wrap", handle(func(req *kmsRequest) (*kmsResponse, error) {
+		ciphertext, err := file.Encrypt(masterKey, req.Plaintext)
+		return &kmsResponse{Ciphertext: ciphertext}, err
+	}))
+	mux.Handle("/unwrap", handle(func(req *kmsRequest) (*kmsResponse, error) {
+		plaintext, err := file.Decrypt(masterKey, req.Ciphertext)
+		return &kmsResponse{Plaintext: plaintext}, err
+	}))
+	return mux
+}
+
+// cachedProvider remembers the keys it unwrapped
+type cachedProvider struct {
+	KeyProvider
+	lock      sync.Mutex
+	unwrapped map[string][]byte
+}
+
+// NewCachedProvider - remembers the keys p unwraps in memory, so they are
+// only unwrapped once, for as long as the returned provider is used
+func NewCachedProvider(p KeyProvider) KeyProvider {
+	return &cachedProvider{
+		KeyProvider: p,
+		unwrapped:   make(map[string][]byte),
+	}
+}
+
+// Unwrap ...
+func (p *cachedProvider) Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if plaintext, ok := p.unwrapped[string(ciphertext)]; ok {
+		return plaintext, nil
+	}
+	plaintext, err := p.KeyProvider.Unwrap(ctx, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	p.unwrapped[string(ciphertext)] = plaintext
+	return plaintext, nil
+}
@@ -0,0 +1,82 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPProvider(t *testing.T) {
+	ctx := context.Background()
+	master := bytes.Repeat([]byte{0x24}, 32)
+	server := httptest.NewServer(NewKMSHandler(master, "token"))
+	defer server.Close()
+	backend := newTestBackend(t)
+	kr, err := CreateWithProvider(ctx, backend, NewHTTPProvider(server.URL, "token"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots, err := Slots(ctx, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 1 || slots[0].Params != nil || len(slots[0].Provider) == 0 {
+		t.Fatalf("created key slots %+v", slots)
+	}
+	if bytes.Contains(readSlot(t, backend, slots[0].ID), []byte(base64.StdEncoding.EncodeToString(kr.Primary))) {
+		t.Fatal("the key slot holds the data key in the clear")
+	}
+	unlocked, _, err := UnlockWithProvider(ctx, backend, NewHTTPProvider(server.URL, "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unlocked.Primary, kr.Primary) || !bytes.Equal(unlocked.Naming, kr.Naming) {
+		t.Error("the provider unwrapped other keys than those created")
+	}
+	_, _, err = UnlockWithProvider(ctx, backend, NewHTTPProvider(server.URL, "wrong"))
+	if err == nil {
+		t.Error("the key management service served a wrong token")
+	}
+	other := httptest.NewServer(NewKMSHandler(bytes.Repeat([]byte{0x25}, 32), "token"))
+	defer other.Close()
+	_, _, err = UnlockWithProvider(ctx, backend, NewHTTPProvider(other.URL, "token"))
+	if err == nil {
+		t.Error("another master key unwrapped the key slot")
+	}
+	_, _, err = Unlock(ctx, backend, testPassphrase)
+	if err == nil {
+		t.Error("a passphrase unlocked a key slot wrapped by a provider")
+	}
+}
+
+// slots wrapped by a provider and protected by a passphrase hold the same
+// keys
+func TestFileProvider(t *testing.T) {
+	ctx := context.Background()
+	backend, kr := newTestRepository(t)
+	path := filepath.Join(backend.Path(), "master.key")
+	err := ioutil.WriteFile(path, []byte(hex.EncodeToString(bytes.Repeat([]byte{0x24}, 32))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = AddWithProvider(ctx, backend, kr, NewFileProvider(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlocked, _, err := UnlockWithProvider(ctx, backend, NewFileProvider(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unlocked.Primary, kr.Primary) {
+		t.Error("the provider and the passphrase unlock different data keys")
+	}
+	_, _, err = UnlockWithProvider(ctx, backend, NewFileProvider(filepath.Join(backend.Path(), "missing")))
+	if err == nil {
+		t.Error("a provider without a master key unwrapped a key slot")
+	}
+}
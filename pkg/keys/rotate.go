@@ -0,0 +1,249 @@
+package keys
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/jsonutil"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/palantir/stacktrace"
+)
+
+// rotationKey is where the state of the rotation in progress is stored. it
+// is nested one level down so it is never listed as a key slot
+const rotationKey = Prefix + "/rotation/state"
+
+// checkpointInterval is the number of objects rotated between two saves
+// of the rotation state
+const checkpointInterval = 64
+
+// Rotation - state of a data key rotation, persisted so an interrupted
+// rotation resumes where it stopped
+type Rotation struct {
+	Started int64 `json:"started" mapstructure:"started"`
+	// Data is the new data key, encrypted with the one key slots wrap
+	Data []byte `json:"data" mapstructure:"data"`
+	// Cursor is the last object rotated. objects are rotated in the
+	// lexical order of their keys
+	Cursor  string `json:"cursor" mapstructure:"cursor"`
+	Rotated int    `json:"rotated" mapstructure:"rotated"`
+}
+
+// StartRotation - begins rotating the repository to a new random data key,
+// and returns the keyring to open the repository with while it runs. a
+// rotation already in progress is resumed instead; kr, as returned by
+// Unlock, already holds its keys. repositories holding prior versions of
+// objects are refused with ErrVersionsKept
+func StartRotation(ctx context.Context, backend file.Backend, kr *Keyring) (*Keyring, error) {
+	rotation, err := loadRotation(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	if rotation != nil {
+		return kr, nil
+	}
+	err = checkNoVersions(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	newKey := make([]byte, file.KeySize)
+	_, err = io.ReadFull(rand.Reader, newKey)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not generate data key")
+		return nil, err
+	}
+	data, err := file.Encrypt(kr.slotKey, newKey)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not encrypt new data key")
+		return nil, err
+	}
+	err = saveRotation(ctx, backend, &Rotation{
+		Started: time.Now().Unix(),
+		Data:    data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{
+		Primary:  newKey,
+		Fallback: [][]byte{kr.slotKey},
+		Naming:   kr.Naming,
+		slotKey:  kr.slotKey,
+		provider: kr.provider,
+		signing:  kr.signing,
+	}, nil
+}
+
+// ErrVersionsKept is returned when a rotation is asked of a repository
+// holding prior versions of objects, which would keep the old data key
+// useful
+var ErrVersionsKept = stacktrace.NewError("[ERROR] repository holds prior versions of objects, sealed with the old data key; purge them first")
+
+// Rotate - re-encrypts every object of backend under the given prefixes
+// with the new data key, checkpointing its progress. backend must be opened
+// with kr. repositories holding prior versions of objects are refused, and
+// objects are replaced without being kept as versions, since those would
+// stay sealed with the old data key. once every object is rotated, key slot id is rewrapped for the
+// new data key with passphrase, or the key provider that unlocked kr, and
+// every other key slot is removed, since their passphrases are not known.
+// it returns the number of objects rotated by this call
+func Rotate(ctx context.Context, backend file.Backend, kr *Keyring, id string, passphrase []byte, prefixes ...string) (int, error) {
+	rotation, err := loadRotation(ctx, backend)
+	if err != nil {
+		return 0, err
+	}
+	if rotation == nil {
+		return 0, stacktrace.NewError("[ERROR] no rotation is in progress")
+	}
+	err = checkNoVersions(ctx, backend)
+	if err != nil {
+		return 0, err
+	}
+	put := backend.Put
+	if versioner, ok := backend.(file.Versioner); ok {
+		put = versioner.PutUnversioned
+	}
+	rotated := 0
+	// walking prefixes in order visits keys in lexical order, which the
+	// cursor relies on
+	prefixes = append([]string{}, prefixes...)
+	sort.Strings(prefixes)
+	fn := func(key string) error {
+		if strings.HasPrefix(key, Prefix+"/") || key <= rotation.Cursor {
+			return nil
+		}
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		entry, err := backend.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			err = put(ctx, entry)
+			if err != nil {
+				return err
+			}
+		}
+		rotation.Cursor = key
+		rotation.Rotated++
+		rotated++
+		if rotated%checkpointInterval == 0 {
+			return saveRotation(ctx, backend, rotation)
+		}
+		return nil
+	}
+	for _, prefix := range prefixes {
+		err = file.WalkKeys(ctx, backend, prefix, fn)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		saveErr := saveRotation(context.Background(), backend, rotation)
+		if saveErr != nil {
+			return rotated, saveErr
+		}
+		err = stacktrace.Propagate(err, "[ERROR] rotation stopped after (%s); run it again to resume", rotation.Cursor)
+		return rotated, err
+	}
+	slots, err := Slots(ctx, backend)
+	if err != nil {
+		return rotated, err
+	}
+	var own *KeyFile
+	for _, kf := range slots {
+		if kf.ID == id {
+			own = kf
+			continue
+		}
+		err = Remove(ctx, backend, kf.ID)
+		if err != nil {
+			return rotated, err
+		}
+	}
+	switch {
+	case own == nil:
+		return rotated, stacktrace.NewError("[ERROR] key slot (%s) does not exist", id)
+	case len(own.Provider) != 0 && kr.provider != nil:
+		err = storeWithProvider(ctx, backend, id, kr.Primary, kr.Naming, kr.signing, kr.provider)
+	case own.Params != nil && passphrase != nil:
+		err = store(ctx, backend, id, kr.Primary, kr.Naming, kr.signing, passphrase, own.Params)
+	default:
+		err = stacktrace.NewError("[ERROR] key slot (%s) was not unlocked by kr", id)
+	}
+	if err != nil {
+		return rotated, err
+	}
+	err = backend.Delete(ctx, rotationKey)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not delete rotation state")
+		return rotated, err
+	}
+	return rotated, nil
+}
+
+// checkNoVersions fails with ErrVersionsKept when backend holds any prior
+// version of an object
+func checkNoVersions(ctx context.Context, backend file.Backend) error {
+	found := false
+	// walking stops at the first version found
+	err := file.WalkKeys(ctx, backend, file.VersionsPrefix, func(key string) error {
+		found = true
+		return ErrVersionsKept
+	})
+	if found {
+		return ErrVersionsKept
+	}
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not list prior versions of objects")
+		return err
+	}
+	return nil
+}
+
+// RotationInProgress - returns the state of the rotation in progress, or
+// nil
+func RotationInProgress(ctx context.Context, backend file.Backend) (*Rotation, error) {
+	return loadRotation(ctx, backend)
+}
+
+func loadRotation(ctx context.Context, backend file.Backend) (*Rotation, error) {
+	entry, err := backend.Get(ctx, rotationKey)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not read rotation state")
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	rotation := &Rotation{}
+	err = jsonutil.DecodeJSON(entry.Value, rotation)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not decode rotation state")
+		return nil, err
+	}
+	return rotation, nil
+}
+
+func saveRotation(ctx context.Context, backend file.Backend, rotation *Rotation) error {
+	value, err := jsonutil.EncodeJSONWithIndentation(rotation)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not encode rotation state")
+		return err
+	}
+	err = backend.Put(ctx, &file.Entry{
+		Key:   rotationKey,
+		Value: value,
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not store rotation state")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+// openRepository opens the repository backend stores keys in with kr, the
+// way the command line does
+func openRepository(t *testing.T, backend *file.Storage, kr *Keyring, opts ...file.Option) *file.Storage {
+	t.Helper()
+	opts = append([]file.Option{
+		file.WithPath(backend.Path()),
+		file.WithPlaintextPrefixes(Prefix),
+		file.WithEncryptionKey(kr.Primary),
+		file.WithFallbackKeys(kr.Fallback...),
+	}, opts...)
+	b := file.New(opts...)
+	err := b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// rotations must not leave objects sealed with the old data key behind as
+// prior versions
+func TestRotateVersioned(t *testing.T) {
+	ctx := context.Background()
+	backend, kr := newTestRepository(t)
+	versioned := []file.Option{file.WithVersioning(), file.WithUnversionedPrefixes(Prefix)}
+	repository := openRepository(t, backend, kr, versioned...)
+	for _, value := range []string{"first", "second"} {
+		err := repository.Put(ctx, &file.Entry{Key: "objects/object", Value: []byte(value)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := StartRotation(ctx, backend, kr)
+	if err != ErrVersionsKept {
+		t.Fatalf("a rotation started with prior versions kept: %v", err)
+	}
+	_, err = repository.PurgeVersions(ctx, "", file.PurgePolicy{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotating, err := StartRotation(ctx, backend, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository = openRepository(t, backend, rotating, versioned...)
+	_, slot, err := Unlock(ctx, backend, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := Rotate(ctx, repository, rotating, slot, testPassphrase, "objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("rotated %d objects, want 1", n)
+	}
+	versions, err := repository.ListVersions(ctx, "objects/object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("rotation kept %d versions sealed with the old data key", len(versions))
+	}
+	rotated, _, err := Unlock(ctx, backend, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := openRepository(t, backend, &Keyring{Primary: rotated.Primary}).Get(ctx, "objects/object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || string(entry.Value) != "second" {
+		t.Fatalf("read %v after the rotation, want second", entry)
+	}
+}
+
+// interrupting is a repository that cancels a rotation after reading a
+// given number of objects
+type interrupting struct {
+	*file.Storage
+	left   int
+	cancel context.CancelFunc
+}
+
+func (b *interrupting) Get(ctx context.Context, key string) (*file.Entry, error) {
+	b.left--
+	if b.left == 0 {
+		b.cancel()
+	}
+	return b.Storage.Get(ctx, key)
+}
+
+func TestRotateResume(t *testing.T) {
+	ctx := context.Background()
+	backend, kr := newTestRepository(t)
+	_, err := Add(ctx, backend, kr, []byte("second"), testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository := openRepository(t, backend, kr)
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("objects/%03d", i)
+		err = repository.Put(ctx, &file.Entry{Key: keys[i], Value: []byte(keys[i])})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotating, err := StartRotation(ctx, backend, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, slot, err := Unlock(ctx, backend, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted, cancel := context.WithCancel(ctx)
+	defer cancel()
+	first, err := Rotate(interrupted, &interrupting{openRepository(t, backend, rotating), 70, cancel}, rotating, slot, testPassphrase, "objects")
+	if err == nil {
+		t.Fatal("an interrupted rotation completed")
+	}
+	rotation, err := RotationInProgress(ctx, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation == nil || rotation.Cursor != keys[first-1] || rotation.Rotated != first {
+		t.Fatalf("rotated %d objects, saved %+v", first, rotation)
+	}
+
+	// the keyring unlocked meanwhile reads objects under either key
+	resumed, _, err := Unlock(ctx, backend, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, err = StartRotation(ctx, backend, resumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Rotate(ctx, openRepository(t, backend, resumed), resumed, slot, testPassphrase, "objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first+second != len(keys) {
+		t.Errorf("rotated %d then %d of %d objects", first, second, len(keys))
+	}
+	slots, err := Slots(ctx, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 1 || slots[0].ID != slot {
+		t.Errorf("key slots %+v are left after the rotation", slots)
+	}
+	rotated, _, err := Unlock(ctx, backend, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rotated.Primary, kr.Primary) || len(rotated.Fallback) != 0 {
+		t.Fatal("the rotation kept the old data key")
+	}
+	current := openRepository(t, backend, rotated)
+	old := openRepository(t, backend, &Keyring{Primary: kr.Primary})
+	for _, key := range keys {
+		entry, err := current.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || string(entry.Value) != key {
+			t.Fatalf("%s was lost by the rotation", key)
+		}
+		_, err = old.Get(ctx, key)
+		if err == nil {
+			t.Fatalf("%s can still be read with the old data key", key)
+		}
+	}
+}
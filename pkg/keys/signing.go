@@ -0,0 +1,197 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrSigningKeysTampered is returned when the signing policy of a key slot
+// was not written by a holder of the keyring
+var ErrSigningKeysTampered = stacktrace.NewError("[ERROR] signing policy does not match its MAC; it was changed without the repository key")
+
+// SigningPolicy - the public keys snapshot manifests must be signed with.
+// a policy trusting no key accepts unsigned manifests. every key slot holds
+// a copy, authenticated with a key derived from the naming key, so the
+// policy cannot be changed without the keyring, nor removed without making
+// the repository unreadable. Version grows with every change and the
+// highest version any slot holds wins, so rolling back one slot to an
+// older copy does not bring back keys that were distrusted since
+type SigningPolicy struct {
+	Version uint64   `json:"version" mapstructure:"version"`
+	Keys    [][]byte `json:"keys" mapstructure:"keys"`
+	MAC     []byte   `json:"mac" mapstructure:"mac"`
+}
+
+// SigningKeys - returns the public keys the repository trusts to sign
+// snapshot manifests, without authenticating them. hosts without the
+// keyring use it to check what they write; readers use the keys of the
+// keyring
+func SigningKeys(ctx context.Context, backend file.Backend) ([]ed25519.PublicKey, error) {
+	slots, err := Slots(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+	var latest *SigningPolicy
+	for _, kf := range slots {
+		if kf.Signing != nil && (latest == nil || kf.Signing.Version > latest.Version) {
+			latest = kf.Signing
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	return publicKeys(latest.Keys), nil
+}
+
+// SigningKeys - returns the public keys the repository trusts to sign
+// snapshot manifests, as authenticated when kr was unlocked. a repository
+// trusting no key returns none
+func (kr *Keyring) SigningKeys() []ed25519.PublicKey {
+	if kr.signing == nil {
+		return nil
+	}
+	return publicKeys(kr.signing.Keys)
+}
+
+// TrustSigningKey - adds key to the public keys the repository trusts to
+// sign snapshot manifests. once one is trusted, manifests signed by no
+// trusted key are refused
+func TrustSigningKey(ctx context.Context, backend file.Backend, kr *Keyring, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return stacktrace.NewError("[ERROR] signing key must be %d bytes long, got %d", ed25519.PublicKeySize, len(key))
+	}
+	current := kr.SigningKeys()
+	for _, k := range current {
+		if bytes.Equal(k, key) {
+			return nil
+		}
+	}
+	return updateSigningPolicy(ctx, backend, kr, append(current, key))
+}
+
+// DistrustSigningKey - removes key from the public keys the repository
+// trusts to sign snapshot manifests. the last one cannot be removed, since
+// that would let unsigned manifests through again
+func DistrustSigningKey(ctx context.Context, backend file.Backend, kr *Keyring, key ed25519.PublicKey) error {
+	current := kr.SigningKeys()
+	remaining := make([]ed25519.PublicKey, 0, len(current))
+	for _, k := range current {
+		if !bytes.Equal(k, key) {
+			remaining = append(remaining, k)
+		}
+	}
+	if len(remaining) == len(current) {
+		return stacktrace.NewError("[ERROR] signing key is not trusted by the repository")
+	}
+	if len(remaining) == 0 {
+		return stacktrace.NewError("[ERROR] the last trusted signing key cannot be removed")
+	}
+	return updateSigningPolicy(ctx, backend, kr, remaining)
+}
+
+// updateSigningPolicy writes a new version of the signing policy of kr,
+// trusting keys, into every key slot
+func updateSigningPolicy(ctx context.Context, backend file.Backend, kr *Keyring, keys []ed25519.PublicKey) error {
+	if kr.signing == nil {
+		return stacktrace.NewError("[ERROR] repository has no key slot to store trusted signing keys in. run [splitter init] first")
+	}
+	raw := make([][]byte, len(keys))
+	for i, key := range keys {
+		raw[i] = key
+	}
+	policy, err := newSigningPolicy(kr.Naming, kr.signing.Version+1, raw)
+	if err != nil {
+		return err
+	}
+	slots, err := Slots(ctx, backend)
+	if err != nil {
+		return err
+	}
+	for _, kf := range slots {
+		kf.Signing = policy
+		err = save(ctx, backend, kf)
+		if err != nil {
+			return err
+		}
+	}
+	kr.signing = policy
+	return nil
+}
+
+// openSigningPolicy returns the newest signing policy slots hold, once
+// authenticated with naming. every slot must hold one
+func openSigningPolicy(naming []byte, slots []*KeyFile) (*SigningPolicy, error) {
+	var latest *SigningPolicy
+	for _, kf := range slots {
+		if kf.Signing == nil {
+			return nil, stacktrace.NewError("[ERROR] key slot (%s) holds no signing policy", kf.ID)
+		}
+		mac, err := signingMAC(naming, kf.Signing.Version, kf.Signing.Keys)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(mac, kf.Signing.MAC) {
+			return nil, stacktrace.Propagate(ErrSigningKeysTampered, "[ERROR] signing policy of key slot (%s) cannot be trusted", kf.ID)
+		}
+		if latest == nil || kf.Signing.Version > latest.Version {
+			latest = kf.Signing
+		}
+	}
+	if latest == nil {
+		return nil, stacktrace.NewError("[ERROR] repository has no key slot holding a signing policy")
+	}
+	return latest, nil
+}
+
+func newSigningPolicy(naming []byte, version uint64, keys [][]byte) (*SigningPolicy, error) {
+	mac, err := signingMAC(naming, version, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningPolicy{
+		Version: version,
+		Keys:    keys,
+		MAC:     mac,
+	}, nil
+}
+
+// signingMAC authenticates a signing policy with a key derived from the
+// naming key, which outlives rotations of the data key
+func signingMAC(naming []byte, version uint64, keys [][]byte) ([]byte, error) {
+	if len(naming) == 0 {
+		return nil, stacktrace.NewError("[ERROR] the repository key is needed to authenticate trusted signing keys")
+	}
+	macKey := make([]byte, file.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, naming, nil, []byte("splitter signing policy")), macKey)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not derive signing policy MAC key")
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	var field [8]byte
+	binary.BigEndian.PutUint64(field[:], version)
+	mac.Write(field[:])
+	for _, key := range keys {
+		binary.BigEndian.PutUint64(field[:], uint64(len(key)))
+		mac.Write(field[:])
+		mac.Write(key)
+	}
+	return mac.Sum(nil), nil
+}
+
+func publicKeys(raw [][]byte) []ed25519.PublicKey {
+	result := make([]ed25519.PublicKey, len(raw))
+	for i, key := range raw {
+		result[i] = ed25519.PublicKey(key)
+	}
+	return result
+}
@@ -0,0 +1,141 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"golang.org/x/crypto/ed25519"
+)
+
+var testPassphrase = []byte("passphrase")
+
+func newTestBackend(t *testing.T) *file.Storage {
+	t.Helper()
+	path, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	b := file.New(file.WithPath(path))
+	err = b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testParams are cheap scrypt parameters, so tests unlock quickly
+func testParams() *Params {
+	return &Params{KDF: Scrypt, N: 1 << 10, R: 8, P: 1}
+}
+
+func newTestRepository(t *testing.T) (*file.Storage, *Keyring) {
+	t.Helper()
+	backend := newTestBackend(t)
+	kr, err := Create(context.Background(), backend, testPassphrase, testParams(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, kr
+}
+
+func newSigningKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public
+}
+
+func readSlot(t *testing.T, backend file.Backend, id string) []byte {
+	t.Helper()
+	entry, err := backend.Get(context.Background(), utils.PathJoin(Prefix, id))
+	if err != nil || entry == nil {
+		t.Fatalf("could not read key slot (%s): %v", id, err)
+	}
+	return entry.Value
+}
+
+func writeSlot(t *testing.T, backend file.Backend, id string, value []byte) {
+	t.Helper()
+	err := backend.Put(context.Background(), &file.Entry{Key: utils.PathJoin(Prefix, id), Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSigningPolicy(t *testing.T) {
+	ctx := context.Background()
+	backend, kr := newTestRepository(t)
+	_, err := Add(ctx, backend, kr, []byte("second"), testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, firstID, err := Unlock(ctx, backend, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.SigningKeys()) != 0 {
+		t.Fatal("a new repository trusts signing keys")
+	}
+	before := readSlot(t, backend, firstID)
+	key, other := newSigningKey(t), newSigningKey(t)
+	for _, k := range []ed25519.PublicKey{key, other} {
+		err = TrustSigningKey(ctx, backend, kr, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = DistrustSigningKey(ctx, backend, kr, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DistrustSigningKey(ctx, backend, kr, key)
+	if err == nil {
+		t.Fatal("the last trusted signing key was removed")
+	}
+	for _, passphrase := range [][]byte{testPassphrase, []byte("second")} {
+		unlocked, _, err := Unlock(ctx, backend, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted := unlocked.SigningKeys()
+		if len(trusted) != 1 || !bytes.Equal(trusted[0], key) {
+			t.Fatalf("slot trusts %x, want only %x", trusted, key)
+		}
+	}
+	after := readSlot(t, backend, firstID)
+
+	// a slot rolled back to a copy trusting nothing is outvoted by the
+	// other slot
+	writeSlot(t, backend, firstID, before)
+	unlocked, _, err := Unlock(ctx, backend, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unlocked.SigningKeys()) != 1 {
+		t.Fatal("a rolled back key slot reverted the signing policy")
+	}
+
+	// a slot whose policy was removed or changed cannot be unlocked
+	writeSlot(t, backend, firstID, bytes.Replace(after, []byte(`"signing"`), []byte(`"removed"`), 1))
+	_, _, err = Unlock(ctx, backend, []byte("second"))
+	if err == nil {
+		t.Fatal("a key slot without a signing policy was accepted")
+	}
+	tampered := make([]byte, len(after))
+	copy(tampered, after)
+	i := bytes.Index(tampered, []byte(`"version": `)) + len(`"version": `)
+	tampered[i] = '7'
+	writeSlot(t, backend, firstID, tampered)
+	_, _, err = Unlock(ctx, backend, []byte("second"))
+	if err == nil {
+		t.Fatal("a key slot with a forged signing policy was accepted")
+	}
+}
@@ -0,0 +1,537 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactionTxSize is the number of bytes copied per transaction while
+// compacting, so a compaction never holds the whole database in memory
+const compactionTxSize = 64 << 20
+
+// New - constructs a new key-value Storage
+func New(opts ...Option) *Storage {
+	result := &Storage{}
+	for _, opt := range opts {
+		opt(result)
+	}
+	if len(result.bucket) == 0 {
+		result.bucket = []byte("objects")
+	}
+	if result.timeout == 0 {
+		result.timeout = 5 * time.Second
+	}
+	return result
+}
+
+// Init - opens ( and creates if needed ) the database file
+func (b *Storage) Init() error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if b.initialized {
+		return nil
+	}
+	if len(b.path) == 0 {
+		err := stacktrace.NewError("[FATAL] KV Storage : database path is not given")
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(b.path), 0700)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[FATAL] KV Storage : could not make the parent tree of (%s)", b.path)
+		return err
+	}
+	err = b.open()
+	if err != nil {
+		return err
+	}
+	b.initialized = true
+	if b.logOps {
+		colorstring.Println(fmt.Sprintf("[yellow][INFO] KV Storage: Initialized at %s", b.path))
+	}
+	return nil
+}
+
+func (b *Storage) open() error {
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: b.timeout})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[FATAL] KV Storage : could not open database at (%s)", b.path)
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		err = stacktrace.Propagate(err, "[FATAL] KV Storage : could not create bucket (%s)", b.bucket)
+		return err
+	}
+	b.db = db
+	return nil
+}
+
+// Close - releases the database file
+func (b *Storage) Close() error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if !b.initialized {
+		return nil
+	}
+	b.initialized = false
+	return b.db.Close()
+}
+
+// Put -
+func (b *Storage) Put(ctx context.Context, entry *file.Entry) error {
+	return b.Batch(ctx, []*file.Entry{entry})
+}
+
+// Batch - stores all entries inside a single write transaction; either all
+// of them are committed or none is
+func (b *Storage) Batch(ctx context.Context, entries []*file.Entry) error {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] KV Storage :was not initialized")
+		return err
+	}
+	if b.logOps {
+		start := time.Now()
+		defer func() {
+			duration := fmt.Sprintf("[bold][yellow][INFO] KV Storage: Put operation of (%d) entries took (%v) to complete", len(entries), time.Now().Sub(start))
+			colorstring.Println(duration)
+		}()
+	}
+	type record struct {
+		key   []byte
+		value []byte
+	}
+	records := make([]record, 0, len(entries))
+	for _, entry := range entries {
+		key, err := normalizeKey(entry.Key)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] KV Storage: Put operation error. could not validate entry key (%s) ", entry.Key)
+			return err
+		}
+		value := entry.Value
+		if encryptionKey := b.keyFor(key); encryptionKey != nil {
+			value, err = file.EncryptWithPadding(b.cipherID, encryptionKey, b.padding, value)
+			if err != nil {
+				err = stacktrace.Propagate(err, "[ERROR] KV Storage: Put operation error. could not encrypt entry (%s) ", entry.Key)
+				return err
+			}
+		}
+		records = append(records, record{key: []byte(key), value: value})
+	}
+	err := ctx.Err()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Put operation error ")
+		return err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		for _, r := range records {
+			err := bucket.Put(r.key, r.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Put operation error. could not commit transaction ")
+		return err
+	}
+	for _, r := range records {
+		b.markDirty(r.key)
+	}
+	return nil
+}
+
+// Get -
+func (b *Storage) Get(ctx context.Context, k string) (*file.Entry, error) {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] KV Storage :was not initialized")
+		return nil, err
+	}
+	key, err := normalizeKey(k)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Get operation error.could not validate entry key (%s) ", k)
+		return nil, err
+	}
+	var value []byte
+	err = b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(b.bucket).Get([]byte(key))
+		if v != nil {
+			// values are only valid for the life of the transaction
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Get operation error ")
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	if encryptionKey := b.keyFor(key); encryptionKey != nil {
+		padded := file.IsPadded(value)
+		value, err = file.DecryptAny(value, append([][]byte{encryptionKey}, b.fallbackKeys...)...)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] KV Storage: Get operation error. could not decrypt entry (%s) ", k)
+			return nil, err
+		}
+		if padded {
+			value, err = file.Unpad(value)
+			if err != nil {
+				err = stacktrace.Propagate(err, "[ERROR] KV Storage: Get operation error. could not strip the padding of entry (%s) ", k)
+				return nil, err
+			}
+		}
+	}
+	return &file.Entry{
+		Key:   k,
+		Value: value,
+	}, nil
+}
+
+// GetRange - reads length bytes of k, starting at offset. plaintext values
+// only have the range copied out of the database; encrypted ones are
+// decrypted whole and the range is cut out of them
+func (b *Storage) GetRange(ctx context.Context, k string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		err := stacktrace.NewError("[ERROR] KV Storage: GetRange operation error. invalid range (%d,%d) for key (%s)", offset, length, k)
+		return nil, err
+	}
+	key, err := normalizeKey(k)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: GetRange operation error.could not validate entry key (%s) ", k)
+		return nil, err
+	}
+	var value []byte
+	if b.keyFor(key) != nil {
+		entry, err := b.Get(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			value = entry.Value
+		}
+	} else {
+		b.stateLock.RLock()
+		defer b.stateLock.RUnlock()
+		if !b.initialized {
+			err := stacktrace.NewError("[ERROR] KV Storage :was not initialized")
+			return nil, err
+		}
+		err = b.db.View(func(tx *bolt.Tx) error {
+			v := tx.Bucket(b.bucket).Get([]byte(key))
+			if v != nil && int64(len(v)) >= offset+length {
+				// values are only valid for the life of the transaction
+				value = append([]byte{}, v[offset:offset+length]...)
+				offset = 0
+			}
+			return nil
+		})
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] KV Storage: GetRange operation error ")
+			return nil, err
+		}
+	}
+	if int64(len(value)) < offset+length {
+		err := stacktrace.NewError("[ERROR] KV Storage: GetRange operation error. range (%d,%d) is out of bounds for key (%s)", offset, length, k)
+		return nil, err
+	}
+	return value[offset : offset+length], nil
+}
+
+// Delete -
+func (b *Storage) Delete(ctx context.Context, k string) error {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] KV Storage :was not initialized")
+		return err
+	}
+	if k == "" {
+		return nil
+	}
+	key, err := normalizeKey(k)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Delete operation error.could not validate entry key (%s) ", k)
+		return err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Delete([]byte(key))
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Delete operation failed to remove %q", k)
+		return err
+	}
+	b.markDirty([]byte(key))
+	return nil
+}
+
+// List - returns the immediate children of prefix, with a trailing slash
+// for "directories", the same way file.Storage does
+func (b *Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] KV Storage :was not initialized")
+		return nil, err
+	}
+	p, err := normalizeKey(prefix)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: List operation error.could not validate path prefix (%s) ", prefix)
+		return nil, err
+	}
+	if len(p) != 0 {
+		p += "/"
+	}
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(b.bucket).Cursor()
+		for k, _ := c.Seek([]byte(p)); k != nil && strings.HasPrefix(string(k), p); k, _ = c.Next() {
+			name := string(k[len(p):])
+			if i := strings.Index(name, "/"); i >= 0 {
+				name = name[:i+1]
+			}
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: List operation error ")
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Compact - rewrites the database into a fresh file, dropping the free
+// pages left behind by deletes and overwrites. the copy is taken from a
+// read transaction while other operations go on; they only block while the
+// keys written meanwhile are copied again and the files are swapped.
+func (b *Storage) Compact(ctx context.Context) error {
+	b.compactLock.Lock()
+	defer b.compactLock.Unlock()
+	b.stateLock.RLock()
+	initialized := b.initialized
+	b.stateLock.RUnlock()
+	if !initialized {
+		err := stacktrace.NewError("[ERROR] KV Storage :was not initialized")
+		return err
+	}
+	before, _ := os.Stat(b.path)
+	tmpPath := b.path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: b.timeout})
+	if err != nil {
+		os.Remove(tmpPath)
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Compact operation could not open (%s)", tmpPath)
+		return err
+	}
+	// the temporary file is removed on every error, once it is closed
+	renamed := false
+	defer func() {
+		if dst != nil {
+			dst.Close()
+		}
+		if !renamed {
+			os.Remove(tmpPath)
+		}
+	}()
+	b.dirtyLock.Lock()
+	b.dirty = make(map[string]struct{})
+	b.dirtyLock.Unlock()
+	defer func() {
+		b.dirtyLock.Lock()
+		b.dirty = nil
+		b.dirtyLock.Unlock()
+	}()
+	b.stateLock.RLock()
+	err = b.copyTo(ctx, dst)
+	b.stateLock.RUnlock()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Compact operation failed to copy database")
+		return err
+	}
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if !b.initialized {
+		err = stacktrace.NewError("[ERROR] KV Storage: Compact operation error. storage was closed while compacting")
+		return err
+	}
+	err = b.copyDirty(dst)
+	if err == nil {
+		err = dst.Sync()
+	}
+	closeErr := dst.Close()
+	dst = nil
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Compact operation failed to copy database")
+		return err
+	}
+	err = b.db.Close()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Compact operation could not close database")
+		return err
+	}
+	err = os.Rename(tmpPath, b.path)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] KV Storage: Compact operation could not replace (%s)", b.path)
+	} else {
+		renamed = true
+	}
+	openErr := b.open()
+	if openErr != nil {
+		b.initialized = false
+		return openErr
+	}
+	if err != nil {
+		return err
+	}
+	after, _ := os.Stat(b.path)
+	if b.logOps && before != nil && after != nil {
+		colorstring.Println(fmt.Sprintf("[yellow][INFO] KV Storage: compacted (%s) from %s to %s", b.path, utils.PrettyPrintSize(before.Size()), utils.PrettyPrintSize(after.Size())))
+	}
+	return nil
+}
+
+// markDirty records keys written while a compaction copies the database,
+// so they are copied again before the files are swapped
+func (b *Storage) markDirty(keys ...[]byte) {
+	b.dirtyLock.Lock()
+	defer b.dirtyLock.Unlock()
+	if b.dirty == nil {
+		return
+	}
+	for _, k := range keys {
+		b.dirty[string(k)] = struct{}{}
+	}
+}
+
+// copyDirty copies the keys written since the compaction started into
+// dst, deleting the ones deleted meanwhile. callers hold stateLock
+func (b *Storage) copyDirty(dst *bolt.DB) error {
+	b.dirtyLock.Lock()
+	dirty := b.dirty
+	b.dirty = make(map[string]struct{})
+	b.dirtyLock.Unlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	return b.db.View(func(src *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			from, to := src.Bucket(b.bucket), tx.Bucket(b.bucket)
+			for k := range dirty {
+				v := from.Get([]byte(k))
+				var err error
+				if v == nil {
+					err = to.Delete([]byte(k))
+				} else {
+					err = to.Put([]byte(k), v)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// copyTo copies every key of the object bucket into dst, committing every
+// compactionTxSize bytes
+func (b *Storage) copyTo(ctx context.Context, dst *bolt.DB) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	bucket, err := tx.CreateBucketIfNotExists(b.bucket)
+	if err != nil {
+		return err
+	}
+	size := 0
+	err = b.db.View(func(src *bolt.Tx) error {
+		return src.Bucket(b.bucket).ForEach(func(k, v []byte) error {
+			if size+len(k)+len(v) > compactionTxSize && size > 0 {
+				err := ctx.Err()
+				if err != nil {
+					return err
+				}
+				err = tx.Commit()
+				if err != nil {
+					return err
+				}
+				tx, err = dst.Begin(true)
+				if err != nil {
+					return err
+				}
+				bucket = tx.Bucket(b.bucket)
+				size = 0
+			}
+			size += len(k) + len(v)
+			return bucket.Put(k, v)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	return err
+}
+
+// keyFor returns the key the value of the normalized key is encrypted
+// with, or nil when it is stored unencrypted
+func (b *Storage) keyFor(key string) []byte {
+	for _, prefix := range b.plaintext {
+		if key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return nil
+		}
+	}
+	return b.encryptionKey
+}
+
+// normalizeKey cleans k the same way file.Storage resolves keys to paths,
+// so both backends agree on which keys are equivalent
+func normalizeKey(k string) (string, error) {
+	if strings.Contains(k, "..") {
+		return "", stacktrace.NewError("path cannot contain parent references")
+	}
+	k = strings.Trim(path.Clean("/"+k), "/")
+	return k, nil
+}
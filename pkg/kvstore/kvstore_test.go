@@ -0,0 +1,106 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+func newTestStorage(t *testing.T, opts ...Option) *Storage {
+	t.Helper()
+	path, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	b := New(append([]Option{WithPath(filepath.Join(path, "repository.db"))}, opts...)...)
+	err = b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// writes made while a compaction copies the database must survive it
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	b := newTestStorage(t)
+	value := bytes.Repeat([]byte{0x42}, 4096)
+	for i := 0; i < 512; i++ {
+		err := b.Put(ctx, &file.Entry{Key: fmt.Sprintf("old/%03d", i), Value: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 512; i += 2 {
+		err := b.Delete(ctx, fmt.Sprintf("old/%03d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := os.Stat(b.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 256; i++ {
+			err := b.Put(ctx, &file.Entry{Key: fmt.Sprintf("new/%03d", i), Value: []byte(fmt.Sprint(i))})
+			if err == nil && i%2 == 1 {
+				err = b.Delete(ctx, fmt.Sprintf("old/%03d", i))
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs <- b.Compact(ctx)
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := os.Stat(b.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("compaction grew the database from %d to %d bytes", before.Size(), after.Size())
+	}
+	for i := 0; i < 512; i++ {
+		entry, err := b.Get(ctx, fmt.Sprintf("old/%03d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i%2 == 1 && i >= 256; (entry != nil) != want {
+			t.Errorf("old/%03d exists: %v, want %v", i, entry != nil, want)
+		}
+	}
+	for i := 0; i < 256; i++ {
+		entry, err := b.Get(ctx, fmt.Sprintf("new/%03d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || string(entry.Value) != fmt.Sprint(i) {
+			t.Errorf("new/%03d written during the compaction was lost", i)
+		}
+	}
+}
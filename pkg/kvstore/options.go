@@ -0,0 +1,143 @@
+package kvstore
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/palantir/stacktrace"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Option - options setter method
+type Option func(*Storage)
+
+// Storage - keeps every object of a repository inside a single embedded
+// bbolt (B+tree) database file
+type Storage struct {
+	stateLock   sync.RWMutex
+	logOps      bool
+	initialized bool
+	// -----
+	path          string
+	bucket        []byte
+	timeout       time.Duration
+	encryptionKey []byte
+	cipherID      byte
+	plaintext     []string
+	fallbackKeys  [][]byte
+	padding       file.Padding
+	db            *bolt.DB
+	// compactLock runs one compaction at a time. while one runs, dirty
+	// holds the keys written since it started copying
+	compactLock sync.Mutex
+	dirtyLock   sync.Mutex
+	dirty       map[string]struct{}
+}
+
+// LogOps -
+func LogOps() Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.logOps = true
+	}
+}
+
+// WithPath - sets path of the database file
+func WithPath(arg string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.path = arg
+	}
+}
+
+// WithBucket - sets name of the bucket objects are stored in
+func WithBucket(arg string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.bucket = []byte(arg)
+	}
+}
+
+// WithTimeout - sets how long Init waits for the database file lock
+func WithTimeout(arg time.Duration) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.timeout = arg
+	}
+}
+
+// WithEncryption - encrypts values with the same stream framing as
+// file.Storage
+func WithEncryption(arg string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		key, err := file.DeriveKey(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		e.encryptionKey = key
+	}
+}
+
+// WithEncryptionKey - encrypts values with the given 256-bit key as is,
+// instead of deriving one from a string
+func WithEncryptionKey(arg []byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		if len(arg) != file.KeySize {
+			err := stacktrace.NewError("[FATAL] encryption key must be %d bytes long, got %d", file.KeySize, len(arg))
+			log.Fatal(err)
+		}
+		e.encryptionKey = arg
+	}
+}
+
+// WithFallbackKeys - values the encryption key cannot decrypt are tried
+// with these keys, in order. writes always use the encryption key
+func WithFallbackKeys(arg ...[]byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.fallbackKeys = append(e.fallbackKeys, arg...)
+	}
+}
+
+// WithPlaintextPrefixes - values under any of the given prefixes are stored
+// unencrypted, even when encryption is enabled
+func WithPlaintextPrefixes(arg ...string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		for _, prefix := range arg {
+			e.plaintext = append(e.plaintext, strings.Trim(prefix, "/"))
+		}
+	}
+}
+
+// WithCipher - sets the cipher suite values are encrypted with
+func WithCipher(arg byte) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.cipherID = arg
+	}
+}
+
+// WithPadding - pads encrypted values with the given policy before
+// encrypting them. padding is stripped on read whatever the policy
+func WithPadding(arg file.Padding) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.padding = arg
+	}
+}
@@ -0,0 +1,129 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/palantir/stacktrace"
+)
+
+// GenerationPrefix is where every replica keeps the generation record of
+// each key it holds. records are hidden from List and Status
+const GenerationPrefix = ".mirror-generations"
+
+// generation - what a replica last recorded for a key. a write stamps a
+// new generation on every replica it reaches, so replicas a write missed
+// are told apart from those it reached. a deleted key keeps its record as
+// a tombstone, so it is not resurrected from a replica the delete missed
+type generation struct {
+	Generation int64  `json:"generation"`
+	Digest     []byte `json:"digest,omitempty"`
+	Deleted    bool   `json:"deleted,omitempty"`
+}
+
+func generationKey(k string) string {
+	return GenerationPrefix + "/" + k
+}
+
+func isGenerationKey(k string) bool {
+	return k == GenerationPrefix || strings.HasPrefix(k, GenerationPrefix+"/")
+}
+
+// newGeneration stamps a write of value, or a delete when value is nil
+func newGeneration(value []byte, deleted bool) *generation {
+	result := &generation{
+		Generation: time.Now().UnixNano(),
+		Deleted:    deleted,
+	}
+	if !deleted {
+		sum := sha256.Sum256(value)
+		result.Digest = sum[:]
+	}
+	return result
+}
+
+// validate rejects a copy whose digest does not match the one recorded
+// when it was written
+func (g *generation) validate(entry *file.Entry) error {
+	if g == nil || len(g.Digest) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(entry.Value)
+	if !bytes.Equal(sum[:], g.Digest) {
+		return stacktrace.NewError("digest of (%s) does not match generation (%d)", entry.Key, g.Generation)
+	}
+	return nil
+}
+
+func putGeneration(ctx context.Context, replica file.Backend, k string, g *generation) error {
+	raw, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return replica.Put(ctx, &file.Entry{Key: generationKey(k), Value: raw})
+}
+
+// getGeneration returns nil when the replica holds no record for k, as is
+// the case for objects written before generations were recorded
+func getGeneration(ctx context.Context, replica file.Backend, k string) (*generation, error) {
+	entry, err := replica.Get(ctx, generationKey(k))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	result := &generation{}
+	err = json.Unmarshal(entry.Value, result)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "could not decode generation record of (%s)", k)
+	}
+	return result, nil
+}
+
+// generations reads the record of k from every replica concurrently. a
+// replica that could not be read has a nil record and a non nil error
+func (b *Storage) generations(ctx context.Context, k string) ([]*generation, []error) {
+	records := make([]*generation, len(b.replicas))
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range b.replicas {
+		wg.Add(1)
+		go func(i int, replica file.Backend) {
+			defer wg.Done()
+			records[i], errs[i] = getGeneration(ctx, replica, k)
+		}(i, replica)
+	}
+	wg.Wait()
+	return records, errs
+}
+
+// newest returns the record with the highest generation, or nil when no
+// replica holds one
+func newest(records []*generation) *generation {
+	var result *generation
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		if result == nil || record.Generation > result.Generation {
+			result = record
+		}
+	}
+	return result
+}
+
+// current reports whether record is at generation latest. every record is
+// current when no replica holds one
+func current(record, latest *generation) bool {
+	if latest == nil {
+		return true
+	}
+	return record != nil && record.Generation == latest.Generation
+}
@@ -0,0 +1,491 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+)
+
+// Report - divergence between the replicas of a Storage
+type Report struct {
+	// Keys is the number of distinct keys found on any replica
+	Keys int
+	// Missing maps a replica index to the keys other replicas hold but it
+	// does not
+	Missing map[int][]string
+	// Divergent lists keys whose copies differ between replicas, or do not
+	// match the digest recorded when they were written. it is only filled
+	// in by a deep status
+	Divergent []string
+	// Stale maps a replica index to the keys it holds at an older
+	// generation than another replica, including keys since deleted. keys
+	// missing from some replica are always checked; a deep status checks
+	// every key
+	Stale map[int][]string
+	// Unreachable maps a replica index to the error listing it failed with
+	Unreachable map[int]error
+}
+
+// New - constructs a new mirrored Storage
+func New(opts ...Option) *Storage {
+	result := &Storage{}
+	for _, opt := range opts {
+		opt(result)
+	}
+	if result.writeQuorum < 1 || result.writeQuorum > len(result.replicas) {
+		result.writeQuorum = len(result.replicas)
+	}
+	return result
+}
+
+// Init - initializes every replica. it fails when fewer replicas than the
+// write quorum come up
+func (b *Storage) Init() error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if b.initialized {
+		return nil
+	}
+	if len(b.replicas) == 0 {
+		err := stacktrace.NewError("[FATAL] Mirror Storage : no replica is given")
+		return err
+	}
+	healthy := 0
+	var lastErr error
+	for i, replica := range b.replicas {
+		err := replica.Init()
+		if err != nil {
+			lastErr = stacktrace.Propagate(err, "[FATAL] Mirror Storage : could not initialize replica #%d", i)
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Mirror Storage: replica #%d failed to initialize: %v", i, err))
+			}
+			continue
+		}
+		healthy++
+	}
+	if healthy < b.writeQuorum {
+		err := stacktrace.Propagate(lastErr, "[FATAL] Mirror Storage : only (%d) replicas are healthy, write quorum is (%d)", healthy, b.writeQuorum)
+		return err
+	}
+	b.initialized = true
+	return nil
+}
+
+// Put - writes entry to every replica concurrently, succeeding once the
+// write quorum acknowledged it. every replica reached records a new
+// generation of entry, along with its digest
+func (b *Storage) Put(ctx context.Context, entry *file.Entry) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Mirror Storage :was not initialized")
+		return err
+	}
+	record := newGeneration(entry.Value, false)
+	errs := b.fanOut(func(replica file.Backend) error {
+		err := replica.Put(ctx, entry)
+		if err != nil {
+			return err
+		}
+		return putGeneration(ctx, replica, entry.Key, record)
+	})
+	return b.quorum("Put", entry.Key, errs)
+}
+
+// Get - reads k from the first replica holding a healthy copy of its
+// newest generation. replicas holding an older generation, none at all,
+// or a copy that fails validation are skipped and repaired when repair is
+// enabled. once the newest generation is a delete, k is not found and the
+// replicas still holding it have it deleted when repair is enabled
+func (b *Storage) Get(ctx context.Context, k string) (*file.Entry, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Mirror Storage :was not initialized")
+		return nil, err
+	}
+	records, recordErrs := b.generations(ctx, k)
+	latest := newest(records)
+	if latest != nil && latest.Deleted {
+		if b.repair {
+			stale := make([]int, 0)
+			for i := range b.replicas {
+				if recordErrs[i] == nil && !current(records[i], latest) {
+					stale = append(stale, i)
+				}
+			}
+			b.repairDeletes(ctx, k, latest, stale)
+		}
+		return nil, nil
+	}
+	stale := make([]int, 0)
+	var lastErr error
+	for i, replica := range b.replicas {
+		err := recordErrs[i]
+		if err != nil {
+			lastErr = err
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Mirror Storage: replica #%d failed to read the generation of (%s): %v", i, k, err))
+			}
+			continue
+		}
+		if !current(records[i], latest) {
+			stale = append(stale, i)
+			continue
+		}
+		entry, err := replica.Get(ctx, k)
+		if err == nil && entry != nil {
+			err = latest.validate(entry)
+		}
+		if err == nil && entry != nil && b.validator != nil {
+			err = b.validator(entry)
+		}
+		if err != nil {
+			lastErr = err
+			stale = append(stale, i)
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Mirror Storage: replica #%d failed to read (%s): %v", i, k, err))
+			}
+			continue
+		}
+		if entry == nil {
+			stale = append(stale, i)
+			continue
+		}
+		for j := i + 1; j < len(b.replicas); j++ {
+			if recordErrs[j] == nil && !current(records[j], latest) {
+				stale = append(stale, j)
+			}
+		}
+		if b.repair && len(stale) != 0 {
+			b.repairReplicas(ctx, entry, latest, stale)
+		}
+		return entry, nil
+	}
+	if lastErr == nil && latest != nil {
+		lastErr = stacktrace.NewError("no replica holds generation (%d)", latest.Generation)
+	}
+	if lastErr != nil {
+		err := stacktrace.Propagate(lastErr, "[ERROR] Mirror Storage: Get operation error. no replica holds a healthy copy of (%s)", k)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// GetRange - reads length bytes of k, starting at offset, from the first
+// replica holding its newest generation. the range cannot be checked
+// against the digest of the whole object, so replicas are neither
+// validated nor repaired; replicas without ranged reads have the whole
+// object read and validated instead
+func (b *Storage) GetRange(ctx context.Context, k string, offset, length int64) ([]byte, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Mirror Storage :was not initialized")
+		return nil, err
+	}
+	if offset < 0 || length < 0 {
+		err := stacktrace.NewError("[ERROR] Mirror Storage: GetRange operation error. invalid range (%d,%d) for key (%s)", offset, length, k)
+		return nil, err
+	}
+	records, recordErrs := b.generations(ctx, k)
+	latest := newest(records)
+	if latest != nil && latest.Deleted {
+		err := stacktrace.NewError("[ERROR] Mirror Storage: GetRange operation error. (%s) was deleted", k)
+		return nil, err
+	}
+	var lastErr error
+	for i, replica := range b.replicas {
+		if recordErrs[i] != nil || !current(records[i], latest) {
+			continue
+		}
+		rr, ok := replica.(file.RangeReader)
+		if !ok {
+			continue
+		}
+		out, err := rr.GetRange(ctx, k, offset, length)
+		if err != nil {
+			lastErr = err
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Mirror Storage: replica #%d failed to read range (%d,%d) of (%s): %v", i, offset, length, k, err))
+			}
+			continue
+		}
+		return out, nil
+	}
+	entry, err := b.Get(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || int64(len(entry.Value)) < offset+length {
+		if lastErr == nil {
+			lastErr = stacktrace.NewError("range (%d,%d) is out of bounds", offset, length)
+		}
+		err = stacktrace.Propagate(lastErr, "[ERROR] Mirror Storage: GetRange operation error. could not read (%s)", k)
+		return nil, err
+	}
+	return entry.Value[offset : offset+length], nil
+}
+
+// Delete - deletes k from every replica, succeeding once the write quorum
+// acknowledged it. every replica reached records the delete as a new
+// generation of k, so replicas it missed are not read from again
+func (b *Storage) Delete(ctx context.Context, k string) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Mirror Storage :was not initialized")
+		return err
+	}
+	record := newGeneration(nil, true)
+	errs := b.fanOut(func(replica file.Backend) error {
+		err := putGeneration(ctx, replica, k, record)
+		if err != nil {
+			return err
+		}
+		return replica.Delete(ctx, k)
+	})
+	return b.quorum("Delete", k, errs)
+}
+
+// List - merges the listings of every reachable replica. keys only some
+// replicas hold are left out once their newest generation is a delete
+func (b *Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Mirror Storage :was not initialized")
+		return nil, err
+	}
+	seen := make(map[string]int)
+	names := make([]string, 0)
+	failed := 0
+	var lastErr error
+	for _, replica := range b.replicas {
+		out, err := replica.List(ctx, prefix)
+		if err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		for _, name := range out {
+			if isGenerationKey(utils.PathJoin(prefix, name)) {
+				continue
+			}
+			if _, ok := seen[name]; !ok {
+				names = append(names, name)
+			}
+			seen[name]++
+		}
+	}
+	if failed == len(b.replicas) {
+		err := stacktrace.Propagate(lastErr, "[ERROR] Mirror Storage: List operation error. no replica could be listed")
+		return nil, err
+	}
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if seen[name] < len(b.replicas)-failed && !strings.HasSuffix(name, "/") && b.deleted(ctx, utils.PathJoin(prefix, name)) {
+			continue
+		}
+		result = append(result, name)
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Status - compares the keys held by every replica under prefix. a deep
+// status also reads every copy and compares their contents
+func (b *Storage) Status(ctx context.Context, prefix string, deep bool) (*Report, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Mirror Storage :was not initialized")
+		return nil, err
+	}
+	result := &Report{
+		Missing:     make(map[int][]string),
+		Divergent:   make([]string, 0),
+		Stale:       make(map[int][]string),
+		Unreachable: make(map[int]error),
+	}
+	holders := make(map[string][]int)
+	for i, replica := range b.replicas {
+		err := file.WalkKeys(ctx, replica, prefix, func(key string) error {
+			if isGenerationKey(key) {
+				return nil
+			}
+			holders[key] = append(holders[key], i)
+			return nil
+		})
+		if err != nil {
+			result.Unreachable[i] = err
+		}
+	}
+	keys := make([]string, 0, len(holders))
+	for key := range holders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result.Keys = len(keys)
+	for _, key := range keys {
+		held := make(map[int]bool)
+		for _, i := range holders[key] {
+			held[i] = true
+		}
+		missing := make([]int, 0)
+		for i := range b.replicas {
+			if _, ok := result.Unreachable[i]; ok {
+				continue
+			}
+			if !held[i] {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 && !deep {
+			continue
+		}
+		records, _ := b.generations(ctx, key)
+		latest := newest(records)
+		for _, i := range holders[key] {
+			if latest != nil && (latest.Deleted || !current(records[i], latest)) {
+				result.Stale[i] = append(result.Stale[i], key)
+			}
+		}
+		if latest != nil && latest.Deleted {
+			continue
+		}
+		for _, i := range missing {
+			result.Missing[i] = append(result.Missing[i], key)
+		}
+		if !deep {
+			continue
+		}
+		var reference []byte
+		for _, i := range holders[key] {
+			if !current(records[i], latest) {
+				continue
+			}
+			digest, err := b.digest(ctx, i, key, latest)
+			if err != nil {
+				result.Divergent = append(result.Divergent, key)
+				break
+			}
+			if reference == nil {
+				reference = digest
+				continue
+			}
+			if !bytes.Equal(reference, digest) {
+				result.Divergent = append(result.Divergent, key)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// Replicas - number of replicas
+func (b *Storage) Replicas() int {
+	return len(b.replicas)
+}
+
+func (b *Storage) digest(ctx context.Context, replica int, key string, record *generation) ([]byte, error) {
+	entry, err := b.replicas[replica].Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, stacktrace.NewError("(%s) vanished from replica #%d", key, replica)
+	}
+	err = record.validate(entry)
+	if err != nil {
+		return nil, err
+	}
+	if b.validator != nil {
+		err = b.validator(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256(entry.Value)
+	return sum[:], nil
+}
+
+// repairReplicas rewrites entry, at generation record, on the given
+// replicas. repair is best effort; the read that triggered it succeeds
+// either way
+func (b *Storage) repairReplicas(ctx context.Context, entry *file.Entry, record *generation, replicas []int) {
+	for _, i := range replicas {
+		err := b.replicas[i].Put(ctx, entry)
+		if err == nil && record != nil {
+			err = putGeneration(ctx, b.replicas[i], entry.Key, record)
+		}
+		if b.logOps {
+			if err != nil {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Mirror Storage: could not repair (%s) on replica #%d: %v", entry.Key, i, err))
+				continue
+			}
+			colorstring.Println(fmt.Sprintf("[yellow][INFO] Mirror Storage: repaired (%s) on replica #%d", entry.Key, i))
+		}
+	}
+}
+
+// repairDeletes deletes k from the given replicas, recording the delete
+// at generation record. it is as best effort as repairReplicas
+func (b *Storage) repairDeletes(ctx context.Context, k string, record *generation, replicas []int) {
+	for _, i := range replicas {
+		err := putGeneration(ctx, b.replicas[i], k, record)
+		if err == nil {
+			err = b.replicas[i].Delete(ctx, k)
+		}
+		if b.logOps {
+			if err != nil {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Mirror Storage: could not repair the delete of (%s) on replica #%d: %v", k, i, err))
+				continue
+			}
+			colorstring.Println(fmt.Sprintf("[yellow][INFO] Mirror Storage: deleted (%s) on replica #%d", k, i))
+		}
+	}
+}
+
+// deleted reports whether the newest generation of k is a delete
+func (b *Storage) deleted(ctx context.Context, k string) bool {
+	records, _ := b.generations(ctx, k)
+	latest := newest(records)
+	return latest != nil && latest.Deleted
+}
+
+// fanOut runs op against every replica concurrently and returns the error
+// of each
+func (b *Storage) fanOut(op func(file.Backend) error) []error {
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range b.replicas {
+		wg.Add(1)
+		go func(i int, replica file.Backend) {
+			defer wg.Done()
+			errs[i] = op(replica)
+		}(i, replica)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (b *Storage) quorum(op, key string, errs []error) error {
+	acks := 0
+	var lastErr error
+	for i, err := range errs {
+		if err != nil {
+			lastErr = err
+			if b.logOps {
+				colorstring.Println(fmt.Sprintf("[red][WARN] Mirror Storage: %s operation of (%s) failed on replica #%d: %v", op, key, i, err))
+			}
+			continue
+		}
+		acks++
+	}
+	if acks < b.writeQuorum {
+		err := stacktrace.Propagate(lastErr, "[ERROR] Mirror Storage: %s operation error. only (%d) replicas acknowledged (%s), write quorum is (%d)", op, acks, key, b.writeQuorum)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package mirror
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+func tempDirs(t *testing.T, count int) []string {
+	t.Helper()
+	result := make([]string, count)
+	for i := range result {
+		path, err := ioutil.TempDir("", "mirror")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(path) })
+		result[i] = path
+	}
+	return result
+}
+
+// newTestStorage mirrors the replicas at paths, and returns them as well
+func newTestStorage(t *testing.T, paths []string, opts ...Option) (*Storage, []*file.Storage) {
+	t.Helper()
+	replicas := make([]*file.Storage, len(paths))
+	for i, path := range paths {
+		replicas[i] = file.New(file.WithPath(path))
+		opts = append(opts, WithReplicas(replicas[i]))
+	}
+	b := New(opts...)
+	err := b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, replicas
+}
+
+// value returns the value replica holds at key, or an empty string
+func value(t *testing.T, replica file.Backend, key string) string {
+	t.Helper()
+	entry, err := replica.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil {
+		return ""
+	}
+	return string(entry.Value)
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	paths := tempDirs(t, 2)
+	b, replicas := newTestStorage(t, paths, WithRepair())
+	for _, key := range []string{"missing", "corrupt", "stale", "deleted"} {
+		err := b.Put(ctx, &file.Entry{Key: key, Value: []byte("first")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := replicas[0].Delete(ctx, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replicas[0].Put(ctx, &file.Entry{Key: "corrupt", Value: []byte("garbage")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes and deletes that only reached the first replica
+	partial, _ := newTestStorage(t, paths[:1])
+	err = partial.Put(ctx, &file.Entry{Key: "stale", Value: []byte("second")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = partial.Delete(ctx, "deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, replicas = newTestStorage(t, paths, WithRepair())
+	for key, want := range map[string]string{"missing": "first", "corrupt": "first", "stale": "second", "deleted": ""} {
+		got := ""
+		entry, err := b.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != nil {
+			got = string(entry.Value)
+		}
+		if got != want {
+			t.Errorf("read %q from %s, want %q", got, key, want)
+		}
+		for i, replica := range replicas {
+			if got := value(t, replica, key); got != want {
+				t.Errorf("replica #%d holds %q at %s after the read, want %q", i, got, key, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package mirror
+
+import (
+	"sync"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+// Option - options setter method
+type Option func(*Storage)
+
+// Storage - a backend that fans every write out to a set of replica
+// backends and reads from the first replica holding a healthy copy
+type Storage struct {
+	stateLock   sync.RWMutex
+	logOps      bool
+	initialized bool
+	// -----
+	replicas    []file.Backend
+	writeQuorum int
+	repair      bool
+	validator   func(*file.Entry) error
+}
+
+// LogOps -
+func LogOps() Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.logOps = true
+	}
+}
+
+// WithReplicas - appends replica backends. reads try replicas in the order
+// they were given
+func WithReplicas(arg ...file.Backend) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.replicas = append(e.replicas, arg...)
+	}
+}
+
+// WithWriteQuorum - number of replicas that must acknowledge a write for it
+// to succeed. defaults to all replicas
+func WithWriteQuorum(arg int) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.writeQuorum = arg
+	}
+}
+
+// WithRepair - rewrites an object on replicas found missing it, or holding
+// a corrupt or older copy, whenever it is read. an object read after a
+// delete is deleted from the replicas the delete missed
+func WithRepair() Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.repair = true
+	}
+}
+
+// WithValidator - sets a function that rejects corrupt copies an otherwise
+// successful read returned. it runs after the copy was checked against the
+// digest recorded when it was written, which is always done
+func WithValidator(arg func(*file.Entry) error) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.validator = arg
+	}
+}
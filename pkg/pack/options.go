@@ -0,0 +1,76 @@
+package pack
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+// Option - options setter method
+type Option func(*Storage)
+
+// Storage - a backend that appends small objects into large pack objects
+// on an underlying backend, instead of storing each one on its own
+type Storage struct {
+	stateLock   sync.RWMutex
+	logOps      bool
+	initialized bool
+	// -----
+	backend    file.Backend
+	prefix     string
+	packDir    string
+	targetSize int64
+	index      map[string]*Location
+	packs      map[string]*Index
+	current    *Index
+	buffer     *bytes.Buffer
+}
+
+// LogOps -
+func LogOps() Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.logOps = true
+	}
+}
+
+// WithBackend - sets the backend packs and pass-through objects are stored
+// on
+func WithBackend(arg file.Backend) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.backend = arg
+	}
+}
+
+// WithPrefix - only objects under this prefix are packed; anything else is
+// passed through to the backend as is
+func WithPrefix(arg string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.prefix = arg
+	}
+}
+
+// WithPackDirectoryPath - sets the prefix pack objects and their indexes
+// are stored under
+func WithPackDirectoryPath(arg string) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.packDir = arg
+	}
+}
+
+// WithTargetSizeInMegabytes - a pack is sealed once it grows past this size
+func WithTargetSizeInMegabytes(arg int64) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.targetSize = int64(arg * 1 << 20)
+	}
+}
@@ -0,0 +1,493 @@
+package pack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/jsonutil"
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/uuid"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+)
+
+// Location - where an object is stored inside a pack
+type Location struct {
+	Pack   string `json:"-" mapstructure:"-"`
+	Offset int64  `json:"offset" mapstructure:"offset"`
+	Length int64  `json:"length" mapstructure:"length"`
+}
+
+// Index - the persisted index of a single pack, mapping every live object
+// key to its location inside the pack
+type Index struct {
+	Pack    string               `json:"pack" mapstructure:"pack"`
+	Size    int64                `json:"size" mapstructure:"size"`
+	Entries map[string]*Location `json:"entries" mapstructure:"entries"`
+	dirty   bool
+}
+
+// LiveRatio - share of the pack's bytes still referenced by the index
+func (i *Index) LiveRatio() float64 {
+	if i.Size == 0 {
+		return 0
+	}
+	var live int64
+	for _, loc := range i.Entries {
+		live += loc.Length
+	}
+	return float64(live) / float64(i.Size)
+}
+
+// New - constructs a new pack Storage
+func New(opts ...Option) *Storage {
+	result := &Storage{
+		index: make(map[string]*Location),
+		packs: make(map[string]*Index),
+	}
+	for _, opt := range opts {
+		opt(result)
+	}
+	if len(result.prefix) == 0 {
+		result.prefix = ".chunks"
+	}
+	if len(result.packDir) == 0 {
+		// packs live with the chunks, so splitter's snapshot walk skips them
+		result.packDir = utils.PathJoin(result.prefix, ".packs")
+	}
+	if result.targetSize == 0 {
+		// pack size : 64 MiB default
+		result.targetSize = int64(64 * 1 << 20)
+	}
+	return result
+}
+
+// Init - initializes the underlying backend and loads the index of every
+// pack into memory
+func (b *Storage) Init() error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if b.initialized {
+		return nil
+	}
+	if b.backend == nil {
+		err := stacktrace.NewError("[FATAL] Pack Storage : backend is not given")
+		return err
+	}
+	err := b.backend.Init()
+	if err != nil {
+		err = stacktrace.Propagate(err, "[FATAL] Pack Storage : could not initialize backend")
+		return err
+	}
+	ctx := context.Background()
+	names, err := b.backend.List(ctx, b.indexKey(""))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[FATAL] Pack Storage : could not list pack indexes")
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		entry, err := b.backend.Get(ctx, b.indexKey(name))
+		if err != nil {
+			err = stacktrace.Propagate(err, "[FATAL] Pack Storage : could not read index of pack (%s)", name)
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		idx := &Index{}
+		err = jsonutil.DecodeJSON(entry.Value, idx)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[FATAL] Pack Storage : could not decode index of pack (%s)", name)
+			return err
+		}
+		if idx.Entries == nil {
+			idx.Entries = make(map[string]*Location)
+		}
+		for k, loc := range idx.Entries {
+			// an interrupted repack leaves the same object in two packs;
+			// both copies hold the same bytes, so keep the first one seen
+			if _, ok := b.index[k]; ok {
+				delete(idx.Entries, k)
+				continue
+			}
+			loc.Pack = idx.Pack
+			b.index[k] = loc
+		}
+		b.packs[idx.Pack] = idx
+	}
+	b.initialized = true
+	if b.logOps {
+		colorstring.Println(fmt.Sprintf("[yellow][INFO] Pack Storage: loaded (%d) objects from (%d) packs", len(b.index), len(b.packs)))
+	}
+	return nil
+}
+
+// Put -
+func (b *Storage) Put(ctx context.Context, entry *file.Entry) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Pack Storage :was not initialized")
+		return err
+	}
+	key := cleanKey(entry.Key)
+	if !b.packed(key) {
+		return b.backend.Put(ctx, entry)
+	}
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	b.forget(key)
+	b.append(key, entry.Value)
+	if int64(b.buffer.Len()) >= b.targetSize {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+// Get -
+func (b *Storage) Get(ctx context.Context, k string) (*file.Entry, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Pack Storage :was not initialized")
+		return nil, err
+	}
+	key := cleanKey(k)
+	if !b.packed(key) {
+		return b.backend.Get(ctx, k)
+	}
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	if b.current != nil {
+		if loc, ok := b.current.Entries[key]; ok {
+			value := make([]byte, loc.Length)
+			copy(value, b.buffer.Bytes()[loc.Offset:loc.Offset+loc.Length])
+			return &file.Entry{Key: k, Value: value}, nil
+		}
+	}
+	loc, ok := b.index[key]
+	if !ok {
+		// objects written before packing was enabled are still loose
+		return b.backend.Get(ctx, k)
+	}
+	value, err := b.readRange(ctx, loc)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Pack Storage: Get operation error. could not read (%s) from pack (%s)", k, loc.Pack)
+		return nil, err
+	}
+	return &file.Entry{Key: k, Value: value}, nil
+}
+
+// Delete -
+func (b *Storage) Delete(ctx context.Context, k string) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Pack Storage :was not initialized")
+		return err
+	}
+	key := cleanKey(k)
+	if !b.packed(key) {
+		return b.backend.Delete(ctx, k)
+	}
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if !b.forget(key) {
+		return b.backend.Delete(ctx, k)
+	}
+	return b.persistDirty(ctx)
+}
+
+// List - merges the loose objects of the backend with the packed objects
+// under prefix
+func (b *Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Pack Storage :was not initialized")
+		return nil, err
+	}
+	names, err := b.backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	p := cleanKey(prefix)
+	if len(p) != 0 {
+		p += "/"
+	}
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		seen[name] = struct{}{}
+	}
+	add := func(key string) {
+		if !strings.HasPrefix(key, p) {
+			return
+		}
+		name := key[len(p):]
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i+1]
+		}
+		if _, ok := seen[name]; ok {
+			return
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	b.stateLock.RLock()
+	for key := range b.index {
+		add(key)
+	}
+	if b.current != nil {
+		for key := range b.current.Entries {
+			add(key)
+		}
+	}
+	b.stateLock.RUnlock()
+	if len(names) > 0 {
+		sort.Strings(names)
+	}
+	return names, nil
+}
+
+// Flush - seals the pack being filled and stores it with its index
+func (b *Storage) Flush(ctx context.Context) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Pack Storage :was not initialized")
+		return err
+	}
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	return b.flush(ctx)
+}
+
+// Repack - rewrites every pack whose live ratio dropped below threshold,
+// copying its live objects into new packs and deleting it afterwards. It
+// returns the number of packs that were rewritten.
+func (b *Storage) Repack(ctx context.Context, threshold float64) (int, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Pack Storage :was not initialized")
+		return 0, err
+	}
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	err := b.flush(ctx)
+	if err != nil {
+		return 0, err
+	}
+	candidates := make([]*Index, 0)
+	for _, idx := range b.packs {
+		if idx.LiveRatio() < threshold {
+			candidates = append(candidates, idx)
+		}
+	}
+	for _, idx := range candidates {
+		if b.logOps {
+			colorstring.Println(fmt.Sprintf("[yellow][INFO] Pack Storage: repacking (%s) with live ratio of %.2f", idx.Pack, idx.LiveRatio()))
+		}
+		if len(idx.Entries) != 0 {
+			entry, err := b.backend.Get(ctx, b.packKey(idx.Pack))
+			if err != nil {
+				err = stacktrace.Propagate(err, "[ERROR] Pack Storage: Repack operation could not read pack (%s)", idx.Pack)
+				return 0, err
+			}
+			if entry == nil || int64(len(entry.Value)) != idx.Size {
+				err = stacktrace.NewError("[ERROR] Pack Storage: Repack operation found pack (%s) missing or truncated", idx.Pack)
+				return 0, err
+			}
+			for key, loc := range idx.Entries {
+				b.append(key, entry.Value[loc.Offset:loc.Offset+loc.Length])
+			}
+		}
+		if b.buffer != nil && int64(b.buffer.Len()) >= b.targetSize {
+			err = b.flush(ctx)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	err = b.flush(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// the old packs keep their index until every object they held is
+	// stored in a new pack, so a failure above leaves both copies readable
+	for _, idx := range candidates {
+		idx.Entries = make(map[string]*Location)
+		idx.dirty = true
+	}
+	err = b.persistDirty(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(candidates), nil
+}
+
+// packed reports whether key is stored inside packs
+func (b *Storage) packed(key string) bool {
+	return under(key, b.prefix) && !under(key, b.packDir)
+}
+
+// under reports whether key is prefix or one of its descendants
+func under(key, prefix string) bool {
+	p := cleanKey(prefix)
+	return key == p || strings.HasPrefix(key, p+"/")
+}
+
+// append adds value to the pack being filled
+func (b *Storage) append(key string, value []byte) {
+	if b.current == nil {
+		id, _ := uuid.GenerateUUID()
+		b.current = &Index{
+			Pack:    id,
+			Entries: make(map[string]*Location),
+		}
+		b.buffer = bytes.NewBuffer(make([]byte, 0, b.targetSize))
+	}
+	loc := &Location{
+		Pack:   b.current.Pack,
+		Offset: int64(b.buffer.Len()),
+		Length: int64(len(value)),
+	}
+	b.buffer.Write(value)
+	b.current.Entries[key] = loc
+}
+
+// forget drops key from the index, leaving its bytes in the pack as dead
+// space. it returns false if key was not packed.
+func (b *Storage) forget(key string) bool {
+	found := false
+	if b.current != nil {
+		if _, ok := b.current.Entries[key]; ok {
+			delete(b.current.Entries, key)
+			found = true
+		}
+	}
+	if loc, ok := b.index[key]; ok {
+		delete(b.index, key)
+		if idx, ok := b.packs[loc.Pack]; ok {
+			delete(idx.Entries, key)
+			idx.dirty = true
+		}
+		found = true
+	}
+	return found
+}
+
+// flush stores the pack being filled, then its index, so an index never
+// points at bytes that are not durable yet
+func (b *Storage) flush(ctx context.Context) error {
+	if b.current == nil {
+		return b.persistDirty(ctx)
+	}
+	idx := b.current
+	if len(idx.Entries) != 0 {
+		if b.logOps {
+			start := time.Now()
+			defer func() {
+				duration := fmt.Sprintf("[bold][yellow][INFO] Pack Storage: storing pack (%s) of %s took (%v) to complete", idx.Pack, utils.PrettyPrintSize(idx.Size), time.Now().Sub(start))
+				colorstring.Println(duration)
+			}()
+		}
+		idx.Size = int64(b.buffer.Len())
+		err := b.backend.Put(ctx, &file.Entry{
+			Key:   b.packKey(idx.Pack),
+			Value: b.buffer.Bytes(),
+		})
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Pack Storage: could not store pack (%s)", idx.Pack)
+			return err
+		}
+		err = b.putIndex(ctx, idx)
+		if err != nil {
+			// best effort, a pack without an index is never read
+			b.backend.Delete(ctx, b.packKey(idx.Pack))
+			return err
+		}
+		b.packs[idx.Pack] = idx
+		for k, loc := range idx.Entries {
+			b.index[k] = loc
+		}
+	}
+	b.current = nil
+	b.buffer = nil
+	return b.persistDirty(ctx)
+}
+
+// persistDirty rewrites the index of every pack that lost objects, and
+// deletes packs that have none left
+func (b *Storage) persistDirty(ctx context.Context) error {
+	for id, idx := range b.packs {
+		if !idx.dirty {
+			continue
+		}
+		if len(idx.Entries) != 0 {
+			err := b.putIndex(ctx, idx)
+			if err != nil {
+				return err
+			}
+			idx.dirty = false
+			continue
+		}
+		err := b.backend.Delete(ctx, b.indexKey(id))
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Pack Storage: could not delete index of pack (%s)", id)
+			return err
+		}
+		err = b.backend.Delete(ctx, b.packKey(id))
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Pack Storage: could not delete pack (%s)", id)
+			return err
+		}
+		delete(b.packs, id)
+	}
+	return nil
+}
+
+func (b *Storage) putIndex(ctx context.Context, idx *Index) error {
+	value, err := jsonutil.EncodeJSON(idx)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Pack Storage: could not encode index of pack (%s)", idx.Pack)
+		return err
+	}
+	err = b.backend.Put(ctx, &file.Entry{
+		Key:   b.indexKey(idx.Pack),
+		Value: value,
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Pack Storage: could not store index of pack (%s)", idx.Pack)
+		return err
+	}
+	return nil
+}
+
+// readRange reads the bytes at loc, with a ranged read when the backend
+// supports it
+func (b *Storage) readRange(ctx context.Context, loc *Location) ([]byte, error) {
+	key := b.packKey(loc.Pack)
+	if rr, ok := b.backend.(file.RangeReader); ok {
+		return rr.GetRange(ctx, key, loc.Offset, loc.Length)
+	}
+	entry, err := b.backend.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || int64(len(entry.Value)) < loc.Offset+loc.Length {
+		err = stacktrace.NewError("pack (%s) is missing or truncated", loc.Pack)
+		return nil, err
+	}
+	return entry.Value[loc.Offset : loc.Offset+loc.Length], nil
+}
+
+func (b *Storage) packKey(id string) string {
+	return utils.PathJoin(b.packDir, "data", id)
+}
+
+func (b *Storage) indexKey(id string) string {
+	return utils.PathJoin(b.packDir, "index", id)
+}
+
+// cleanKey resolves k the way file.Storage resolves keys to paths
+func cleanKey(k string) string {
+	return strings.Trim(path.Clean("/"+k), "/")
+}
@@ -0,0 +1,105 @@
+package pack
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	path, err := ioutil.TempDir("", "pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	return path
+}
+
+// newTestStorage opens a pack Storage, and the backend it initializes, on
+// the repository at path
+func newTestStorage(t *testing.T, path string) (*Storage, file.Backend) {
+	t.Helper()
+	backend := file.New(file.WithPath(path))
+	b := New(WithBackend(backend))
+	err := b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, backend
+}
+
+func TestRepack(t *testing.T) {
+	ctx := context.Background()
+	path := tempDir(t)
+	b, backend := newTestStorage(t, path)
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf(".chunks/%02d", i)
+		err := b.Put(ctx, &file.Entry{Key: keys[i], Value: []byte(keys[i])})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := b.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := backend.List(ctx, ".chunks/.packs/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 1 {
+		t.Fatalf("flushing wrote %d packs, want 1", len(before))
+	}
+	for i := 0; i < len(keys); i++ {
+		if i%4 != 0 {
+			err = b.Delete(ctx, keys[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n, err := b.Repack(ctx, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("repacked %d packs, want 1", n)
+	}
+	after, err := backend.List(ctx, ".chunks/.packs/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 1 || after[0] == before[0] {
+		t.Fatalf("packs %v are left after repacking %v", after, before)
+	}
+	n, err = b.Repack(ctx, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("a second repack rewrote %d packs", n)
+	}
+	// the new pack and its index must be all a fresh Storage needs
+	reopened, _ := newTestStorage(t, path)
+	for i, key := range keys {
+		entry, err := reopened.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%4 != 0 {
+			if entry != nil {
+				t.Errorf("deleted %s came back", key)
+			}
+			continue
+		}
+		if entry == nil || string(entry.Value) != key {
+			t.Errorf("%s was lost by the repack", key)
+		}
+	}
+}
@@ -2,9 +2,13 @@ package section
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
 	"github.com/mitchellh/hashstructure"
 	"github.com/palantir/stacktrace"
 )
@@ -32,5 +36,23 @@ func (s *Section) Data() ([]byte, error) {
 		return nil, err
 	}
 	s.Hash = fmt.Sprintf("%d", hash)
-	return buf.Bytes(), nil
+	digest := sha256.Sum256(buf.Bytes())
+	s.Digest = hex.EncodeToString(digest[:])
+	if s.secret == nil {
+		return buf.Bytes(), nil
+	}
+	// the key is bound to this use of secret, so it never matches other
+	// HMACs computed with it
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("convergent key\x00"))
+	mac.Write(buf.Bytes())
+	s.Key = mac.Sum(nil)
+	id := sha256.Sum256(s.Key)
+	s.ID = hex.EncodeToString(id[:])
+	value, err := file.EncryptConvergent(s.Key, buf.Bytes())
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not seal section #%d", s.Number)
+		return nil, err
+	}
+	return value, nil
 }
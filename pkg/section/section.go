@@ -6,13 +6,21 @@ import (
 
 // Section ...
 type Section struct {
-	Start         int64             `json:"start" mapstructure:"start"`
-	End           int64             `json:"end" mapstructure:"end"`
-	Size          int64             `json:"size" mapstructure:"size"`
-	Number        int               `json:"number" mapstructure:"number"`
-	Hash          string            `json:"hash" mapstructure:"hash"`
+	Start  int64  `json:"start" mapstructure:"start"`
+	End    int64  `json:"end" mapstructure:"end"`
+	Size   int64  `json:"size" mapstructure:"size"`
+	Number int    `json:"number" mapstructure:"number"`
+	Hash   string `json:"hash" mapstructure:"hash"`
+	// Digest is the hex encoded SHA-256 of the plaintext of the section.
+	// Merge rejects data that does not match it
+	Digest string `json:"digest,omitempty" mapstructure:"digest"`
+	// ID and Key are set for convergently encrypted sections: ID names
+	// the chunk object and Key is the key it is sealed with
+	ID            string            `json:"id,omitempty" mapstructure:"id"`
+	Key           []byte            `json:"key,omitempty" mapstructure:"key"`
 	SectionReader *io.SectionReader `json:"-" mapstructure:"-"`
 	SectionWriter io.WriterAt       `json:"-" mapstructure:"-"`
+	secret        []byte
 }
 
 // New ...
@@ -27,3 +35,10 @@ func New(start, size int64, number int, reader io.ReaderAt, writer io.WriterAt)
 	}
 	return result
 }
+
+// WithConvergentEncryption - makes Data seal the section with a key
+// derived from its contents and secret, so equal sections of any file seal
+// to the same object
+func (s *Section) WithConvergentEncryption(secret []byte) {
+	s.secret = secret
+}
@@ -2,13 +2,31 @@ package section
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
 	"github.com/palantir/stacktrace"
 )
 
 // Merge uses write at to add bytes to a file section
 // it decompresses and decrypts bytes if needed
 func (s *Section) Merge(p []byte) (int, error) {
+	if len(s.Key) != 0 {
+		plaintext, err := file.Decrypt(s.Key, p)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] failed to open convergently encrypted chunk (%s)", s.ID)
+			return 0, err
+		}
+		p = plaintext
+	}
+	if len(s.Digest) != 0 {
+		digest := sha256.Sum256(p)
+		if hex.EncodeToString(digest[:]) != s.Digest {
+			err := stacktrace.NewError("[ERROR] chunk #%d does not match its digest", s.Number)
+			return 0, err
+		}
+	}
 
 	buf := bytes.NewBuffer(p)
 	n, err := s.SectionWriter.WriteAt(buf.Bytes(), s.Start)
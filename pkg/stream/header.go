@@ -0,0 +1,150 @@
+package stream
+
+import (
+	"encoding/binary"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Errors
+var (
+	// ErrInvalidPayloadSize ...
+	ErrInvalidPayloadSize = stacktrace.NewError("invalid payload size")
+	// ErrAuthentication ...
+	ErrAuthentication = stacktrace.NewError("authentication failed")
+	// ErrLargerSizeThanExpected ...
+	ErrLargerSizeThanExpected = stacktrace.NewError("data size is too large")
+	// ErrNonceMismatch ...
+	ErrNonceMismatch = stacktrace.NewError("header nonce mismatch")
+	// ErrUnexpectedEOF ...
+	ErrUnexpectedEOF = stacktrace.NewError("unexpected end of file (EOF)")
+	// ErrUnexpectedData ...
+	ErrUnexpectedData = stacktrace.NewError("unexpected data after final burst of data")
+	// ErrInvalidDecryptedSize ...
+	ErrInvalidDecryptedSize = stacktrace.NewError("size is not valid")
+	// ErrUnknownCipher ...
+	ErrUnknownCipher = stacktrace.NewError("unknown cipher suite")
+	// ErrCipherMismatch ...
+	ErrCipherMismatch = stacktrace.NewError("cipher suite changed within a stream")
+)
+
+// Consts
+const (
+	// AES256GCM ...
+	AES256GCM byte = iota
+	// XChaCha20Poly1305 - for hosts without AES hardware acceleration
+	XChaCha20Poly1305
+	// TagSize ...
+	TagSize = 16
+	// HeaderSize ...
+	HeaderSize = 16
+	// GCM standard nounce size
+	StandardNonceSize = 12
+	// 1000 0000
+	HeaderFinalFlag = 0x80
+	// HeaderPaddedFlag is set on the cipher id of every burst of a stream
+	// whose plaintext is padded. see WithPadded
+	HeaderPaddedFlag = 0x80
+	// KeySize ...
+	KeySize = 32
+	// MaxPayloadSize ...
+	MaxPayloadSize = 1 << 16
+	// MaxBufferSize ...
+	MaxBufferSize = HeaderSize + MaxPayloadSize + TagSize
+	// MaxDecryptedSize ...
+	MaxDecryptedSize = 1 << 48
+	// MaxEncryptedSize ...
+	MaxEncryptedSize = MaxDecryptedSize + ((HeaderSize + TagSize) * 1 << 32)
+)
+
+// Buffer ...
+type Buffer []byte
+
+// Header ...
+func (b Buffer) Header() Header {
+	return Header(b[:HeaderSize])
+}
+
+// Data ...
+func (b Buffer) Data() []byte {
+	return b[HeaderSize : HeaderSize+b.Header().GetLength()]
+}
+
+// Ciphertext ...
+func (b Buffer) Ciphertext() []byte {
+	return b[HeaderSize:b.GetLength()]
+}
+
+// GetLength ...
+func (b Buffer) GetLength() int {
+	return HeaderSize + TagSize + b.Header().GetLength()
+}
+
+// Header ...
+type Header []byte
+
+// GetLength ...
+func (h Header) GetLength() int {
+	return int(binary.LittleEndian.Uint32(h[0:HeaderSize-StandardNonceSize])&0xFFFFFF) + 1
+}
+
+// SetLength ...
+func (h Header) SetLength(length int) {
+	flags := h[HeaderSize-StandardNonceSize-1]
+	binary.LittleEndian.PutUint32(h[0:HeaderSize-StandardNonceSize], uint32(length-1))
+	h[HeaderSize-StandardNonceSize-1] = flags
+}
+
+// CipherID - the cipher suite a burst is sealed with. it is kept in the
+// high byte of the length, which payloads never reach, so streams written
+// before suites were recorded read as AES256GCM
+func (h Header) CipherID() byte {
+	return h[HeaderSize-StandardNonceSize-1] &^ HeaderPaddedFlag
+}
+
+// SetCipherID ...
+func (h Header) SetCipherID(id byte) {
+	h[HeaderSize-StandardNonceSize-1] = h[HeaderSize-StandardNonceSize-1]&HeaderPaddedFlag | id
+}
+
+// IsPadded - reports whether the stream holds a padded plaintext. it is
+// part of the additional data, so it is authenticated with the burst
+func (h Header) IsPadded() bool {
+	return h[HeaderSize-StandardNonceSize-1]&HeaderPaddedFlag == HeaderPaddedFlag
+}
+
+// SetPadded ...
+func (h Header) SetPadded(padded bool) {
+	if padded {
+		h[HeaderSize-StandardNonceSize-1] |= HeaderPaddedFlag
+	} else {
+		h[HeaderSize-StandardNonceSize-1] &^= HeaderPaddedFlag
+	}
+}
+
+// IsFinal ...
+func (h Header) IsFinal() bool {
+	return h[HeaderSize-StandardNonceSize]&HeaderFinalFlag == HeaderFinalFlag
+}
+
+// Nonce ...
+func (h Header) Nonce() []byte {
+	return h[HeaderSize-StandardNonceSize : HeaderSize]
+}
+
+// AddData ...
+func (h Header) AddData() []byte {
+	return h[:HeaderSize-StandardNonceSize]
+}
+
+// SetRand ...
+func (h Header) SetRand(randVal []byte, final bool) {
+	copy(h[HeaderSize-StandardNonceSize:], randVal)
+	if final {
+		//  h[HeaderSize - StandardNonceSize] | 1000 0000
+		h[HeaderSize-StandardNonceSize] |= HeaderFinalFlag
+	} else {
+		//  h[HeaderSize - StandardNonceSize] | 0111 1111
+		h[HeaderSize-StandardNonceSize] &= 0x7F
+	}
+}
@@ -0,0 +1,51 @@
+package stream
+
+import (
+	"io"
+)
+
+// Option - options setter method for encrypting and decrypting streams
+type Option func(*config)
+
+// config ...
+type config struct {
+	cipherID    byte
+	padded      bool
+	rand        io.Reader
+	concurrency int
+}
+
+// WithCipher - seals bursts with the given cipher suite instead of
+// AES256GCM
+func WithCipher(arg byte) Option {
+	return func(c *config) {
+		c.cipherID = arg
+	}
+}
+
+// WithPadded - marks every burst of the stream as holding a padded
+// plaintext, so readers know to strip the padding without looking at the
+// plaintext. see IsPadded
+func WithPadded() Option {
+	return func(c *config) {
+		c.padded = true
+	}
+}
+
+// WithRand - draws the stream nonce from arg instead of crypto/rand. it is
+// meant for deterministic streams such as convergent encryption and test
+// vectors; a nonce must never be used twice with the same key
+func WithRand(arg io.Reader) Option {
+	return func(c *config) {
+		c.rand = arg
+	}
+}
+
+// WithConcurrency - seals or opens up to arg bursts at once, one per
+// goroutine. streams are byte identical to the ones sealed one burst at a
+// time; values below 2 keep the serial path
+func WithConcurrency(arg int) Option {
+	return func(c *config) {
+		c.concurrency = arg
+	}
+}
@@ -0,0 +1,237 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"io"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+// parallelEncryptor seals the bursts of a stream in batches, spread over a
+// pool of workers. a burst only depends on the stream nonce and its
+// sequence number, so the stream is the one encryptor would produce
+type parallelEncryptor struct {
+	encryptor *encryptor
+	workers   []cipher.AEAD
+	// plain holds the plaintext of the next batch and one byte read past
+	// it, since only the last burst may be final
+	plain  []byte
+	filled int
+	out    []byte
+	offset int
+	length int
+}
+
+func newParallelEncryptor(e *encryptor, concurrency int) (*parallelEncryptor, error) {
+	result := &parallelEncryptor{
+		encryptor: e,
+		workers:   make([]cipher.AEAD, concurrency),
+		plain:     make([]byte, concurrency*MaxPayloadSize+1),
+		out:       make([]byte, concurrency*MaxBufferSize),
+	}
+	for i := range result.workers {
+		aead, err := newAEAD(e.cipherID, e.key)
+		if err != nil {
+			return nil, err
+		}
+		result.workers[i] = aead
+	}
+	return result, nil
+}
+
+// Read ...
+func (p *parallelEncryptor) Read(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if p.offset == p.length {
+			if p.encryptor.finalized {
+				return n, io.EOF
+			}
+			err := p.fill()
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		count := copy(b, p.out[p.offset:p.length])
+		p.offset += count
+		b = b[count:]
+		n += count
+	}
+	return n, nil
+}
+
+// fill reads and seals the next batch of bursts
+func (p *parallelEncryptor) fill() error {
+	e := p.encryptor
+	nn, err := io.ReadFull(e.reader, p.plain[p.filled:])
+	p.filled += nn
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		err = stacktrace.Propagate(err, "[ERROR] parallel encryptor failed to read from reader")
+		return err
+	}
+	final := err != nil
+	size := p.filled
+	if !final {
+		size--
+	}
+	p.offset, p.length = 0, 0
+	if size == 0 {
+		e.finalized = true
+		return nil
+	}
+	bursts := (size + MaxPayloadSize - 1) / MaxPayloadSize
+	runBursts(len(p.workers), bursts, func(worker, i int) error {
+		end := (i + 1) * MaxPayloadSize
+		if end > size {
+			end = size
+		}
+		sealBurst(
+			p.workers[worker],
+			e.cipherID,
+			e.padded,
+			e.randVal,
+			e.sequenceNumber+uint32(i),
+			p.out[i*MaxBufferSize:],
+			p.plain[i*MaxPayloadSize:end],
+			final && i == bursts-1,
+		)
+		return nil
+	})
+	e.sequenceNumber += uint32(bursts)
+	e.finalized = final
+	p.length = size + bursts*(HeaderSize+TagSize)
+	p.filled = 0
+	if !final {
+		p.plain[0] = p.plain[size]
+		p.filled = 1
+	}
+	return nil
+}
+
+// parallelDecryptor checks the headers of a batch of bursts in order and
+// opens them on a pool of workers
+type parallelDecryptor struct {
+	decryptor *decryptor
+	workers   []cipher.AEAD
+	in        []byte
+	out       []byte
+	offset    int
+	length    int
+}
+
+func newParallelDecryptor(d *decryptor, concurrency int) *parallelDecryptor {
+	return &parallelDecryptor{
+		decryptor: d,
+		workers:   make([]cipher.AEAD, concurrency),
+		in:        make([]byte, concurrency*MaxBufferSize),
+		out:       make([]byte, concurrency*MaxPayloadSize),
+	}
+}
+
+// Read ...
+func (p *parallelDecryptor) Read(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if p.offset == p.length {
+			err := p.fill()
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		count := copy(b, p.out[p.offset:p.length])
+		p.offset += count
+		b = b[count:]
+		n += count
+	}
+	return n, nil
+}
+
+// fill reads, authenticates and decrypts the next batch of bursts
+func (p *parallelDecryptor) fill() error {
+	d := p.decryptor
+	nn, err := io.ReadFull(d.reader, p.in)
+	if err == io.EOF {
+		if !d.finalized {
+			err = stacktrace.Propagate(ErrUnexpectedEOF, "[ERROR] parallel decryptor reached EOF without getting final data burst")
+		}
+		return err
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	type burst struct {
+		src            []byte
+		dst            []byte
+		sequenceNumber uint32
+	}
+	bursts := []burst{}
+	size := 0
+	for pos := 0; pos < nn; {
+		src := p.in[pos:nn]
+		if len(src) > HeaderSize {
+			if length := Buffer(src).GetLength(); length < len(src) {
+				src = src[:length]
+			}
+		}
+		sequenceNumber, err := d.check(src)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] parallel decryptor could not check burst #%d", d.sequenceNumber)
+			return err
+		}
+		bursts = append(bursts, burst{
+			src:            src,
+			dst:            p.out[size:],
+			sequenceNumber: sequenceNumber,
+		})
+		size += len(src) - HeaderSize - TagSize
+		pos += len(src)
+	}
+	if p.workers[0] == nil {
+		// the cipher suite is only known once the first header is checked
+		p.workers[0] = d.cipher
+		for i := 1; i < len(p.workers); i++ {
+			p.workers[i], err = newAEAD(d.header.CipherID(), d.key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = runBursts(len(p.workers), len(bursts), func(worker, i int) error {
+		return openBurst(p.workers[worker], bursts[i].dst, bursts[i].src, bursts[i].sequenceNumber)
+	})
+	if err != nil {
+		return err
+	}
+	p.offset, p.length = 0, size
+	return nil
+}
+
+// runBursts calls fn for bursts [0, bursts) on up to workers goroutines,
+// passing the worker each burst runs on. it returns the error of the first
+// burst that failed
+func runBursts(workers, bursts int, fn func(worker, i int) error) error {
+	if workers > bursts {
+		workers = bursts
+	}
+	errs := make([]error, bursts)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < bursts; i += workers {
+				errs[i] = fn(w, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+)
+
+// benchmarkSize is the plaintext size of a benchmarked stream, large
+// enough for every worker to seal many bursts
+const benchmarkSize = 16 << 20
+
+var benchmarkKey = bytes.Repeat([]byte{0x42}, 32)
+
+var benchmarkCiphers = []string{"aes-256-gcm", "xchacha20-poly1305"}
+
+// concurrencies compares a single worker with several, and with one per
+// cpu when there are more
+func concurrencies() []int {
+	result := []int{1, 4}
+	if n := runtime.NumCPU(); n > 4 {
+		result = append(result, n)
+	}
+	return result
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	plaintext := make([]byte, benchmarkSize)
+	for _, name := range benchmarkCiphers {
+		cipherID, err := ParseCipher(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, n := range concurrencies() {
+			b.Run(fmt.Sprintf("%s/concurrency=%d", name, n), func(b *testing.B) {
+				b.SetBytes(benchmarkSize)
+				for i := 0; i < b.N; i++ {
+					r, err := NewEncryptReader(bytes.NewReader(plaintext), benchmarkKey, WithCipher(cipherID), WithConcurrency(n))
+					if err != nil {
+						b.Fatal(err)
+					}
+					_, err = io.Copy(ioutil.Discard, r)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	plaintext := make([]byte, benchmarkSize)
+	for _, name := range benchmarkCiphers {
+		cipherID, err := ParseCipher(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r, err := NewEncryptReader(bytes.NewReader(plaintext), benchmarkKey, WithCipher(cipherID))
+		if err != nil {
+			b.Fatal(err)
+		}
+		ciphertext, err := ioutil.ReadAll(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, n := range concurrencies() {
+			b.Run(fmt.Sprintf("%s/concurrency=%d", name, n), func(b *testing.B) {
+				b.SetBytes(benchmarkSize)
+				for i := 0; i < b.N; i++ {
+					r, err := NewDecryptReader(bytes.NewReader(ciphertext), benchmarkKey, WithConcurrency(n))
+					if err != nil {
+						b.Fatal(err)
+					}
+					_, err = io.Copy(ioutil.Discard, r)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+// DecryptingReader - reads the plaintext of an encrypted object at any
+// offset. every burst but the last holds MaxPayloadSize bytes, so the
+// bursts covering a range are located without reading the ones before
+// them, and each is authenticated on its own against its sequence number
+type DecryptingReader struct {
+	lock   sync.Mutex
+	src    io.ReaderAt
+	key    []byte
+	cipher cipher.AEAD
+	// header is the header of the first burst, the others are checked
+	// against
+	header Header
+	bursts int64
+	// lastSize is the encrypted size of the final burst
+	lastSize int64
+	size     int64
+	offset   int64
+	// cached is the last burst opened, kept for sequential reads
+	cachedIndex int64
+	cached      []byte
+}
+
+// NewDecryptingReader - returns a DecryptingReader over the encrypted
+// object src, encryptedSize bytes long, sealed with key
+func NewDecryptingReader(src io.ReaderAt, encryptedSize int64, key []byte) (*DecryptingReader, error) {
+	if len(key) != KeySize {
+		err := stacktrace.NewError("[ERROR] decrypting reader cannot be initialized due to invalid key size")
+		return nil, err
+	}
+	result := &DecryptingReader{
+		src:         src,
+		key:         key,
+		cachedIndex: -1,
+	}
+	if encryptedSize == 0 {
+		return result, nil
+	}
+	result.bursts = (encryptedSize + MaxBufferSize - 1) / MaxBufferSize
+	result.lastSize = encryptedSize - (result.bursts-1)*MaxBufferSize
+	if result.lastSize <= HeaderSize+TagSize {
+		err := stacktrace.Propagate(ErrInvalidPayloadSize, "[ERROR] encrypted object of (%d) bytes is truncated", encryptedSize)
+		return nil, err
+	}
+	result.size = (result.bursts-1)*MaxPayloadSize + result.lastSize - HeaderSize - TagSize
+	result.header = make(Header, HeaderSize)
+	_, err := src.ReadAt(result.header, 0)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not read the header of the encrypted object")
+		return nil, err
+	}
+	result.cipher, err = newAEAD(result.header.CipherID(), key)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Size - returns the plaintext size of the object
+func (r *DecryptingReader) Size() int64 {
+	return r.size
+}
+
+// Padded - reports whether the object was sealed WithPadded. every burst
+// read is checked to agree with it
+func (r *DecryptingReader) Padded() bool {
+	return r.header != nil && r.header.IsPadded()
+}
+
+// ReadAt - decrypts len(p) bytes starting at off, reading only the bursts
+// holding them
+func (r *DecryptingReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, stacktrace.NewError("[ERROR] negative offset (%d)", off)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for n < len(p) {
+		position := off + int64(n)
+		if position >= r.size {
+			return n, io.EOF
+		}
+		index := position / MaxPayloadSize
+		payload, err := r.burst(index)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], payload[position-index*MaxPayloadSize:])
+	}
+	return n, nil
+}
+
+// Read - decrypts from the current offset
+func (r *DecryptingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek - sets the offset of the next Read
+func (r *DecryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.offset, stacktrace.NewError("[ERROR] invalid whence (%d)", whence)
+	}
+	if offset < 0 {
+		return r.offset, stacktrace.NewError("[ERROR] negative offset (%d)", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// burst reads, authenticates and decrypts burst index
+func (r *DecryptingReader) burst(index int64) ([]byte, error) {
+	if index == r.cachedIndex {
+		return r.cached, nil
+	}
+	size := int64(MaxBufferSize)
+	final := index == r.bursts-1
+	if final {
+		size = r.lastSize
+	}
+	src := make(Buffer, size)
+	_, err := r.src.ReadAt(src, index*MaxBufferSize)
+	if err != nil && !(err == io.EOF && final) {
+		err = stacktrace.Propagate(err, "[ERROR] could not read burst #%d of the encrypted object", index)
+		return nil, err
+	}
+	header := src.Header()
+	if header.CipherID() != r.header.CipherID() || header.IsPadded() != r.header.IsPadded() {
+		return nil, ErrCipherMismatch
+	}
+	if int64(HeaderSize+TagSize+header.GetLength()) != size {
+		err = stacktrace.Propagate(ErrInvalidPayloadSize, "[ERROR] burst #%d length does not match its position", index)
+		return nil, err
+	}
+	// only the last burst may be final, which catches truncated objects
+	if header.IsFinal() != final {
+		err = stacktrace.Propagate(ErrUnexpectedEOF, "[ERROR] burst #%d final flag does not match its position", index)
+		return nil, err
+	}
+	refNonce := append([]byte{}, r.header.Nonce()...)
+	refNonce[0] &= 0x7F
+	if final {
+		refNonce[0] |= HeaderFinalFlag
+	}
+	if subtle.ConstantTimeCompare(header.Nonce(), refNonce) != 1 {
+		return nil, ErrNonceMismatch
+	}
+	var nonce [StandardNonceSize]byte
+	copy(nonce[:], header.Nonce())
+	binary.LittleEndian.PutUint32(
+		nonce[8:],
+		binary.LittleEndian.Uint32(nonce[8:])^uint32(index),
+	)
+	payload, err := r.cipher.Open(
+		nil,
+		aeadNonce(r.cipher, nonce[:]),
+		src[HeaderSize:],
+		header.AddData(),
+	)
+	if err != nil {
+		err = stacktrace.Propagate(err, ErrAuthentication.Error())
+		err = stacktrace.Propagate(err, "[ERROR] could not authenticate burst #%d of the encrypted object", index)
+		return nil, err
+	}
+	r.cachedIndex = index
+	r.cached = payload
+	return payload, nil
+}
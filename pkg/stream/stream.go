@@ -0,0 +1,427 @@
+package stream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// encryptor ...
+type encryptor struct {
+	reader         io.Reader
+	key            []byte
+	rand           io.Reader
+	buffer         Buffer
+	offset         int
+	lastByte       byte
+	firstRead      bool
+	cipherID       byte
+	padded         bool
+	cipher         cipher.AEAD
+	randVal        []byte
+	sequenceNumber uint32
+	finalized      bool
+}
+
+// NewEncryptReader - returns an io.Reader that encrypts everything it
+// reads from reader with key
+func NewEncryptReader(reader io.Reader, key []byte, opts ...Option) (io.Reader, error) {
+	e, err := newEncryptor(reader, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if n := newConfig(opts...).concurrency; n > 1 {
+		return newParallelEncryptor(e, n)
+	}
+	return e, nil
+}
+
+// NewDecryptReader - returns an io.Reader that decrypts and authenticates
+// everything it reads from reader with key. the cipher suite is read from
+// the stream; of the options, only WithConcurrency applies
+func NewDecryptReader(reader io.Reader, key []byte, opts ...Option) (io.Reader, error) {
+	d, err := newDecryptor(reader, key)
+	if err != nil {
+		return nil, err
+	}
+	if n := newConfig(opts...).concurrency; n > 1 {
+		return newParallelDecryptor(d, n), nil
+	}
+	return d, nil
+}
+
+// newConfig returns the defaults overridden by opts
+func newConfig(opts ...Option) *config {
+	c := &config{
+		cipherID: AES256GCM,
+		rand:     rand.Reader,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// newEncryptor returns an io.Reader that encrypts everything it reads.
+func newEncryptor(reader io.Reader, key []byte, opts ...Option) (*encryptor, error) {
+	var err error
+	c := newConfig(opts...)
+	result := &encryptor{
+		key:       key,
+		reader:    reader,
+		buffer:    make(Buffer, MaxBufferSize),
+		firstRead: true,
+	}
+	if len(result.key) != KeySize {
+		err := stacktrace.NewError("[ERROR] encryptor cannot be initialized due to invalid key size")
+		return nil, err
+	}
+	result.rand = c.rand
+	result.cipherID = c.cipherID
+	result.padded = c.padded
+	result.cipher, err = newAEAD(c.cipherID, result.key)
+	if err != nil {
+		return nil, err
+	}
+	var randVal [12]byte
+	_, err = io.ReadFull(result.rand, randVal[:])
+	if err != nil {
+		return nil, err
+	}
+	result.randVal = randVal[:]
+	return result, nil
+}
+
+// Read ...
+func (e *encryptor) Read(p []byte) (int, error) {
+	var (
+		count int
+		err   error
+	)
+	if e.firstRead {
+		e.firstRead = false
+		_, err = io.ReadFull(e.reader, e.buffer[HeaderSize:HeaderSize+1])
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if err == io.EOF {
+			e.finalized = true
+			return 0, io.EOF
+		}
+		e.lastByte = e.buffer[HeaderSize]
+	}
+
+	if e.offset > 0 {
+		remaining := e.buffer.GetLength() - e.offset
+		if len(p) < remaining {
+			e.offset += copy(p, e.buffer[e.offset:e.offset+len(p)])
+			return len(p), nil
+		}
+		count = copy(p, e.buffer[e.offset:e.offset+remaining])
+		p = p[remaining:]
+		e.offset = 0
+	}
+	if e.finalized {
+		return count, io.EOF
+	}
+	finalize := false
+
+	for len(p) >= MaxBufferSize {
+		e.buffer[HeaderSize] = e.lastByte
+		nn, err := io.ReadFull(
+			e.reader,
+			e.buffer[HeaderSize+1:HeaderSize+1+MaxPayloadSize],
+		)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			err = stacktrace.Propagate(err, "[ERROR] encryptor failed to read maximum payload from reader")
+			return count, err
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			finalize = true
+			e.seal(p, e.buffer[HeaderSize:HeaderSize+1+nn], finalize)
+			return count + HeaderSize + TagSize + 1 + nn, io.EOF
+		}
+		e.lastByte = e.buffer[HeaderSize+MaxPayloadSize]
+		e.seal(p, e.buffer[HeaderSize:HeaderSize+MaxPayloadSize], finalize)
+		p = p[MaxBufferSize:]
+		count += MaxBufferSize
+	}
+	if len(p) > 0 {
+		e.buffer[HeaderSize] = e.lastByte
+		nn, err := io.ReadFull(
+			e.reader,
+			e.buffer[HeaderSize+1:HeaderSize+1+MaxPayloadSize],
+		)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			err = stacktrace.Propagate(err, "[ERROR] encryptor failed to read from reader")
+			return count, err
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			finalize = true
+			e.seal(e.buffer, e.buffer[HeaderSize:HeaderSize+1+nn], finalize)
+			if len(p) > e.buffer.GetLength() {
+				count += copy(p, e.buffer[:e.buffer.GetLength()])
+				return count, io.EOF
+			}
+		} else {
+			e.lastByte = e.buffer[HeaderSize+MaxPayloadSize]
+			e.seal(e.buffer, e.buffer[HeaderSize:HeaderSize+MaxPayloadSize], finalize)
+		}
+		e.offset = copy(p, e.buffer[:len(p)])
+		count += e.offset
+	}
+	return count, nil
+}
+
+func (e *encryptor) seal(dst, src []byte, finalize bool) {
+	if e.finalized {
+		err := stacktrace.NewError("[ERROR] sealing byte bursts after Close is not permitted")
+		panic(err)
+	}
+	e.finalized = finalize
+	sealBurst(e.cipher, e.cipherID, e.padded, e.randVal, e.sequenceNumber, dst, src, finalize)
+	e.sequenceNumber++
+}
+
+// sealBurst writes the burst number sequenceNumber of a stream, holding
+// src, to dst. bursts only depend on the stream nonce and their sequence
+// number, so they can be sealed in any order
+func sealBurst(c cipher.AEAD, cipherID byte, padded bool, randVal []byte, sequenceNumber uint32, dst, src []byte, finalize bool) {
+	header := Header(dst[:HeaderSize])
+	header.SetCipherID(cipherID)
+	header.SetPadded(padded)
+	header.SetLength(len(src))
+	header.SetRand(randVal, finalize)
+	c.Seal(dst[HeaderSize:HeaderSize], burstNonce(c, header, sequenceNumber), src, header.AddData())
+}
+
+// burstNonce returns the AEAD nonce of the burst number sequenceNumber
+// with the given header
+func burstNonce(c cipher.AEAD, header Header, sequenceNumber uint32) []byte {
+	var nonce [StandardNonceSize]byte
+	copy(nonce[:], header.Nonce())
+	binary.LittleEndian.PutUint32(
+		nonce[8:],
+		binary.LittleEndian.Uint32(nonce[8:])^sequenceNumber,
+	)
+	return aeadNonce(c, nonce[:])
+}
+
+// decryptor ...
+type decryptor struct {
+	rand           io.Reader
+	key            []byte
+	reader         io.Reader
+	buffer         Buffer
+	header         Header
+	finalized      bool
+	sequenceNumber uint32
+	cipher         cipher.AEAD
+	offset         int
+}
+
+// newDecryptor returns an io.Reader decrypts everything it reads.
+func newDecryptor(reader io.Reader, key []byte) (*decryptor, error) {
+	result := &decryptor{
+		key:    key,
+		reader: reader,
+		buffer: make(Buffer, MaxBufferSize),
+	}
+
+	if len(result.key) != KeySize {
+		err := stacktrace.NewError("[ERROR] Encryptor cannot be initialized due to invalid key size")
+		return nil, err
+	}
+	result.rand = rand.Reader
+	// the cipher is picked from the header of the first burst
+	return result, nil
+}
+
+// Read ...
+func (d *decryptor) Read(p []byte) (n int, err error) {
+	if d.offset > 0 {
+		remaining := len(d.buffer.Data()) - d.offset
+		if len(p) < remaining {
+			n = copy(p, d.buffer.Data()[d.offset:d.offset+len(p)])
+			d.offset += n
+			return n, nil
+		}
+		n = copy(p, d.buffer.Data()[d.offset:])
+		p = p[remaining:]
+		d.offset = 0
+	}
+	for len(p) >= MaxPayloadSize {
+		nn, err := io.ReadFull(d.reader, d.buffer)
+		if err == io.EOF && !d.finalized {
+			err = ErrUnexpectedEOF
+			err = stacktrace.Propagate(err, "[ERROR] decryptor Read failed because it reached EOF without getting final data burst")
+			return n, err
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			// err = stacktrace.Propagate(err, "[ERROR] decryptor Read failed because it reached EOF or reading from reader failed")
+
+			return n, err
+		}
+		err = d.metadata(p, d.buffer[:nn])
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] decryptor Read failed because it could not initialize metadata for the sequence")
+
+			return n, err
+		}
+		p = p[len(d.buffer.Data()):]
+		n += len(d.buffer.Data())
+	}
+	if len(p) > 0 {
+		nn, err := io.ReadFull(d.reader, d.buffer)
+		if err == io.EOF && !d.finalized {
+			err = ErrUnexpectedEOF
+			err = stacktrace.Propagate(err, "[ERROR] decryptor Read failed because it reached EOF without getting final data burst")
+			return n, err
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			// err = stacktrace.Propagate(err, "[ERROR] decryptor Read failed because it reached EOF or reading from reader failed")
+			return n, err
+		}
+		err = d.metadata(d.buffer[HeaderSize:], d.buffer[:nn])
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] decryptor Read failed because it could not initialize metadata for the sequence")
+			return n, err
+		}
+		payload := d.buffer.Data()
+		if len(p) < len(payload) {
+			d.offset = copy(p, payload[:len(p)])
+			n += d.offset
+		} else {
+			n += copy(p, payload)
+		}
+	}
+	return n, nil
+}
+
+// metadata ...
+func (d *decryptor) metadata(dst, src []byte) error {
+	sequenceNumber, err := d.check(src)
+	if err != nil {
+		return err
+	}
+	return openBurst(d.cipher, dst, src, sequenceNumber)
+}
+
+// check validates the header of the next burst, src, against the stream
+// and returns its sequence number. bursts are checked in order, but can
+// be opened in any order once checked
+func (d *decryptor) check(src []byte) (uint32, error) {
+	if d.finalized {
+
+		return 0, ErrUnexpectedData
+	}
+	if len(src) <= HeaderSize+TagSize {
+		err := ErrInvalidPayloadSize
+		err = stacktrace.Propagate(err, "[ERROR] Could not generate metadata for decryptor because current source length (%v) is lower than or equal to sum of header size constant (%v) and Tag size constant (%v)", len(src), HeaderSize, TagSize)
+		return 0, err
+	}
+
+	header := Buffer(src).Header()
+	if d.header == nil {
+		d.header = make([]byte, HeaderSize)
+		copy(d.header, header)
+		aead, err := newAEAD(header.CipherID(), d.key)
+		if err != nil {
+			return 0, err
+		}
+		d.cipher = aead
+	}
+	if header.CipherID() != d.header.CipherID() || header.IsPadded() != d.header.IsPadded() {
+		return 0, ErrCipherMismatch
+	}
+	if len(src) != HeaderSize+TagSize+header.GetLength() {
+		err := ErrInvalidPayloadSize
+		err = stacktrace.Propagate(err, "[ERROR] Could not generate metadata for decryptor because current source length (%v) is not equal to the sum of header size constant (%v) and Tag size constant (%v) and header size (%v)", len(src), HeaderSize, TagSize, header.GetLength())
+		return 0, err
+	}
+	if !header.IsFinal() && header.GetLength() != MaxPayloadSize {
+		err := ErrInvalidPayloadSize
+		err = stacktrace.Propagate(err, "[ERROR] Could not generate metadata for decryptor because unfinalized header length (%v) is not equal to the sum of max payload size constant (%v)", header.GetLength(), MaxPayloadSize)
+		return 0, err
+	}
+	refNonce := d.header.Nonce()
+	if header.IsFinal() {
+		d.finalized = true
+		refNonce[0] |= HeaderFinalFlag
+	}
+	if subtle.ConstantTimeCompare(header.Nonce(), refNonce[:]) != 1 {
+		return 0, ErrNonceMismatch
+	}
+	sequenceNumber := d.sequenceNumber
+	d.sequenceNumber++
+	return sequenceNumber, nil
+}
+
+// openBurst authenticates and decrypts the checked burst src into dst
+func openBurst(c cipher.AEAD, dst, src []byte, sequenceNumber uint32) error {
+	header := Buffer(src).Header()
+	ciphertext := src[HeaderSize : HeaderSize+header.GetLength()+TagSize]
+	_, err := c.Open(
+		dst[:0],
+		burstNonce(c, header, sequenceNumber),
+		ciphertext,
+		header.AddData(),
+	)
+	if err != nil {
+		err = stacktrace.Propagate(err, ErrAuthentication.Error())
+		err = stacktrace.Propagate(err, "[ERROR] Could not generate metadata for decryptor becuase cipher failed with decrypting and authenticating ciphertext")
+		return err
+	}
+	return nil
+}
+
+// newAEAD returns the cipher suite id keyed with key.
+func newAEAD(id byte, key []byte) (cipher.AEAD, error) {
+	switch id {
+	case AES256GCM:
+		aes256, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(aes256)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, stacktrace.Propagate(ErrUnknownCipher, "[ERROR] cipher suite (%d) is not supported", id)
+}
+
+// aeadNonce extends the 96-bit burst nonce to the nonce size of c. the
+// burst nonce is unique per stream and burst already, so XChaCha20's
+// extended nonce is zero padded rather than randomized.
+func aeadNonce(c cipher.AEAD, nonce []byte) []byte {
+	if c.NonceSize() == len(nonce) {
+		return nonce
+	}
+	result := make([]byte, c.NonceSize())
+	copy(result, nonce)
+	return result
+}
+
+// IsPadded - reports whether the stream starting with ciphertext was sealed
+// WithPadded. the flag is only authentic once the stream was decrypted
+func IsPadded(ciphertext []byte) bool {
+	return len(ciphertext) >= HeaderSize && Header(ciphertext[:HeaderSize]).IsPadded()
+}
+
+// ParseCipher - returns the cipher suite named name, one of [aes-256-gcm,
+// xchacha20-poly1305]
+func ParseCipher(name string) (byte, error) {
+	switch name {
+	case "", "aes-256-gcm":
+		return AES256GCM, nil
+	case "xchacha20-poly1305":
+		return XChaCha20Poly1305, nil
+	}
+	return 0, stacktrace.Propagate(ErrUnknownCipher, "[ERROR] cipher suite (%s) is not supported", name)
+}
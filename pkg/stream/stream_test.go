@@ -0,0 +1,318 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+// vector - a known answer for the stream format. the plaintext is length
+// bytes, byte i being i%256. every burst holds MaxPayloadSize bytes but the
+// last one, which has the final flag set on the first nonce byte. a burst
+// is sealed with its header nonce with the little endian burst sequence
+// number XORed into the last four bytes, zero padded to 24 bytes for
+// XChaCha20Poly1305, and the first four header bytes as additional data
+type vector struct {
+	name   string
+	cipher byte
+	// key is the hex encoded stream key
+	key string
+	// rand is the hex encoded stream nonce, as drawn when the stream is
+	// created
+	rand   string
+	length int
+	// headers are the hex encoded headers of the bursts
+	headers []string
+	// nonces are the hex encoded AEAD nonces the bursts are sealed with
+	nonces []string
+	// digest is the hex encoded SHA-256 of the whole stream
+	digest string
+}
+
+var vectors = []vector{
+	{
+		name:    "aes-256-gcm single byte",
+		cipher:  AES256GCM,
+		key:     "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		rand:    "a0a1a2a3a4a5a6a7a8a9aaab",
+		length:  1,
+		headers: []string{"00000000a0a1a2a3a4a5a6a7a8a9aaab"},
+		nonces:  []string{"a0a1a2a3a4a5a6a7a8a9aaab"},
+		digest:  "20461ebfa65018baeaf99670ce4f0fec8719896f4dd25467b7e685a3961a5c44",
+	},
+	{
+		name:    "aes-256-gcm full burst",
+		cipher:  AES256GCM,
+		key:     "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		rand:    "a0a1a2a3a4a5a6a7a8a9aaab",
+		length:  MaxPayloadSize,
+		headers: []string{"ffff0000a0a1a2a3a4a5a6a7a8a9aaab"},
+		nonces:  []string{"a0a1a2a3a4a5a6a7a8a9aaab"},
+		digest:  "2c86322d6d98cad7f7970af4bc0d42501ed9501827267ee1f3f90235ef970177",
+	},
+	{
+		name:   "aes-256-gcm two bursts",
+		cipher: AES256GCM,
+		key:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		rand:   "20a1a2a3a4a5a6a7a8a9aaab",
+		length: MaxPayloadSize + 1,
+		headers: []string{
+			"ffff000020a1a2a3a4a5a6a7a8a9aaab",
+			"00000000a0a1a2a3a4a5a6a7a8a9aaab",
+		},
+		nonces: []string{
+			"20a1a2a3a4a5a6a7a8a9aaab",
+			"a0a1a2a3a4a5a6a7a9a9aaab",
+		},
+		digest: "e59d940684bcdba9873316f5d291f3d426ae184f3243ed77c5abb1ac9fa6a648",
+	},
+	{
+		name:   "xchacha20-poly1305 three bursts",
+		cipher: XChaCha20Poly1305,
+		key:    "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100",
+		rand:   "0102030405060708090a0b0c",
+		length: 2*MaxPayloadSize + 100,
+		headers: []string{
+			"ffff00010102030405060708090a0b0c",
+			"ffff00010102030405060708090a0b0c",
+			"630000018102030405060708090a0b0c",
+		},
+		nonces: []string{
+			"0102030405060708090a0b0c000000000000000000000000",
+			"0102030405060708080a0b0c000000000000000000000000",
+			"81020304050607080b0a0b0c000000000000000000000000",
+		},
+		digest: "f08ad4ef7fd04a84856135ccf3b7fd4e8e9069574d1000a87df47e4c3e71c44f",
+	},
+}
+
+func (v *vector) plaintext() []byte {
+	result := make([]byte, v.length)
+	for i := range result {
+		result[i] = byte(i)
+	}
+	return result
+}
+
+func (v *vector) seal(t *testing.T, concurrency int) []byte {
+	t.Helper()
+	reader, err := NewEncryptReader(
+		bytes.NewReader(v.plaintext()),
+		decodeHex(t, v.key),
+		WithCipher(v.cipher),
+		WithRand(bytes.NewReader(decodeHex(t, v.rand))),
+		WithConcurrency(concurrency),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	result, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// bursts splits a stream into its bursts
+func bursts(t *testing.T, ciphertext []byte) [][]byte {
+	t.Helper()
+	result := make([][]byte, 0)
+	for offset := 0; offset < len(ciphertext); {
+		n := Buffer(ciphertext[offset:]).GetLength()
+		if offset+n > len(ciphertext) {
+			t.Fatalf("burst #%d runs past the end of the stream", len(result))
+		}
+		result = append(result, ciphertext[offset:offset+n])
+		offset += n
+	}
+	return result
+}
+
+// open decrypts ciphertext with a decrypt reader and a decrypt writer,
+// failing the test when they disagree
+func open(t *testing.T, ciphertext, key []byte) ([]byte, error) {
+	t.Helper()
+	reader, err := NewDecryptReader(bytes.NewReader(ciphertext), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromReader, readErr := ioutil.ReadAll(reader)
+	fromWriter := bytes.NewBuffer(nil)
+	writer, err := NewDecryptWriter(fromWriter, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, writeErr := writer.Write(ciphertext)
+	if writeErr == nil {
+		writeErr = writer.Close()
+	}
+	if (readErr == nil) != (writeErr == nil) {
+		t.Fatalf("decrypt reader returned (%v) but decrypt writer returned (%v)", readErr, writeErr)
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if !bytes.Equal(fromReader, fromWriter.Bytes()) {
+		t.Fatal("decrypt reader and decrypt writer returned different plaintexts")
+	}
+	return fromReader, nil
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			key := decodeHex(t, v.key)
+			for _, concurrency := range []int{1, 4} {
+				ciphertext := v.seal(t, concurrency)
+				digest := sha256.Sum256(ciphertext)
+				if hex.EncodeToString(digest[:]) != v.digest {
+					t.Fatalf("stream digest with (%d) workers is %x, want %s", concurrency, digest, v.digest)
+				}
+			}
+			ciphertext := v.seal(t, 1)
+			aead, err := newAEAD(v.cipher, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all := bursts(t, ciphertext)
+			if len(all) != len(v.headers) {
+				t.Fatalf("stream has %d bursts, want %d", len(all), len(v.headers))
+			}
+			for i, burst := range all {
+				header := Buffer(burst).Header()
+				if hex.EncodeToString(header) != v.headers[i] {
+					t.Fatalf("burst #%d header is %x, want %s", i, []byte(header), v.headers[i])
+				}
+				var nonce [StandardNonceSize]byte
+				copy(nonce[:], header.Nonce())
+				binary.LittleEndian.PutUint32(nonce[8:], binary.LittleEndian.Uint32(nonce[8:])^uint32(i))
+				sealNonce := aeadNonce(aead, nonce[:])
+				if hex.EncodeToString(sealNonce) != v.nonces[i] {
+					t.Fatalf("burst #%d nonce is %x, want %s", i, sealNonce, v.nonces[i])
+				}
+				// the burst must open with the nonce the vector documents
+				_, err = aead.Open(nil, sealNonce, burst[HeaderSize:], header.AddData())
+				if err != nil {
+					t.Fatalf("burst #%d does not open with its documented nonce: %v", i, err)
+				}
+			}
+			plaintext, err := open(t, ciphertext, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, v.plaintext()) {
+				t.Fatal("decrypted stream does not match the plaintext")
+			}
+		})
+	}
+}
+
+func TestTampering(t *testing.T) {
+	cases := []struct {
+		name string
+		// tamper returns a modified copy of the bursts of a stream
+		tamper func(all [][]byte) [][]byte
+	}{
+		{
+			name: "final burst dropped",
+			tamper: func(all [][]byte) [][]byte {
+				return all[:len(all)-1]
+			},
+		},
+		{
+			name: "final burst cut short",
+			tamper: func(all [][]byte) [][]byte {
+				last := all[len(all)-1]
+				return append(all[:len(all)-1], last[:len(last)-1])
+			},
+		},
+		{
+			name: "burst cut after its header",
+			tamper: func(all [][]byte) [][]byte {
+				return append(all[:len(all)-1], all[len(all)-1][:HeaderSize])
+			},
+		},
+		{
+			name: "bursts swapped",
+			tamper: func(all [][]byte) [][]byte {
+				return [][]byte{all[1], all[0], all[2]}
+			},
+		},
+		{
+			name: "burst repeated",
+			tamper: func(all [][]byte) [][]byte {
+				return [][]byte{all[0], all[0], all[1], all[2]}
+			},
+		},
+		{
+			name: "final flag set on a burst before the last",
+			tamper: func(all [][]byte) [][]byte {
+				first := append([]byte{}, all[0]...)
+				Header(first).SetRand(Header(first).Nonce(), true)
+				return [][]byte{first}
+			},
+		},
+		{
+			name: "final flag cleared on the last burst",
+			tamper: func(all [][]byte) [][]byte {
+				last := append([]byte{}, all[len(all)-1]...)
+				Header(last).SetRand(Header(last).Nonce(), false)
+				return append(all[:len(all)-1], last)
+			},
+		},
+		{
+			name: "ciphertext flipped",
+			tamper: func(all [][]byte) [][]byte {
+				second := append([]byte{}, all[1]...)
+				second[HeaderSize] ^= 1
+				return [][]byte{all[0], second, all[2]}
+			},
+		},
+		{
+			name: "burst appended after the final one",
+			tamper: func(all [][]byte) [][]byte {
+				return append(all, all[0])
+			},
+		},
+	}
+	for _, suite := range []string{"aes-256-gcm", "xchacha20-poly1305"} {
+		cipherID, err := ParseCipher(suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := vector{
+			cipher: cipherID,
+			key:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			rand:   "a0a1a2a3a4a5a6a7a8a9aaab",
+			length: 2*MaxPayloadSize + 100,
+		}
+		key := decodeHex(t, v.key)
+		all := bursts(t, v.seal(t, 1))
+		if len(all) != 3 {
+			t.Fatalf("stream has %d bursts, want 3", len(all))
+		}
+		for _, c := range cases {
+			c := c
+			t.Run(suite+"/"+c.name, func(t *testing.T) {
+				tampered := bytes.Join(c.tamper(append([][]byte{}, all...)), nil)
+				_, err := open(t, tampered, key)
+				if err == nil {
+					t.Fatal("tampered stream was decrypted without error")
+				}
+			})
+		}
+	}
+}
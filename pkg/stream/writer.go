@@ -0,0 +1,157 @@
+package stream
+
+import (
+	"io"
+
+	"github.com/palantir/stacktrace"
+)
+
+// encryptWriter seals everything written to it into bursts written to w
+type encryptWriter struct {
+	w         io.Writer
+	encryptor *encryptor
+	// pending holds plaintext not sealed yet. a full burst is only sealed
+	// once a byte past it is written, since the last burst must be final
+	pending []byte
+	out     Buffer
+	closed  bool
+}
+
+// NewEncryptWriter - returns an io.WriteCloser that encrypts everything
+// written to it with key and writes it to w. Close seals the final burst;
+// it does not close w
+func NewEncryptWriter(w io.Writer, key []byte, opts ...Option) (io.WriteCloser, error) {
+	e, err := newEncryptor(nil, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:         w,
+		encryptor: e,
+		pending:   make([]byte, 0, MaxPayloadSize+1),
+		out:       make(Buffer, MaxBufferSize),
+	}, nil
+}
+
+// Write ...
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, stacktrace.NewError("[ERROR] write to a closed encrypt writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		count := copy(e.pending[len(e.pending):cap(e.pending)], p)
+		e.pending = e.pending[:len(e.pending)+count]
+		p = p[count:]
+		n += count
+		if len(e.pending) > MaxPayloadSize {
+			err := e.flush(e.pending[:MaxPayloadSize], false)
+			if err != nil {
+				return n, err
+			}
+			e.pending = e.pending[:copy(e.pending, e.pending[MaxPayloadSize:])]
+		}
+	}
+	return n, nil
+}
+
+// Close - seals and writes the final burst. an empty stream writes nothing
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	if len(e.pending) == 0 {
+		return nil
+	}
+	return e.flush(e.pending, true)
+}
+
+func (e *encryptWriter) flush(src []byte, finalize bool) error {
+	e.encryptor.seal(e.out, src, finalize)
+	_, err := e.w.Write(e.out[:HeaderSize+len(src)+TagSize])
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] encrypt writer could not write burst")
+		return err
+	}
+	return nil
+}
+
+// decryptWriter authenticates and decrypts bursts written to it, writing
+// their plaintext to w
+type decryptWriter struct {
+	w         io.Writer
+	decryptor *decryptor
+	buffer    Buffer
+	// buffered is the number of bytes of the current burst in buffer
+	buffered int
+	started  bool
+	closed   bool
+}
+
+// NewDecryptWriter - returns an io.WriteCloser that decrypts everything
+// written to it with key and writes the plaintext to w. plaintext is only
+// written once its burst is authenticated. Close fails when the stream was
+// truncated; it does not close w
+func NewDecryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	d, err := newDecryptor(nil, key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptWriter{
+		w:         w,
+		decryptor: d,
+		buffer:    make(Buffer, MaxBufferSize),
+	}, nil
+}
+
+// Write ...
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	if d.closed {
+		return 0, stacktrace.NewError("[ERROR] write to a closed decrypt writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		if d.decryptor.finalized {
+			return n, ErrUnexpectedData
+		}
+		d.started = true
+		need := HeaderSize
+		if d.buffered >= HeaderSize {
+			need = d.buffer.GetLength()
+			if need > MaxBufferSize {
+				return n, ErrInvalidPayloadSize
+			}
+		}
+		count := copy(d.buffer[d.buffered:need], p)
+		d.buffered += count
+		p = p[count:]
+		n += count
+		if d.buffered < HeaderSize || d.buffered < d.buffer.GetLength() {
+			continue
+		}
+		err := d.decryptor.metadata(d.buffer[HeaderSize:], d.buffer[:d.buffered])
+		if err != nil {
+			return n, err
+		}
+		_, err = d.w.Write(d.buffer.Data())
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] decrypt writer could not write plaintext")
+			return n, err
+		}
+		d.buffered = 0
+	}
+	return n, nil
+}
+
+// Close - fails unless the stream ended with its final burst
+func (d *decryptWriter) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	if d.started && (!d.decryptor.finalized || d.buffered != 0) {
+		return stacktrace.Propagate(ErrUnexpectedEOF, "[ERROR] decrypt writer was closed before the final burst")
+	}
+	return nil
+}
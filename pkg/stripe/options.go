@@ -0,0 +1,64 @@
+package stripe
+
+import (
+	"sync"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/keylock"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+// Option - options setter method
+type Option func(*Storage)
+
+// Storage - a backend that spreads objects across several local disks,
+// placing each object with rendezvous hashing weighted by the free space
+// of every disk
+type Storage struct {
+	stateLock   sync.RWMutex
+	logOps      bool
+	initialized bool
+	// -----
+	disks []*disk
+	locks keylock.Locks
+}
+
+// disk is a single member of the stripe. a draining disk owns no keys; it
+// is only read from until a rebalance moved every object off it
+type disk struct {
+	storage  *file.Storage
+	layout   *Layout
+	draining bool
+}
+
+// LogOps -
+func LogOps() Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		e.logOps = true
+	}
+}
+
+// WithDisks - appends disks to the stripe
+func WithDisks(arg ...*file.Storage) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		for _, storage := range arg {
+			e.disks = append(e.disks, &disk{storage: storage})
+		}
+	}
+}
+
+// WithDrainingDisks - appends disks that are leaving the stripe. objects
+// are still read from and deleted on them, but never written to them, and
+// a rebalance moves every object they hold to the other disks
+func WithDrainingDisks(arg ...*file.Storage) Option {
+	return func(e *Storage) {
+		e.stateLock.Lock()
+		defer e.stateLock.Unlock()
+		for _, storage := range arg {
+			e.disks = append(e.disks, &disk{storage: storage, draining: true})
+		}
+	}
+}
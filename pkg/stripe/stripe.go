@@ -0,0 +1,386 @@
+package stripe
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/jsonutil"
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/uuid"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+)
+
+// layoutKey is where every disk keeps its Layout
+const layoutKey = ".stripe"
+
+// Layout - identity and weight of a disk. it is persisted on the disk
+// itself, so placement only changes when a rebalance reweighs the disks
+type Layout struct {
+	ID     string  `json:"id" mapstructure:"id"`
+	Weight float64 `json:"weight" mapstructure:"weight"`
+}
+
+// New - constructs a new striped Storage
+func New(opts ...Option) *Storage {
+	result := &Storage{}
+	for _, opt := range opts {
+		opt(result)
+	}
+	return result
+}
+
+// Init - initializes every disk and loads its layout, weighing disks that
+// join the stripe for the first time
+func (b *Storage) Init() error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	if b.initialized {
+		return nil
+	}
+	owners := 0
+	for _, d := range b.disks {
+		if !d.draining {
+			owners++
+		}
+	}
+	if owners == 0 {
+		err := stacktrace.NewError("[FATAL] Stripe Storage : no disk is given, besides the ones being drained")
+		return err
+	}
+	ctx := context.Background()
+	for i, d := range b.disks {
+		if d.draining {
+			_, err := os.Stat(d.storage.Path())
+			if err != nil {
+				err = stacktrace.Propagate(err, "[FATAL] Stripe Storage : could not find root of draining disk #%d", i)
+				return err
+			}
+		}
+		err := os.MkdirAll(d.storage.Path(), 0700)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[FATAL] Stripe Storage : could not make root of disk #%d", i)
+			return err
+		}
+		err = d.storage.Init()
+		if err != nil {
+			err = stacktrace.Propagate(err, "[FATAL] Stripe Storage : could not initialize disk #%d", i)
+			return err
+		}
+		entry, err := d.storage.Get(ctx, layoutKey)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[FATAL] Stripe Storage : could not read layout of disk #%d", i)
+			return err
+		}
+		if entry != nil {
+			layout := &Layout{}
+			err = jsonutil.DecodeJSON(entry.Value, layout)
+			if err != nil {
+				err = stacktrace.Propagate(err, "[FATAL] Stripe Storage : could not decode layout of disk #%d", i)
+				return err
+			}
+			d.layout = layout
+			continue
+		}
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			return err
+		}
+		d.layout = &Layout{ID: id}
+		if d.draining {
+			continue
+		}
+		err = b.weigh(ctx, d)
+		if err != nil {
+			return err
+		}
+	}
+	b.initialized = true
+	if b.logOps {
+		for _, d := range b.disks {
+			if d.draining {
+				colorstring.Println(fmt.Sprintf("[yellow][INFO] Stripe Storage: disk (%s) at (%s) is being drained", d.layout.ID, d.storage.Path()))
+				continue
+			}
+			colorstring.Println(fmt.Sprintf("[yellow][INFO] Stripe Storage: disk (%s) at (%s) has a weight of %.0f", d.layout.ID, d.storage.Path(), d.layout.Weight))
+		}
+	}
+	return nil
+}
+
+// Put - stores entry on the disk that owns its key
+func (b *Storage) Put(ctx context.Context, entry *file.Entry) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Stripe Storage :was not initialized")
+		return err
+	}
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(entry.Key)
+	lock.Lock()
+	defer lock.Unlock()
+	return b.owner(entry.Key).storage.Put(ctx, entry)
+}
+
+// Get - reads k from the disk that owns it, falling back to the other
+// disks for objects a rebalance has not moved yet
+func (b *Storage) Get(ctx context.Context, k string) (*file.Entry, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Stripe Storage :was not initialized")
+		return nil, err
+	}
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	owner := b.owner(k)
+	entry, err := owner.storage.Get(ctx, k)
+	if err != nil || entry != nil {
+		return entry, err
+	}
+	for _, d := range b.disks {
+		if d == owner {
+			continue
+		}
+		entry, err = d.storage.Get(ctx, k)
+		if err != nil || entry != nil {
+			return entry, err
+		}
+	}
+	return nil, nil
+}
+
+// GetRange - reads length bytes of k, starting at offset, from the disk
+// that owns it, falling back to the other disks like Get does
+func (b *Storage) GetRange(ctx context.Context, k string, offset, length int64) ([]byte, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Stripe Storage :was not initialized")
+		return nil, err
+	}
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	owner := b.owner(k)
+	disks := append([]*disk{owner}, b.disks...)
+	for i, d := range disks {
+		if i != 0 && d == owner {
+			continue
+		}
+		entry, err := d.storage.Stat(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		return d.storage.GetRange(ctx, k, offset, length)
+	}
+	err := stacktrace.NewError("[ERROR] Stripe Storage: GetRange operation error. (%s) was not found", k)
+	return nil, err
+}
+
+// Delete - deletes k from every disk
+func (b *Storage) Delete(ctx context.Context, k string) error {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Stripe Storage :was not initialized")
+		return err
+	}
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	lock := b.locks.ForKey(k)
+	lock.Lock()
+	defer lock.Unlock()
+	for i, d := range b.disks {
+		err := d.storage.Delete(ctx, k)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Stripe Storage: Delete operation error. could not delete (%s) from disk #%d", k, i)
+			return err
+		}
+	}
+	return nil
+}
+
+// List - merges the listings of every disk
+func (b *Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Stripe Storage :was not initialized")
+		return nil, err
+	}
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	for i, d := range b.disks {
+		out, err := d.storage.List(ctx, prefix)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Stripe Storage: List operation error. could not list disk #%d", i)
+			return nil, err
+		}
+		for _, name := range out {
+			if len(prefix) == 0 && name == layoutKey {
+				continue
+			}
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Rebalance - moves every object that is not stored on the disk owning it,
+// which after adding or removing a disk are only the objects whose owner
+// changed, and every object of a draining disk. with reweigh, the weight
+// of every disk is first recomputed from its current free space. objects
+// are locked one at a time while they move, so the stripe stays usable
+// while it runs. it returns the number of objects moved
+func (b *Storage) Rebalance(ctx context.Context, reweigh bool) (int, error) {
+	if !b.initialized {
+		err := stacktrace.NewError("[ERROR] Stripe Storage :was not initialized")
+		return 0, err
+	}
+	if reweigh {
+		err := b.reweigh(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+	b.stateLock.RLock()
+	defer b.stateLock.RUnlock()
+	moved := 0
+	for _, d := range b.disks {
+		err := file.WalkKeys(ctx, d.storage, "", func(key string) error {
+			if key == layoutKey {
+				return nil
+			}
+			ok, err := b.move(ctx, d, key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				moved++
+			}
+			return nil
+		})
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] Stripe Storage: Rebalance operation failed on disk at (%s)", d.storage.Path())
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// reweigh recomputes the weight of every disk that is not being drained
+func (b *Storage) reweigh(ctx context.Context) error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	for _, d := range b.disks {
+		if d.draining {
+			continue
+		}
+		err := b.weigh(ctx, d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move moves key off d when d does not own it. a copy the owner already
+// holds was written after the one on d, so it is kept and d's is dropped
+func (b *Storage) move(ctx context.Context, d *disk, key string) (bool, error) {
+	owner := b.owner(key)
+	if owner == d {
+		return false, nil
+	}
+	lock := b.locks.ForKey(key)
+	lock.Lock()
+	defer lock.Unlock()
+	entry, err := d.storage.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if entry == nil {
+		return false, nil
+	}
+	current, err := owner.storage.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if current == nil {
+		err = owner.storage.Put(ctx, entry)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = d.storage.Delete(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if b.logOps {
+		colorstring.Println(fmt.Sprintf("[yellow][INFO] Stripe Storage: moved (%s) from (%s) to (%s)", key, d.storage.Path(), owner.storage.Path()))
+	}
+	return true, nil
+}
+
+// weigh sets the weight of d to its free space in GiB and persists its
+// layout
+func (b *Storage) weigh(ctx context.Context, d *disk) error {
+	free, err := freeSpace(d.storage.Path())
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Stripe Storage : could not get free space of (%s)", d.storage.Path())
+		return err
+	}
+	d.layout.Weight = math.Max(1, math.Floor(float64(free)/float64(1<<30)))
+	value, err := jsonutil.EncodeJSON(d.layout)
+	if err != nil {
+		return err
+	}
+	err = d.storage.Put(ctx, &file.Entry{
+		Key:   layoutKey,
+		Value: value,
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Stripe Storage : could not store layout of (%s)", d.storage.Path())
+		return err
+	}
+	return nil
+}
+
+// owner returns the disk key is placed on, using weighted rendezvous
+// hashing : every disk that is not being drained scores the key, and the
+// highest score wins
+func (b *Storage) owner(key string) *disk {
+	var (
+		result *disk
+		best   = math.Inf(-1)
+	)
+	for _, d := range b.disks {
+		if d.draining {
+			continue
+		}
+		sum := sha256.Sum256([]byte(d.layout.ID + "/" + key))
+		// uniform in (0,1) from the top 53 bits of the digest
+		u := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / float64(1<<53)
+		score := -d.layout.Weight / math.Log(u)
+		if score > best {
+			best = score
+			result = d
+		}
+	}
+	return result
+}
@@ -0,0 +1,153 @@
+package stripe
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+)
+
+func tempDirs(t *testing.T, count int) []string {
+	t.Helper()
+	result := make([]string, count)
+	for i := range result {
+		path, err := ioutil.TempDir("", "stripe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(path) })
+		result[i] = path
+	}
+	return result
+}
+
+func disksAt(paths ...string) []*file.Storage {
+	result := make([]*file.Storage, len(paths))
+	for i, path := range paths {
+		result[i] = file.New(file.WithPath(path))
+	}
+	return result
+}
+
+func newTestStorage(t *testing.T, opts ...Option) *Storage {
+	t.Helper()
+	b := New(opts...)
+	err := b.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func putObjects(t *testing.T, b *Storage, count int) []string {
+	t.Helper()
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("objects/%03d", i)
+		err := b.Put(context.Background(), &file.Entry{Key: keys[i], Value: []byte(keys[i])})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+// checkPlacement fails unless every key is readable and stored on its
+// owner only
+func checkPlacement(t *testing.T, b *Storage, keys []string) {
+	t.Helper()
+	ctx := context.Background()
+	for _, key := range keys {
+		entry, err := b.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || string(entry.Value) != key {
+			t.Fatalf("%s was lost", key)
+		}
+		for _, d := range b.disks {
+			stored, err := d.storage.Stat(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (stored != nil) != (d == b.owner(key)) {
+				t.Fatalf("%s is stored on (%s), owned by (%s)", key, d.storage.Path(), b.owner(key).storage.Path())
+			}
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	ctx := context.Background()
+	paths := tempDirs(t, 3)
+	keys := putObjects(t, newTestStorage(t, WithDisks(disksAt(paths[:2]...)...)), 64)
+	b := newTestStorage(t, WithDisks(disksAt(paths...)...))
+	for _, key := range keys {
+		entry, err := b.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			t.Fatalf("%s cannot be read before the rebalance", key)
+		}
+	}
+	moved, err := b.Rebalance(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 || moved == len(keys) {
+		t.Errorf("moved %d of %d objects onto the new disk", moved, len(keys))
+	}
+	checkPlacement(t, b, keys)
+	moved, err = b.Rebalance(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 0 {
+		t.Errorf("a second rebalance moved %d objects", moved)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	paths := tempDirs(t, 3)
+	keys := putObjects(t, newTestStorage(t, WithDisks(disksAt(paths...)...)), 64)
+	b := newTestStorage(t, WithDisks(disksAt(paths[:2]...)...), WithDrainingDisks(disksAt(paths[2])...))
+	drained := b.disks[2].storage
+	before, err := drained.List(ctx, "objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) == 0 {
+		t.Fatal("no object was placed on the disk to drain")
+	}
+	moved, err := b.Rebalance(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved < len(before) {
+		t.Errorf("moved %d objects, the drained disk held %d", moved, len(before))
+	}
+	after, err := drained.List(ctx, "objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 0 {
+		t.Errorf("%d objects are left on the drained disk", len(after))
+	}
+	checkPlacement(t, b, keys)
+	err = b.Put(ctx, &file.Entry{Key: "objects/new", Value: []byte("new")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := drained.Stat(ctx, "objects/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != nil {
+		t.Error("a new object was written to the draining disk")
+	}
+}
@@ -0,0 +1,190 @@
+package chunker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/damoonazarpazhooh/File-Ingestion/internal/jsonutil"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/file"
+	"github.com/damoonazarpazhooh/File-Ingestion/pkg/utils"
+	"github.com/mitchellh/colorstring"
+	"github.com/palantir/stacktrace"
+)
+
+// Shred - makes snapshot tag unreadable at once by destroying its snapshot
+// key, then deletes its metadata and the chunks only it references to
+// reclaim their space. once the key is gone the snapshot cannot be
+// restored, even if deleting its objects fails; such failures are only
+// reported. convergent chunks may be shared with other snapshots and are
+// kept
+func (s *Multipart) Shred(ctx context.Context, tag string) error {
+	if s.logOps {
+		start := time.Now()
+		defer func() {
+			duration := fmt.Sprintf("[DEBUG] Shred Snapshot operation took (%v) to complete", time.Now().Sub(start))
+			log.Println(duration)
+		}()
+	}
+	result, err := s.disk.Get(ctx, s.metadataKey(tag))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Failed to retrieve metadata for (%s)", tag)
+		return err
+	}
+	if result == nil {
+		err = stacktrace.NewError("[ERROR] snapshot (%s) was not found", tag)
+		return err
+	}
+	snapshotKey, err := s.loadSnapshotKey(ctx, tag)
+	if err != nil {
+		return err
+	}
+	if snapshotKey == nil {
+		err = stacktrace.NewError("[ERROR] snapshot (%s) has no snapshot key; only snapshots taken with per-snapshot keys can be shredded", tag)
+		return err
+	}
+	// the objects of the snapshot can only be found while its metadata is
+	// still readable
+	md, _, err := s.decodeMetadata(ctx, tag, result.Value)
+	if err != nil {
+		return err
+	}
+	objects := []string{}
+	for _, fw := range md.Entities {
+		if !fw.IsFile() || fw.Size == 0 {
+			continue
+		}
+		for _, sec := range md.ChunkMap[fw.Hash] {
+			if len(sec.ID) != 0 {
+				continue
+			}
+			objects = append(objects,
+				s.sectionKey(tag, fw, sec),
+				s.chunkKey(utils.PathJoin(s.rootChunksDir, tag, fw.Path, fmt.Sprintf("%d", sec.Number), ".metadata")),
+			)
+		}
+	}
+	err = s.disk.Delete(ctx, s.snapshotKeyKey(tag))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not destroy the key of snapshot (%s)", tag)
+		return err
+	}
+	err = s.purgeKeyVersions(ctx, s.snapshotKeyKey(tag))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] the key of snapshot (%s) was deleted but prior versions of it are left; the snapshot is NOT shredded", tag)
+		return err
+	}
+	colorstring.Printf("[green]destroyed the key of snapshot (%s)\n", tag)
+	objects = append(objects, s.metadataKey(tag))
+	failed := 0
+	for _, key := range objects {
+		err = s.disk.Delete(ctx, key)
+		if err != nil {
+			failed++
+		}
+	}
+	if failed != 0 {
+		colorstring.Printf("[red][WARN] could not delete (%d) of the (%d) objects of snapshot (%s); they are unreadable already\n", failed, len(objects), tag)
+	}
+	return nil
+}
+
+// purgeKeyVersions removes every prior version of the key material stored
+// at key, failing when any is left. versioned backends do not keep versions
+// of key material they are told about, but may hold some written before
+func (s *Multipart) purgeKeyVersions(ctx context.Context, key string) error {
+	versioner, ok := s.disk.(file.Versioner)
+	if !ok {
+		return nil
+	}
+	_, err := versioner.PurgeVersions(ctx, key, file.PurgePolicy{All: true})
+	if err != nil {
+		return err
+	}
+	left, err := versioner.ListVersions(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(left) != 0 {
+		err = stacktrace.NewError("(%d) versions of (%s) are left", len(left), key)
+		return err
+	}
+	return nil
+}
+
+// snapshotKeyKey returns the key the snapshot key of tag is stored at
+func (s *Multipart) snapshotKeyKey(tag string) string {
+	key := utils.PathJoin(SnapshotKeyPrefix, tag)
+	if s.namingKey == nil {
+		return key
+	}
+	return utils.PathJoin(SnapshotKeyPrefix, s.obfuscate(key))
+}
+
+// newSnapshotKey generates and stores the snapshot key of tag
+func (s *Multipart) newSnapshotKey(ctx context.Context, tag string) ([]byte, error) {
+	key := make([]byte, file.KeySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not generate the key of snapshot (%s)", tag)
+		return nil, err
+	}
+	err = s.disk.Put(ctx, &file.Entry{
+		Key:   s.snapshotKeyKey(tag),
+		Value: key,
+	})
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not store the key of snapshot (%s)", tag)
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadSnapshotKey returns the snapshot key of tag, or nil if it has none
+func (s *Multipart) loadSnapshotKey(ctx context.Context, tag string) ([]byte, error) {
+	entry, err := s.disk.Get(ctx, s.snapshotKeyKey(tag))
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] could not read the key of snapshot (%s)", tag)
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	if len(entry.Value) != file.KeySize {
+		err = stacktrace.NewError("[ERROR] the key of snapshot (%s) must be %d bytes long, got %d", tag, file.KeySize, len(entry.Value))
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// decodeMetadata decodes the metadata of snapshot tag, decrypting it with
+// its snapshot key first when it has one. the snapshot key is returned as
+// well
+func (s *Multipart) decodeMetadata(ctx context.Context, tag string, value []byte) (*SnapshotMetadata, []byte, error) {
+	snapshotKey, err := s.loadSnapshotKey(ctx, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	if snapshotKey != nil {
+		value, err = file.Decrypt(snapshotKey, value)
+		if err != nil {
+			err = stacktrace.Propagate(err, "[ERROR] could not decrypt metadata of (%s) with its snapshot key", tag)
+			return nil, nil, err
+		}
+	} else if !bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+		// metadata is json unless it is sealed with a snapshot key
+		err = stacktrace.NewError("[ERROR] snapshot (%s) was shredded; its key no longer exists", tag)
+		return nil, nil, err
+	}
+	md := &SnapshotMetadata{}
+	err = jsonutil.DecodeJSON(value, md)
+	if err != nil {
+		err = stacktrace.Propagate(err, "[ERROR] Failed to decode metadata of (%s)", tag)
+		return nil, nil, err
+	}
+	return md, snapshotKey, nil
+}
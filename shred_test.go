@@ -0,0 +1,109 @@
+package chunker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	path, err := ioutil.TempDir("", "splitter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	return path
+}
+
+// newTestSplitter snapshots a directory holding a single file of a few
+// chunks, which it returns along with the splitter
+func newTestSplitter(t *testing.T, opts ...Option) (*Multipart, []byte) {
+	t.Helper()
+	root := tempDir(t)
+	data := make([]byte, 300<<10)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "data"), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]Option{
+		WithRootPath(root),
+		WithEncryptionKey(testKey),
+		WithChunkSizeInKilobytes(64),
+		WithNumberOfThreads(2),
+	}, opts...)
+	return New(opts...), data
+}
+
+// restored restores snapshot tag and returns the file it holds. snapshots
+// are restored under the root of s
+func restored(t *testing.T, s *Multipart, tag string) ([]byte, error) {
+	t.Helper()
+	destination, err := ioutil.TempDir(s.root, "restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+	err = s.Restore(context.Background(), filepath.Base(destination), tag)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(destination, tag, "data"))
+}
+
+func TestShred(t *testing.T) {
+	ctx := context.Background()
+	s, data := newTestSplitter(t, WithSnapshotKeys())
+	for _, tag := range []string{"shredded", "kept"} {
+		err := s.Snapshot(ctx, tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	value, err := restored(t, s, "shredded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, data) {
+		t.Fatal("the snapshot was not restored as taken")
+	}
+	err = s.Shred(ctx, "shredded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.disk.Get(ctx, s.snapshotKeyKey("shredded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != nil {
+		t.Error("the snapshot key outlived the snapshot")
+	}
+	chunks, err := s.disk.List(ctx, filepath.Join(s.rootChunksDir, "shredded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("chunks %v of the shredded snapshot are left", chunks)
+	}
+	_, err = restored(t, s, "shredded")
+	if err == nil {
+		t.Error("a shredded snapshot was restored")
+	}
+	value, err = restored(t, s, "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, data) {
+		t.Error("shredding a snapshot damaged another one")
+	}
+}